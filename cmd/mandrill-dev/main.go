@@ -6,14 +6,25 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/jerson/mandrillfordev/internal/api"
 	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
 	"github.com/jerson/mandrillfordev/internal/scheduler"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/smtpd"
 	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/templatedir"
+	"github.com/jerson/mandrillfordev/internal/tracking"
+	"github.com/jerson/mandrillfordev/internal/types"
+	"github.com/jerson/mandrillfordev/internal/webhook"
 )
 
 func main() {
@@ -27,11 +38,68 @@ func main() {
 	}
 
 	cfg := config.Load()
+	tracking.SetSecret(cfg.TrackingSecret)
+	rules, err := simulate.ParseAll(cfg.SimulateRules, cfg.SimulateDefaults)
+	if err != nil {
+		log.Fatalf("SIMULATE_RULES: %v", err)
+	}
+	keys := dkim.NewKeyring(cfg.DKIMKeysDir, cfg.DKIMSelector, cfg.DKIMAlgorithm)
+	if cfg.DKIMSign {
+		if err := keys.LoadAll(); err != nil {
+			log.Fatalf("DKIM_KEYS_DIR: %v", err)
+		}
+	}
 	st := store.NewStore()
-	sched := scheduler.NewScheduler(cfg, st)
+	capture, err := smtpd.NewServer(cfg, func(m *types.CapturedMessage) { api.CaptureMessage(cfg, st, m) })
+	if err != nil {
+		log.Fatalf("smtpd: %v", err)
+	}
+	mailer.SetCaptureServer(capture.Pipe)
+	rt, err := routing.New(cfg)
+	if err != nil {
+		log.Fatalf("UPSTREAMS/ROUTES: %v", err)
+	}
+	var upstreams []string
+	for _, transport := range rt.Transports() {
+		upstreams = append(upstreams, transport)
+	}
+	m, err := mailer.New(cfg, keys, upstreams...)
+	if err != nil {
+		log.Fatalf("TRANSPORT/UPSTREAMS: %v", err)
+	}
+	if cfg.RedirectTo != "" {
+		if _, err := mail.ParseAddress(cfg.RedirectTo); err != nil {
+			log.Fatalf("REDIRECT_TO: %v", err)
+		}
+		log.Printf("redirect mode: all mail goes to %s (allowed domains: %s)", cfg.RedirectTo, strings.Join(cfg.RedirectAllowDomains, ", "))
+	}
+	st.Subscribe(webhook.NewDispatcher(cfg).Notify)
+	queue := delivery.NewQueue(cfg, st, m, rt, rules)
+	queue.Start()
+	sched := scheduler.NewScheduler(cfg, st, queue)
 	sched.Start()
 
-	mux := api.NewMux(cfg, st)
+	if cfg.TemplatesDir != "" {
+		tw := templatedir.NewWatcher(cfg.TemplatesDir, func(req types.TemplateAddRequest) error {
+			_, err := api.ImportTemplate(cfg, st, req)
+			return err
+		}, func(name string) {
+			st.DeleteTemplate(name)
+		})
+		if err := tw.Start(); err != nil {
+			log.Fatalf("templates dir: %v", err)
+		}
+	}
+
+	if cfg.SMTPDAddr != "" {
+		go func() {
+			if err := capture.ListenAndServe(); err != nil {
+				log.Fatalf("smtpd: %v", err)
+			}
+		}()
+	}
+
+	mux := api.NewMux(cfg, st, queue, keys)
 
 	addr := ":8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -102,6 +170,12 @@ func (w *loggingResponseWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush the inbox's event stream.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func isDebug() bool {
 	v := strings.TrimSpace(os.Getenv("MANDRILL_DEBUG"))
 	if v == "" {
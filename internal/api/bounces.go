@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jerson/mandrillfordev/internal/bounce"
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// ProcessBounce parses a raw bounce and applies it to the message it refers
+// to, see delivery.Bounce. rcptTo is the envelope recipient of the bounce,
+// if known. matched reports whether the bounce was applied to a stored
+// message for any of its recipients.
+func ProcessBounce(st *store.Store, raw []byte, rcptTo string) (report *bounce.Report, matched bool, err error) {
+	report, err = bounce.Parse(raw, rcptTo)
+	if err != nil {
+		return report, false, err
+	}
+	if report.MessageID == "" {
+		return report, false, nil
+	}
+	for _, r := range report.Recipients {
+		if delivery.Bounce(st, report.MessageID, r) {
+			matched = true
+		}
+	}
+	return report, matched, nil
+}
+
+// messageRules are the simulation rules for m: its X-MandrillDev-Simulate
+// directive, if any, ahead of the rules q was configured with. m has been
+// validated.
+func messageRules(q *delivery.Queue, m types.MandrillMessage) simulate.Rules {
+	d, _ := simulate.FromHeaders(m.Headers)
+	return d.Rules(q.Rules())
+}
+
+// rejectReason reports why rcpt can't be sent to: it is on the rejects
+// list or matches a simulated reject rule.
+func rejectReason(st *store.Store, rules simulate.Rules, rcpt string) (string, bool) {
+	if r, ok := st.GetReject(rcpt); ok {
+		return r.Reason, true
+	}
+	if rule, ok := rules.Match(rcpt); ok && rule.Action == simulate.Reject {
+		return rule.Detail, true
+	}
+	return "", false
+}
+
+// splitRejected separates rejected addresses from deliverable ones.
+func splitRejected(st *store.Store, rules simulate.Rules, rcpts []string) (keep, rejected []string) {
+	for _, r := range rcpts {
+		if _, ok := rejectReason(st, rules, r); ok {
+			rejected = append(rejected, r)
+		} else {
+			keep = append(keep, r)
+		}
+	}
+	return keep, rejected
+}
+
+// rejectedResults reports rejected addresses with the reason they were
+// rejected for (hard-bounce, custom, ...).
+func rejectedResults(st *store.Store, rules simulate.Rules, id string, rejected []string) []types.SendResult {
+	out := make([]types.SendResult, 0, len(rejected))
+	for _, rcpt := range rejected {
+		reason, ok := rejectReason(st, rules, rcpt)
+		if !ok {
+			reason = "rejected"
+		}
+		out = append(out, types.SendResult{Email: rcpt, Status: "rejected", RejectReason: reason, ID: id})
+	}
+	return out
+}
+
+// undeliverableStatus is the state of a message none of whose recipients
+// can be sent to.
+func undeliverableStatus(rejected []string) string {
+	if len(rejected) > 0 {
+		return "rejected"
+	}
+	return "invalid"
+}
+
+// handleBounce is a development endpoint: it accepts a raw bounce as if it
+// had arrived at the return-path address.
+func handleBounce(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+	var req types.BounceRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := required("raw_message", req.RawMessage); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	report, matched, err := ProcessBounce(st, []byte(req.RawMessage), req.RcptTo)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"matched": matched, "message_id": report.MessageID, "recipients": report.Recipients})
+}
+
+func handleRejectsAdd(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+	var req types.RejectsAddRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := checkEmail("email", req.Email); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	delivery.AddReject(st, req.Email, "custom", req.Comment, "")
+	writeJSON(w, http.StatusOK, map[string]any{"email": req.Email, "added": true})
+}
+
+func handleRejectsList(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+	var req types.RejectsListRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, st.ListRejects(req.Email))
+}
+
+func handleRejectsDelete(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+	var req types.RejectsDeleteRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := required("email", req.Email); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	deleted := st.DeleteReject(req.Email)
+	writeJSON(w, http.StatusOK, map[string]any{"email": req.Email, "deleted": deleted, "subaccount": nil})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// CaptureMessage stores a message received by the embedded SMTP server.
+// A copy of a message sent through the API is linked to it by Message-ID,
+// and mail to a VERP bounce address is processed as a bounce.
+func CaptureMessage(cfg config.Config, st *store.Store, m *types.CapturedMessage) {
+	if id := mailer.MessageID(m.Raw); id != "" {
+		if _, ok := st.GetMessage(id); ok {
+			m.MessageID = id
+		}
+	}
+	st.SaveCaptured(m, cfg.SMTPDMaxMessages)
+	for _, rcpt := range m.RcptTo {
+		if _, ok := mailer.ParseVERP(rcpt); !ok {
+			continue
+		}
+		report, matched, err := ProcessBounce(st, m.Raw, rcpt)
+		switch {
+		case err != nil:
+			log.Printf("smtpd: bounce to %s: %v", rcpt, err)
+		case !matched:
+			log.Printf("smtpd: bounce to %s matched no message", rcpt)
+		default:
+			log.Printf("smtpd: bounce for %s: %d recipient(s)", report.MessageID, len(report.Recipients))
+		}
+	}
+}
+
+// handleCaptured is a development endpoint listing the messages the
+// embedded SMTP server received, newest first, or clearing them.
+func handleCaptured(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	switch r.Method {
+	case http.MethodGet:
+		list := st.ListCaptured()
+		out := make([]types.CapturedMessage, 0, len(list))
+		for _, m := range list {
+			s := *m
+			s.Transcript = nil
+			out = append(out, s)
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, map[string]any{"deleted": st.ClearCaptured()})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleCapturedMessage returns one captured message with its transcript
+// and raw source.
+func handleCapturedMessage(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	m, ok := st.GetCaptured(strings.TrimPrefix(r.URL.Path, "/dev/captured/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		*types.CapturedMessage
+		Raw string `json:"raw"`
+	}{m, string(m.Raw)})
+}
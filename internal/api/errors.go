@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// Mandrill error names and their numeric codes.
+const (
+	errInvalidKey      = "Invalid_Key"
+	errValidation      = "ValidationError"
+	errUnknownTemplate = "Unknown_Template"
+	errInvalidTemplate = "Invalid_Template"
+	errUnknownMessage  = "Unknown_Message"
+)
+
+var errorCodes = map[string]int{
+	errInvalidKey:      -1,
+	errValidation:      -2,
+	errUnknownTemplate: 5,
+	errInvalidTemplate: 6,
+	errUnknownMessage:  11,
+}
+
+// writeError reports a failure in Mandrill's error shape. Strict mode
+// mirrors production and always answers HTTP 500; otherwise the given
+// status is used and the message is repeated under "error" for older
+// clients of this server.
+func writeError(w http.ResponseWriter, cfg config.Config, status int, name, message string) {
+	body := map[string]any{
+		"status":  "error",
+		"code":    errorCodes[name],
+		"name":    name,
+		"message": message,
+	}
+	if cfg.Strict {
+		status = http.StatusInternalServerError
+	} else {
+		body["error"] = message
+	}
+	writeJSON(w, status, body)
+}
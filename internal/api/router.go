@@ -14,12 +14,18 @@ import (
 	"time"
 
 	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/inbox"
 	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/merge"
+	"github.com/jerson/mandrillfordev/internal/simulate"
 	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/tracking"
 	"github.com/jerson/mandrillfordev/internal/types"
 )
 
-func NewMux(cfg config.Config, st *store.Store) http.Handler {
+func NewMux(cfg config.Config, st *store.Store, q *delivery.Queue, keys *dkim.Keyring) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/messages/send", func(w http.ResponseWriter, r *http.Request) {
@@ -27,21 +33,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleSend(w, r, cfg, st)
+		handleSend(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/messages/send.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSend(w, r, cfg, st)
+		handleSend(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/api/1.0/messages/send.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSend(w, r, cfg, st)
+		handleSend(w, r, cfg, st, q)
 	})
 
 	mux.HandleFunc("/messages/send-template", func(w http.ResponseWriter, r *http.Request) {
@@ -49,21 +55,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendTemplate(w, r, cfg, st)
+		handleSendTemplate(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/messages/send-template.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendTemplate(w, r, cfg, st)
+		handleSendTemplate(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/api/1.0/messages/send-template.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendTemplate(w, r, cfg, st)
+		handleSendTemplate(w, r, cfg, st, q)
 	})
 
 	mux.HandleFunc("/messages/send-raw", func(w http.ResponseWriter, r *http.Request) {
@@ -71,21 +77,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendRaw(w, r, cfg, st)
+		handleSendRaw(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/messages/send-raw.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendRaw(w, r, cfg, st)
+		handleSendRaw(w, r, cfg, st, q)
 	})
 	mux.HandleFunc("/api/1.0/messages/send-raw.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSendRaw(w, r, cfg, st)
+		handleSendRaw(w, r, cfg, st, q)
 	})
 
 	mux.HandleFunc("/messages/parse", func(w http.ResponseWriter, r *http.Request) {
@@ -93,21 +99,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleParse(w, r)
+		handleParse(w, r, cfg)
 	})
 	mux.HandleFunc("/messages/parse.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleParse(w, r)
+		handleParse(w, r, cfg)
 	})
 	mux.HandleFunc("/api/1.0/messages/parse.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleParse(w, r)
+		handleParse(w, r, cfg)
 	})
 
 	mux.HandleFunc("/messages/info", func(w http.ResponseWriter, r *http.Request) {
@@ -115,21 +121,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleInfo(w, r, st)
+		handleInfo(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/info.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleInfo(w, r, st)
+		handleInfo(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/info.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleInfo(w, r, st)
+		handleInfo(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/content", func(w http.ResponseWriter, r *http.Request) {
@@ -137,21 +143,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleContent(w, r, st)
+		handleContent(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/content.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleContent(w, r, st)
+		handleContent(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/content.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleContent(w, r, st)
+		handleContent(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/search", func(w http.ResponseWriter, r *http.Request) {
@@ -159,21 +165,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearch(w, r, st)
+		handleSearch(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/search.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearch(w, r, st)
+		handleSearch(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/search.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearch(w, r, st)
+		handleSearch(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/search-time-series", func(w http.ResponseWriter, r *http.Request) {
@@ -181,21 +187,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearchTimeSeries(w, r, st)
+		handleSearchTimeSeries(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/search-time-series.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearchTimeSeries(w, r, st)
+		handleSearchTimeSeries(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/search-time-series.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleSearchTimeSeries(w, r, st)
+		handleSearchTimeSeries(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/list-scheduled", func(w http.ResponseWriter, r *http.Request) {
@@ -203,21 +209,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleListScheduled(w, r, st)
+		handleListScheduled(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/list-scheduled.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleListScheduled(w, r, st)
+		handleListScheduled(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/list-scheduled.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleListScheduled(w, r, st)
+		handleListScheduled(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/cancel-scheduled", func(w http.ResponseWriter, r *http.Request) {
@@ -225,21 +231,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleCancelScheduled(w, r, st)
+		handleCancelScheduled(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/cancel-scheduled.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleCancelScheduled(w, r, st)
+		handleCancelScheduled(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/cancel-scheduled.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleCancelScheduled(w, r, st)
+		handleCancelScheduled(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/messages/reschedule", func(w http.ResponseWriter, r *http.Request) {
@@ -247,21 +253,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleReschedule(w, r, st)
+		handleReschedule(w, r, cfg, st)
 	})
 	mux.HandleFunc("/messages/reschedule.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleReschedule(w, r, st)
+		handleReschedule(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/messages/reschedule.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleReschedule(w, r, st)
+		handleReschedule(w, r, cfg, st)
 	})
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -269,6 +275,14 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 		_, _ = w.Write([]byte("ok"))
 	})
 
+	// Open/click tracking
+	mux.HandleFunc(tracking.OpenPath, func(w http.ResponseWriter, r *http.Request) {
+		handleTrackOpen(w, r, st)
+	})
+	mux.HandleFunc(tracking.ClickPath, func(w http.ResponseWriter, r *http.Request) {
+		handleTrackClick(w, r, st)
+	})
+
 	// Templates endpoints
 	// add
 	mux.HandleFunc("/templates/add", func(w http.ResponseWriter, r *http.Request) {
@@ -276,21 +290,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateAdd(w, r, st)
+		handleTemplateAdd(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/add.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateAdd(w, r, st)
+		handleTemplateAdd(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/add.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateAdd(w, r, st)
+		handleTemplateAdd(w, r, cfg, st)
 	})
 	// info
 	mux.HandleFunc("/templates/info", func(w http.ResponseWriter, r *http.Request) {
@@ -298,21 +312,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateInfo(w, r, st)
+		handleTemplateInfo(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/info.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateInfo(w, r, st)
+		handleTemplateInfo(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/info.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateInfo(w, r, st)
+		handleTemplateInfo(w, r, cfg, st)
 	})
 	// update
 	mux.HandleFunc("/templates/update", func(w http.ResponseWriter, r *http.Request) {
@@ -320,21 +334,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateUpdate(w, r, st)
+		handleTemplateUpdate(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/update.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateUpdate(w, r, st)
+		handleTemplateUpdate(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/update.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateUpdate(w, r, st)
+		handleTemplateUpdate(w, r, cfg, st)
 	})
 	// publish
 	mux.HandleFunc("/templates/publish", func(w http.ResponseWriter, r *http.Request) {
@@ -342,21 +356,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplatePublish(w, r, st)
+		handleTemplatePublish(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/publish.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplatePublish(w, r, st)
+		handleTemplatePublish(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/publish.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplatePublish(w, r, st)
+		handleTemplatePublish(w, r, cfg, st)
 	})
 	// delete
 	mux.HandleFunc("/templates/delete", func(w http.ResponseWriter, r *http.Request) {
@@ -364,21 +378,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateDelete(w, r, st)
+		handleTemplateDelete(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/delete.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateDelete(w, r, st)
+		handleTemplateDelete(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/delete.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateDelete(w, r, st)
+		handleTemplateDelete(w, r, cfg, st)
 	})
 	// list
 	mux.HandleFunc("/templates/list", func(w http.ResponseWriter, r *http.Request) {
@@ -386,21 +400,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateList(w, r, st)
+		handleTemplateList(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/list.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateList(w, r, st)
+		handleTemplateList(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/list.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateList(w, r, st)
+		handleTemplateList(w, r, cfg, st)
 	})
 	// time-series
 	mux.HandleFunc("/templates/time-series", func(w http.ResponseWriter, r *http.Request) {
@@ -408,21 +422,21 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateTimeSeries(w, r, st)
+		handleTemplateTimeSeries(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/time-series.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateTimeSeries(w, r, st)
+		handleTemplateTimeSeries(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/time-series.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateTimeSeries(w, r, st)
+		handleTemplateTimeSeries(w, r, cfg, st)
 	})
 	// render
 	mux.HandleFunc("/templates/render", func(w http.ResponseWriter, r *http.Request) {
@@ -430,110 +444,242 @@ func NewMux(cfg config.Config, st *store.Store) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateRender(w, r, st)
+		handleTemplateRender(w, r, cfg, st)
 	})
 	mux.HandleFunc("/templates/render.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateRender(w, r, st)
+		handleTemplateRender(w, r, cfg, st)
 	})
 	mux.HandleFunc("/api/1.0/templates/render.json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.NotFound(w, r)
 			return
 		}
-		handleTemplateRender(w, r, st)
+		handleTemplateRender(w, r, cfg, st)
+	})
+
+	// Senders endpoints
+	mux.HandleFunc("/senders/domains", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleSendersDomains(w, r, cfg, st, keys)
+	})
+	mux.HandleFunc("/senders/domains.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleSendersDomains(w, r, cfg, st, keys)
+	})
+	mux.HandleFunc("/api/1.0/senders/domains.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleSendersDomains(w, r, cfg, st, keys)
 	})
 
+	// Rejects endpoints
+	// add
+	mux.HandleFunc("/rejects/add", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsAdd(w, r, cfg, st)
+	})
+	mux.HandleFunc("/rejects/add.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsAdd(w, r, cfg, st)
+	})
+	mux.HandleFunc("/api/1.0/rejects/add.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsAdd(w, r, cfg, st)
+	})
+	// list
+	mux.HandleFunc("/rejects/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsList(w, r, cfg, st)
+	})
+	mux.HandleFunc("/rejects/list.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsList(w, r, cfg, st)
+	})
+	mux.HandleFunc("/api/1.0/rejects/list.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsList(w, r, cfg, st)
+	})
+	// delete
+	mux.HandleFunc("/rejects/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsDelete(w, r, cfg, st)
+	})
+	mux.HandleFunc("/rejects/delete.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsDelete(w, r, cfg, st)
+	})
+	mux.HandleFunc("/api/1.0/rejects/delete.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleRejectsDelete(w, r, cfg, st)
+	})
+
+	// Development endpoints
+	mux.HandleFunc("/dev/bounce", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		handleBounce(w, r, cfg, st)
+	})
+	mux.Handle("/dev/smtp-pool", strictKey(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, mailer.Stats())
+	})))
+	mux.Handle("/dev/captured", strictKey(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleCaptured(w, r, st)
+	})))
+	mux.Handle("/dev/captured/", strictKey(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleCapturedMessage(w, r, st)
+	})))
+	if cfg.Inbox {
+		ui := strictKey(cfg, inbox.NewHandler(cfg, st))
+		mux.Handle("/inbox", ui)
+		mux.Handle("/inbox/", ui)
+	}
+
 	return mux
 }
 
 // Handlers
-func handleSend(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+func handleSend(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, q *delivery.Queue) {
 	var req types.SendRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := validateSend(cfg, req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
+	applyKeyDefaults(cfg, req.Key, &req.Message)
 
-	var scheduledAt *time.Time
-	if strings.TrimSpace(req.SendAt) != "" {
-		if t, err := parseTime(req.SendAt); err == nil {
-			scheduledAt = &t
+	if cfg.Strict {
+		if err := checkMessageConstraints(req.Message); err != nil {
+			writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+			return
 		}
 	}
-
-	id := genID()
-	rcpts := recipientsFromMessage(req.Message)
-	if len(rcpts) == 0 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "no recipients"})
+	scheduledAt, err := parseSendAt(cfg, req.SendAt)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 
-	rec := &types.MessageRecord{ID: id, CreatedAt: time.Now(), ScheduledAt: scheduledAt, Status: "queued", Message: req.Message, From: req.Message.FromEmail, To: rcpts, Subject: req.Message.Subject, Tags: req.Message.Tags}
-
-	var results []types.SendResult
-	for _, rcpt := range rcpts {
-		results = append(results, types.SendResult{Email: rcpt, Status: "queued", ID: id})
-	}
-
-	if scheduledAt != nil && scheduledAt.After(time.Now()) {
-		rec.Status = "scheduled"
-		st.AddScheduled(rec)
-		for i := range results {
-			results[i].Status = "scheduled"
-		}
-		writeJSON(w, http.StatusOK, results)
+	rcpts, invalid := recipientsFromMessage(req.Message)
+	if len(rcpts) == 0 && len(invalid) == 0 {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, "no recipients")
 		return
 	}
+	rules := messageRules(q, req.Message)
+	rcpts, rejected := splitRejected(st, rules, rcpts)
+	req.Message = withoutRecipients(req.Message, append(invalid, rejected...))
 
-	if err := mailer.SendMessage(cfg, req.Message, id, &rec.Raw); err != nil {
-		rec.Status = "rejected"
-		rec.RejectReason = err.Error()
-		st.SaveMessage(rec)
-		for i := range results {
-			results[i].Status = "rejected"
-			results[i].RejectReason = rec.RejectReason
+	lint := lintMessage(req.Message, nil)
+	merged := req.Message.Merge || len(req.Message.GlobalMergeVars) > 0 || len(req.Message.MergeVars) > 0
+
+	results := sendEach(cfg, st, q, req.Message, invalid, rejected, rules, scheduledAt, req.Async, func(id string, m types.MandrillMessage, to []string) *types.MessageRecord {
+		if merged {
+			mergeMessage(&m, nil)
 		}
-		writeJSON(w, http.StatusOK, results)
-		return
-	}
-	now := time.Now()
-	rec.SentAt = &now
-	rec.Status = "sent"
-	st.SaveMessage(rec)
-	for i := range results {
-		results[i].Status = "sent"
-	}
+		return &types.MessageRecord{ID: id, CreatedAt: time.Now(), ScheduledAt: scheduledAt, Status: "queued", Message: m, From: m.FromEmail, To: to, Subject: m.Subject, Tags: m.Tags, Lint: lint, Key: req.Key, IPPool: req.IPPool}
+	})
 	writeJSON(w, http.StatusOK, results)
 }
 
-func handleSendTemplate(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+func handleSendTemplate(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, q *delivery.Queue) {
 	var req types.SendTemplateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
+	if err := validateSendTemplate(cfg, req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	applyKeyDefaults(cfg, req.Key, &req.Message)
 
-	vars := map[string]string{}
+	// A stored template replaces the message body; subject and sender fall
+	// back to the template when the message leaves them empty.
+	t, ok := st.GetTemplate(req.TemplateName)
+	if !ok && cfg.Strict {
+		writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.TemplateName))
+		return
+	}
+	if ok {
+		html, text, subject := templateVersion(t, false)
+		req.Message.HTML, req.Message.Text = html, text
+		if strings.TrimSpace(req.Message.Subject) == "" {
+			req.Message.Subject = subject
+		}
+		if strings.TrimSpace(req.Message.FromEmail) == "" {
+			req.Message.FromEmail = t.FromEmail
+		}
+		if strings.TrimSpace(req.Message.FromName) == "" {
+			req.Message.FromName = t.FromName
+		}
+	}
+
+	lint := lintMessage(req.Message, req.TemplateContent)
+
+	content := map[string]string{}
 	for _, tc := range req.TemplateContent {
-		vars[tc.Name] = tc.Content
+		content[tc.Name] = tc.Content
 	}
-	req.Message.HTML = replaceVars(req.Message.HTML, vars)
-	req.Message.Text = replaceVars(req.Message.Text, vars)
+	req.Message.HTML = merge.FillEditable(req.Message.HTML, content)
 
 	sr := types.SendRequest{Key: req.Key, Message: req.Message, Async: req.Async, IPPool: req.IPPool, SendAt: req.SendAt}
 	// In debug mode, append the original (sanitized) request to the message body for troubleshooting
+	var debugRequest []byte
 	if isDebug() {
 		dbg := map[string]any{
 			"template_name":    req.TemplateName,
@@ -544,164 +690,154 @@ func handleSendTemplate(w http.ResponseWriter, r *http.Request, cfg config.Confi
 			"send_at":          req.SendAt,
 			"_note":            "Debug info: original send-template request (key omitted)",
 		}
-		if b, err := json.MarshalIndent(dbg, "", "  "); err == nil {
-			// Text part
-			if strings.TrimSpace(sr.Message.Text) == "" {
-				sr.Message.Text = string(b)
-			} else {
-				sr.Message.Text += "\n\n---- debug: send-template request ----\n" + string(b)
-			}
-			// HTML part
-			esc := html.EscapeString(string(b))
-			if strings.TrimSpace(sr.Message.HTML) == "" {
-				sr.Message.HTML = "<pre style=\"white-space:pre-wrap\">" + esc + "</pre>"
-			} else {
-				sr.Message.HTML += "<hr><h4>Debug: send-template request</h4><pre style=\"white-space:pre-wrap\">" + esc + "</pre>"
-			}
-		}
+		debugRequest, _ = json.MarshalIndent(dbg, "", "  ")
 	}
-	var scheduledAt *time.Time
-	if strings.TrimSpace(sr.SendAt) != "" {
-		if t, err := parseTime(sr.SendAt); err == nil {
-			scheduledAt = &t
+	if cfg.Strict {
+		if err := checkMessageConstraints(sr.Message); err != nil {
+			writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+			return
 		}
 	}
-	id := genID()
-	rcpts := recipientsFromMessage(sr.Message)
-	if len(rcpts) == 0 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "no recipients"})
+	scheduledAt, err := parseSendAt(cfg, sr.SendAt)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	rcpts, invalid := recipientsFromMessage(sr.Message)
+	if len(rcpts) == 0 && len(invalid) == 0 {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, "no recipients")
 		return
 	}
+	rules := messageRules(q, sr.Message)
+	rcpts, rejected := splitRejected(st, rules, rcpts)
+	sr.Message = withoutRecipients(sr.Message, append(invalid, rejected...))
 
 	// include template name for later stats and discovery
 	tags := append([]string{}, sr.Message.Tags...)
 	if strings.TrimSpace(req.TemplateName) != "" {
 		tags = append(tags, "template:"+req.TemplateName)
 	}
-	rec := &types.MessageRecord{ID: id, CreatedAt: time.Now(), ScheduledAt: scheduledAt, Status: "queued", Message: sr.Message, From: sr.Message.FromEmail, To: rcpts, Subject: sr.Message.Subject, Tags: tags, TemplateName: req.TemplateName}
-	var results []types.SendResult
-	for _, rcpt := range rcpts {
-		results = append(results, types.SendResult{Email: rcpt, Status: "queued", ID: id})
-	}
-	if scheduledAt != nil && scheduledAt.After(time.Now()) {
-		rec.Status = "scheduled"
-		st.AddScheduled(rec)
-		for i := range results {
-			results[i].Status = "scheduled"
-		}
-		writeJSON(w, http.StatusOK, results)
-		return
-	}
-	if err := mailer.SendMessage(cfg, sr.Message, id, &rec.Raw); err != nil {
-		rec.Status = "rejected"
-		rec.RejectReason = err.Error()
-		st.SaveMessage(rec)
-		for i := range results {
-			results[i].Status = "rejected"
-			results[i].RejectReason = rec.RejectReason
+	results := sendEach(cfg, st, q, sr.Message, invalid, rejected, rules, scheduledAt, req.Async, func(id string, m types.MandrillMessage, to []string) *types.MessageRecord {
+		mergeMessage(&m, content)
+		if debugRequest != nil {
+			// Text part
+			if strings.TrimSpace(m.Text) == "" {
+				m.Text = string(debugRequest)
+			} else {
+				m.Text += "\n\n---- debug: send-template request ----\n" + string(debugRequest)
+			}
+			// HTML part
+			esc := html.EscapeString(string(debugRequest))
+			if strings.TrimSpace(m.HTML) == "" {
+				m.HTML = "<pre style=\"white-space:pre-wrap\">" + esc + "</pre>"
+			} else {
+				m.HTML += "<hr><h4>Debug: send-template request</h4><pre style=\"white-space:pre-wrap\">" + esc + "</pre>"
+			}
 		}
-		writeJSON(w, http.StatusOK, results)
-		return
-	}
-	now := time.Now()
-	rec.SentAt = &now
-	rec.Status = "sent"
-	st.SaveMessage(rec)
-	for i := range results {
-		results[i].Status = "sent"
-	}
+		return &types.MessageRecord{ID: id, CreatedAt: time.Now(), ScheduledAt: scheduledAt, Status: "queued", Message: m, From: m.FromEmail, To: to, Subject: m.Subject, Tags: tags, TemplateName: req.TemplateName, Lint: lint, Key: req.Key, IPPool: req.IPPool}
+	})
 	writeJSON(w, http.StatusOK, results)
 }
 
-func handleSendRaw(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+func handleSendRaw(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, q *delivery.Queue) {
 	var req types.SendRawRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := validateSendRaw(cfg, req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 
 	from := strings.TrimSpace(req.FromEmail)
+	if from == "" && cfg.Strict {
+		if addr, err := mail.ParseAddress(extractHeader(req.RawMessage, "From")); err == nil {
+			from = addr.Address
+		} else {
+			writeError(w, cfg, http.StatusBadRequest, errValidation, "from_email: required when the raw message has no From header")
+			return
+		}
+	}
 	if from == "" {
 		from = "no-reply@example.local"
 	}
-	to := make([]string, 0, len(req.To))
+	var to, invalid []string
 	for _, a := range req.To {
-		if strings.TrimSpace(a) != "" {
-			to = append(to, strings.TrimSpace(a))
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if validRecipient(a) {
+			to = append(to, a)
+		} else {
+			invalid = append(invalid, a)
 		}
 	}
-	if len(to) == 0 {
+	if len(to) == 0 && len(invalid) == 0 {
 		if hdrTo := extractHeader(req.RawMessage, "To"); hdrTo != "" {
-			parts := strings.Split(hdrTo, ",")
-			for _, p := range parts {
-				if addr, err := mail.ParseAddress(strings.TrimSpace(p)); err == nil {
-					to = append(to, addr.Address)
-				}
-			}
+			to, invalid = headerRecipients(hdrTo)
 		}
 	}
-	if len(to) == 0 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "no recipients"})
+	if len(to) == 0 && len(invalid) == 0 {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, "no recipients")
 		return
 	}
 
+	rules := q.Rules()
+	to, rejected := splitRejected(st, rules, to)
+
 	id := genID()
-	rec := &types.MessageRecord{ID: id, CreatedAt: time.Now(), Status: "queued", From: from, To: to, Subject: extractHeader(req.RawMessage, "Subject")}
-	var scheduledAt *time.Time
-	if strings.TrimSpace(req.SendAt) != "" {
-		if t, err := parseTime(req.SendAt); err == nil {
-			scheduledAt = &t
-		}
+	rec := &types.MessageRecord{ID: id, CreatedAt: time.Now(), Status: "queued", From: from, To: to, Subject: extractHeader(req.RawMessage, "Subject"), Raw: []byte(req.RawMessage), Key: req.Key, IPPool: req.IPPool}
+	scheduledAt, err := parseSendAt(cfg, req.SendAt)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	results := append(newResults(id, to, invalid), rejectedResults(st, rules, id, rejected)...)
+	if len(to) == 0 {
+		rec.Status = undeliverableStatus(rejected)
+		st.SaveMessage(rec)
+		delivery.RecordRejects(st, id, results)
+		writeJSON(w, http.StatusOK, results)
+		return
 	}
+	rec.Message = types.MandrillMessage{FromEmail: from, FromName: req.FromName, To: toRecipients(to), ReturnPathDomain: req.ReturnPathDomain}
 	if scheduledAt != nil && scheduledAt.After(time.Now()) {
 		rec.ScheduledAt = scheduledAt
-		rec.Raw = []byte(req.RawMessage)
-		rec.Message = types.MandrillMessage{FromEmail: from, FromName: req.FromName, To: toRecipients(to)}
 		rec.Status = "scheduled"
 		st.AddScheduled(rec)
-		var results []types.SendResult
-		for _, rcpt := range to {
-			results = append(results, types.SendResult{Email: rcpt, Status: "scheduled", ID: id})
-		}
+		setStatus(results, "scheduled", "")
 		writeJSON(w, http.StatusOK, results)
 		return
 	}
-	if err := mailer.SendRaw(cfg, from, to, []byte(req.RawMessage)); err != nil {
-		rec.Status = "rejected"
-		rec.RejectReason = err.Error()
-		st.SaveMessage(rec)
-		var results []types.SendResult
-		for _, rcpt := range to {
-			results = append(results, types.SendResult{Email: rcpt, Status: "rejected", ID: id, RejectReason: rec.RejectReason})
-		}
-		writeJSON(w, http.StatusOK, results)
-		return
-	}
-	now := time.Now()
-	rec.SentAt = &now
-	rec.Status = "sent"
-	rec.Raw = []byte(req.RawMessage)
-	st.SaveMessage(rec)
-	var results []types.SendResult
-	for _, rcpt := range to {
-		results = append(results, types.SendResult{Email: rcpt, Status: "sent", ID: id})
-	}
+	deliverRecord(cfg, st, q, rec, results, req.Async)
 	writeJSON(w, http.StatusOK, results)
 }
 
-func handleParse(w http.ResponseWriter, r *http.Request) {
+func handleParse(w http.ResponseWriter, r *http.Request, cfg config.Config) {
 	var req types.ParseRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
+	if err := required("raw_message", req.RawMessage); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	msg, err := mail.ReadMessage(strings.NewReader(req.RawMessage))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid mime"})
+		writeError(w, cfg, http.StatusBadRequest, errValidation, "invalid mime")
 		return
 	}
 	subj := msg.Header.Get("Subject")
@@ -711,52 +847,77 @@ func handleParse(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{"subject": subj, "from": from, "to": to, "raw": string(b), "headers": msg.Header})
 }
 
-func handleInfo(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleInfo(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.InfoRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if req.Id == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing id"})
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
+	if err := required("id", req.Id); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if m, ok := st.GetMessage(req.Id); ok {
 		writeJSON(w, http.StatusOK, m)
 		return
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	writeError(w, cfg, http.StatusNotFound, errUnknownMessage, fmt.Sprintf("No message exists with the id %q", req.Id))
 }
 
-func handleContent(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleContent(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.ContentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
+	if err := required("id", req.Id); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if m, ok := st.GetMessage(req.Id); ok {
 		writeJSON(w, http.StatusOK, map[string]any{"raw": string(m.Raw), "subject": m.Subject, "from": m.From, "to": m.To})
 		return
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	writeError(w, cfg, http.StatusNotFound, errUnknownMessage, fmt.Sprintf("No message exists with the id %q", req.Id))
 }
 
-func handleSearch(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleSearch(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.SearchRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	var fromT, toT *time.Time
-	if strings.TrimSpace(req.DateFrom) != "" {
-		if t, err := parseTime(req.DateFrom); err == nil {
-			fromT = &t
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
 		}
 	}
-	if strings.TrimSpace(req.DateTo) != "" {
-		if t, err := parseTime(req.DateTo); err == nil {
-			toT = &t
-		}
+	fromT, err := parseSearchDate(cfg, "date_from", req.DateFrom)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	toT, err := parseSearchDate(cfg, "date_to", req.DateTo)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if cfg.Strict && req.Limit > maxSearchLimit {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, fmt.Sprintf("limit: must be %d or less", maxSearchLimit))
+		return
 	}
 	limit := req.Limit
 	if limit <= 0 {
@@ -766,7 +927,18 @@ func handleSearch(w http.ResponseWriter, r *http.Request, st *store.Store) {
 	writeJSON(w, http.StatusOK, res)
 }
 
-func handleSearchTimeSeries(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleSearchTimeSeries(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
+	if cfg.Strict {
+		var req types.SearchTimeSeriesRequest
+		if err := decodeRequest(r, &req); err != nil {
+			writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+			return
+		}
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
 	type point struct {
 		Time string `json:"time"`
 		Sent int    `json:"sent"`
@@ -793,20 +965,36 @@ func handleSearchTimeSeries(w http.ResponseWriter, r *http.Request, st *store.St
 	writeJSON(w, http.StatusOK, out)
 }
 
-func handleListScheduled(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleListScheduled(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.ListScheduledRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
 	items := st.ListScheduled(req.To)
 	writeJSON(w, http.StatusOK, items)
 }
 
-func handleCancelScheduled(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleCancelScheduled(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.CancelScheduledRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
+	if err := required("id", req.Id); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if m, ok := st.RemoveScheduled(req.Id); ok {
@@ -815,45 +1003,80 @@ func handleCancelScheduled(w http.ResponseWriter, r *http.Request, st *store.Sto
 		writeJSON(w, http.StatusOK, map[string]any{"status": "canceled", "id": req.Id})
 		return
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	writeError(w, cfg, http.StatusNotFound, errUnknownMessage, fmt.Sprintf("No message exists with the id %q", req.Id))
 }
 
-func handleReschedule(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleReschedule(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.RescheduleRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	t, err := parseTime(req.SendAt)
+	if cfg.Strict {
+		if err := requireKey(cfg, req.Key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+	}
+	if err := required("id", req.Id); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := required("send_at", req.SendAt); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	t, err := parseSendAt(cfg, req.SendAt)
+	if err == nil && t == nil {
+		err = fmt.Errorf("invalid send_at")
+	}
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid send_at"})
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if m, ok := st.GetScheduled(req.Id); ok {
-		m.ScheduledAt = &t
+		m.ScheduledAt = t
 		m.Status = "scheduled"
 		st.SaveMessage(m)
 		writeJSON(w, http.StatusOK, m)
 		return
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	writeError(w, cfg, http.StatusNotFound, errUnknownMessage, fmt.Sprintf("No message exists with the id %q", req.Id))
 }
 
 // Templates Handlers
-func handleTemplateAdd(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateAdd(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateAddRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := validateTemplateFields(cfg, req.Name, req.FromEmail); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if _, exists := st.GetTemplate(req.Name); exists && cfg.Strict {
+		writeError(w, cfg, http.StatusBadRequest, errInvalidTemplate, fmt.Sprintf("A template with name %q already exists", req.Name))
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	t, err := AddTemplate(st, req)
+	if err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// AddTemplate stores a template built from an add request. It backs the
+// templates/add endpoint and imports of new templates, see ImportTemplate.
+func AddTemplate(st *store.Store, req types.TemplateAddRequest) (*types.Template, error) {
 	name := strings.TrimSpace(req.Name)
 	if name == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing name"})
-		return
+		return nil, fmt.Errorf("missing name")
 	}
 	now := time.Now()
 	t := &types.Template{
@@ -870,26 +1093,67 @@ func handleTemplateAdd(w http.ResponseWriter, r *http.Request, st *store.Store)
 	if req.Publish {
 		t.PublishedCode = t.Code
 		t.PublishedText = t.Text
+		t.PublishedSubject = t.Subject
 		t.PublishedAt = &now
 	}
 	st.SaveTemplate(t)
-	writeJSON(w, http.StatusOK, t)
+	return t, nil
 }
 
-func handleTemplateInfo(w http.ResponseWriter, r *http.Request, st *store.Store) {
+// ImportTemplate stores a template read from TEMPLATES_DIR, validated like
+// one sent to templates/add. Reloading a template that is already stored
+// keeps its creation time, and keeps its published version unless the
+// import publishes different content.
+func ImportTemplate(cfg config.Config, st *store.Store, req types.TemplateAddRequest) (*types.Template, error) {
+	if err := validateTemplateFields(cfg, req.Name, req.FromEmail); err != nil {
+		return nil, err
+	}
+	old, ok := st.GetTemplate(req.Name)
+	if !ok {
+		return AddTemplate(st, req)
+	}
+	now := time.Now()
+	t := *old
+	t.Name = strings.TrimSpace(req.Name)
+	t.FromEmail = req.FromEmail
+	t.FromName = req.FromName
+	t.Subject = req.Subject
+	t.Code = req.Code
+	t.Text = req.Text
+	t.Labels = append([]string{}, req.Labels...)
+	t.UpdatedAt = now
+	if req.Publish && (t.PublishedAt == nil || t.PublishedCode != t.Code || t.PublishedText != t.Text || t.PublishedSubject != t.Subject) {
+		t.PublishedCode = t.Code
+		t.PublishedText = t.Text
+		t.PublishedSubject = t.Subject
+		t.PublishedAt = &now
+	}
+	st.SaveTemplate(&t)
+	return &t, nil
+}
+
+func handleTemplateInfo(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateInfoRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := required("name", req.Name); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if t, ok := st.GetTemplate(req.Name); ok {
 		writeJSON(w, http.StatusOK, t)
 		return
 	}
+	if cfg.Strict {
+		writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.Name))
+		return
+	}
 	// Not found: return a synthetic template to "fake it's there"
 	now := time.Now()
 	t := &types.Template{
@@ -900,19 +1164,23 @@ func handleTemplateInfo(w http.ResponseWriter, r *http.Request, st *store.Store)
 	writeJSON(w, http.StatusOK, t)
 }
 
-func handleTemplateUpdate(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateUpdate(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateUpdateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := validateTemplateUpdate(cfg, req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	t, ok := st.GetTemplate(req.Name)
 	if !ok {
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.Name))
 		return
 	}
 	changed := false
@@ -944,6 +1212,7 @@ func handleTemplateUpdate(w http.ResponseWriter, r *http.Request, st *store.Stor
 		now := time.Now()
 		t.PublishedCode = t.Code
 		t.PublishedText = t.Text
+		t.PublishedSubject = t.Subject
 		t.PublishedAt = &now
 		changed = true
 	}
@@ -954,69 +1223,82 @@ func handleTemplateUpdate(w http.ResponseWriter, r *http.Request, st *store.Stor
 	writeJSON(w, http.StatusOK, t)
 }
 
-func handleTemplatePublish(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplatePublish(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplatePublishRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := required("name", req.Name); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	t, ok := st.GetTemplate(req.Name)
 	if !ok {
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.Name))
 		return
 	}
 	now := time.Now()
 	t.PublishedCode = t.Code
 	t.PublishedText = t.Text
+	t.PublishedSubject = t.Subject
 	t.PublishedAt = &now
 	t.UpdatedAt = now
 	st.SaveTemplate(t)
 	writeJSON(w, http.StatusOK, t)
 }
 
-func handleTemplateDelete(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateDelete(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateDeleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := required("name", req.Name); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	if t, ok := st.DeleteTemplate(req.Name); ok {
 		writeJSON(w, http.StatusOK, t)
 		return
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.Name))
 }
 
-func handleTemplateList(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateList(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateListRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
 	list := st.ListTemplates(req.Label)
 	writeJSON(w, http.StatusOK, list)
 }
 
-func handleTemplateTimeSeries(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateTimeSeries(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateTimeSeriesRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+	if err := required("name", req.Name); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	// Build hourly buckets for the last 30 days
@@ -1049,33 +1331,50 @@ func handleTemplateTimeSeries(w http.ResponseWriter, r *http.Request, st *store.
 	writeJSON(w, http.StatusOK, out)
 }
 
-func handleTemplateRender(w http.ResponseWriter, r *http.Request, st *store.Store) {
+func handleTemplateRender(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) {
 	var req types.TemplateRenderRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
 		return
 	}
-	if err := requireKey(req.Key); err != nil {
-		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	if err := validateTemplateRender(req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
 		return
 	}
 	t, _ := st.GetTemplate(req.TemplateName)
-	// Prefer published code, fallback to draft code if none
-	code := ""
-	if t != nil {
-		if strings.TrimSpace(t.PublishedCode) != "" {
-			code = t.PublishedCode
-		} else {
-			code = t.Code
-		}
+	if t == nil && cfg.Strict {
+		writeError(w, cfg, http.StatusNotFound, errUnknownTemplate, fmt.Sprintf("No such template %q", req.TemplateName))
+		return
 	}
 	// If no stored template, render the merge-only content; some clients may expect variable injection without stored template
-	vars := map[string]string{}
+	var code, text, subject string
+	if t != nil {
+		code, text, subject = templateVersion(t, req.Draft)
+	}
+	content := map[string]string{}
+	names := make([]string, 0, len(req.TemplateContent))
 	for _, tc := range req.TemplateContent {
-		vars[tc.Name] = tc.Content
+		content[tc.Name] = tc.Content
+		names = append(names, tc.Name)
+	}
+	msg := types.MandrillMessage{HTML: merge.FillEditable(code, content), Text: text, Subject: subject, MergeLanguage: req.MergeLanguage, GlobalMergeVars: req.MergeVars}
+	mergeMessage(&msg, content)
+
+	lint := lintMessage(types.MandrillMessage{HTML: code, Text: text, Subject: subject, MergeLanguage: req.MergeLanguage, GlobalMergeVars: req.MergeVars}, req.TemplateContent)
+	writeJSON(w, http.StatusOK, map[string]any{"html": msg.HTML, "text": msg.Text, "subject": msg.Subject, "lint": lint})
+}
+
+// templateVersion returns the published html, text and subject of a
+// template, or the draft when draft is set or nothing was published yet.
+func templateVersion(t *types.Template, draft bool) (string, string, string) {
+	if draft || t.PublishedAt == nil {
+		return t.Code, t.Text, t.Subject
 	}
-	htmlOut := replaceVars(code, vars)
-	writeJSON(w, http.StatusOK, map[string]any{"html": htmlOut})
+	return t.PublishedCode, t.PublishedText, t.PublishedSubject
 }
 
 // Helpers
@@ -1125,16 +1424,52 @@ func toRecipients(to []string) []types.MandrillRecipient {
 	return out
 }
 
-func replaceVars(s string, vars map[string]string) string {
-	if s == "" {
-		return s
+// mergeMessage evaluates merge tags in the subject and bodies using the
+// message's merge language. template_content entries act as the lowest
+// priority vars. Per-recipient merge_vars only apply to single-recipient
+// messages, since one MIME message is built for all recipients; sendEach
+// splits the others unless preserve_recipients is set.
+func mergeMessage(m *types.MandrillMessage, content map[string]string) {
+	vars := map[string]any{}
+	for k, v := range content {
+		vars[k] = v
+	}
+	var rcptVars []types.MandrillMergeVar
+	if len(m.To) == 1 {
+		rcptVars = merge.RcptVars(m.MergeVars, m.To[0].Email)
+	}
+	for k, v := range merge.Vars(m.GlobalMergeVars, rcptVars) {
+		vars[k] = v
+	}
+	m.Subject = merge.Render(m.Subject, m.MergeLanguage, vars)
+	vars["MC:SUBJECT"] = m.Subject
+	m.HTML = merge.Render(m.HTML, m.MergeLanguage, vars)
+	m.Text = merge.Render(m.Text, m.MergeLanguage, vars)
+}
+
+// lintMessage checks the authored subject and bodies of a message against
+// the merge vars and template_content it supplies.
+func lintMessage(m types.MandrillMessage, content []types.TemplateContent) *types.LintReport {
+	rcpts, _ := recipientsFromMessage(m)
+	in := merge.LintInput{
+		Language:   m.MergeLanguage,
+		Sources:    []string{m.Subject, m.HTML, m.Text},
+		Recipients: rcpts,
+		RcptVars:   map[string][]string{},
+		Shared:     m.PreserveRecipients,
 	}
-	out := s
-	for k, v := range vars {
-		token := fmt.Sprintf("*|%s|*", k)
-		out = strings.ReplaceAll(out, token, v)
+	for _, v := range m.GlobalMergeVars {
+		in.Vars = append(in.Vars, v.Name)
 	}
-	return out
+	for _, rv := range m.MergeVars {
+		for _, v := range rv.Vars {
+			in.RcptVars[rv.Rcpt] = append(in.RcptVars[rv.Rcpt], v.Name)
+		}
+	}
+	for _, tc := range content {
+		in.TemplateContent = append(in.TemplateContent, tc.Name)
+	}
+	return merge.Lint(in)
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -1145,9 +1480,56 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 
 func genID() string { b := make([]byte, 12); _, _ = rand.Read(b); return hex.EncodeToString(b) }
 
-func requireKey(key string) error {
+// applyKeyDefaults turns on per-key message defaults configured on the
+// server, the way Mandrill applies a key's sending options.
+func applyKeyDefaults(cfg config.Config, key string, m *types.MandrillMessage) {
+	for _, k := range cfg.AutoTextKeys {
+		if k == "*" || k == key {
+			m.AutoText = true
+			return
+		}
+	}
+}
+
+// keyCookie remembers the key of a strict-mode browser session, so the
+// inbox's requests, iframes and event stream don't each need it.
+const keyCookie = "mandrill_dev_key"
+
+// strictKey makes h require a valid key in strict mode, for endpoints
+// without a JSON body. The key comes from the key query parameter, the
+// X-Mandrill-Key header or the cookie set by an earlier request.
+func strictKey(cfg config.Config, h http.Handler) http.Handler {
+	if !cfg.Strict {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			key = r.Header.Get("X-Mandrill-Key")
+		}
+		fromCookie := false
+		if c, err := r.Cookie(keyCookie); key == "" && err == nil {
+			key, fromCookie = c.Value, true
+		}
+		if err := requireKey(cfg, key); err != nil {
+			writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+			return
+		}
+		if !fromCookie {
+			http.SetCookie(w, &http.Cookie{Name: keyCookie, Value: key, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireKey checks key against MANDRILL_KEYS. Strict mode also rejects an
+// empty key when no key list is configured.
+func requireKey(cfg config.Config, key string) error {
 	allowed := strings.TrimSpace(os.Getenv("MANDRILL_KEYS"))
 	if allowed == "" {
+		if cfg.Strict && strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid mandrill api key")
+		}
 		return nil
 	}
 	keys := strings.Split(allowed, ",")
@@ -1159,18 +1541,204 @@ func requireKey(key string) error {
 	return fmt.Errorf("invalid mandrill api key")
 }
 
-func recipientsFromMessage(m types.MandrillMessage) []string {
-	rcpts := make([]string, 0, len(m.To)+1)
+// recipientsFromMessage returns the envelope recipients of a message split
+// into deliverable addresses and ones that fail address validation.
+func recipientsFromMessage(m types.MandrillMessage) (valid, invalid []string) {
+	add := func(addr string) {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			return
+		}
+		if validRecipient(addr) {
+			valid = append(valid, addr)
+		} else {
+			invalid = append(invalid, addr)
+		}
+	}
+	for _, r := range m.To {
+		add(r.Email)
+	}
+	add(m.BccAddress)
+	return valid, invalid
+}
+
+// headerRecipients splits an address list header into deliverable
+// addresses and the entries that don't parse or fail validation, which are
+// returned as written.
+func headerRecipients(v string) (valid, invalid []string) {
+	if list, err := mail.ParseAddressList(v); err == nil {
+		for _, a := range list {
+			if validRecipient(a.Address) {
+				valid = append(valid, a.Address)
+			} else {
+				invalid = append(invalid, a.Address)
+			}
+		}
+		return valid, invalid
+	}
+	for _, p := range splitAddressList(v) {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if addr, err := mail.ParseAddress(p); err == nil && validRecipient(addr.Address) {
+			valid = append(valid, addr.Address)
+		} else {
+			invalid = append(invalid, p)
+		}
+	}
+	return valid, invalid
+}
+
+// splitAddressList splits an address list on the commas outside quoted
+// strings and angle brackets.
+func splitAddressList(v string) []string {
+	var out []string
+	quoted, angle, start := false, false, 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			angle = true
+		case c == '>' && !quoted:
+			angle = false
+		case c == ',' && !quoted && !angle:
+			out = append(out, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, v[start:])
+}
+
+// withoutRecipients drops the given addresses from the message so they never
+// reach the SMTP envelope or the To/Cc headers.
+func withoutRecipients(m types.MandrillMessage, drop []string) types.MandrillMessage {
+	if len(drop) == 0 {
+		return m
+	}
+	skip := make(map[string]bool, len(drop))
+	for _, d := range drop {
+		skip[d] = true
+	}
+	to := make([]types.MandrillRecipient, 0, len(m.To))
 	for _, r := range m.To {
-		e := strings.TrimSpace(r.Email)
-		if e != "" {
-			rcpts = append(rcpts, e)
+		if !skip[strings.TrimSpace(r.Email)] {
+			to = append(to, r)
 		}
 	}
-	if strings.TrimSpace(m.BccAddress) != "" {
-		rcpts = append(rcpts, strings.TrimSpace(m.BccAddress))
+	m.To = to
+	if skip[strings.TrimSpace(m.BccAddress)] {
+		m.BccAddress = ""
+	}
+	return m
+}
+
+// newResults builds a queued result per deliverable recipient followed by an
+// "invalid" result per rejected address.
+func newResults(id string, valid, invalid []string) []types.SendResult {
+	out := make([]types.SendResult, 0, len(valid)+len(invalid))
+	for _, rcpt := range valid {
+		out = append(out, types.SendResult{Email: rcpt, Status: "queued", ID: id})
+	}
+	for _, rcpt := range invalid {
+		out = append(out, types.SendResult{Email: rcpt, Status: "invalid", ID: id})
+	}
+	return out
+}
+
+// splitRecipients returns one copy of m per recipient when m has
+// per-recipient merge_vars and several recipients, the way Mandrill sends
+// each recipient a message of their own unless preserve_recipients is set,
+// so each copy is rendered with its recipient's vars. Every copy keeps
+// bcc_address. Otherwise m is returned alone.
+func splitRecipients(m types.MandrillMessage) []types.MandrillMessage {
+	if len(m.MergeVars) == 0 || m.PreserveRecipients || len(m.To) < 2 {
+		return []types.MandrillMessage{m}
+	}
+	out := make([]types.MandrillMessage, 0, len(m.To))
+	for _, r := range m.To {
+		c := m
+		r.Type = "to"
+		c.To = []types.MandrillRecipient{r}
+		out = append(out, c)
+	}
+	return out
+}
+
+// sendEach stores and delivers each message splitRecipients makes of m,
+// already stripped of its invalid and rejected recipients, as a record of
+// its own built by newRecord. The invalid and rejected recipients are
+// reported with the first one, as is bcc_address.
+func sendEach(cfg config.Config, st *store.Store, q *delivery.Queue, m types.MandrillMessage, invalid, rejected []string, rules simulate.Rules, scheduledAt *time.Time, async bool, newRecord func(id string, m types.MandrillMessage, to []string) *types.MessageRecord) []types.SendResult {
+	var results []types.SendResult
+	for i, part := range splitRecipients(m) {
+		id := genID()
+		rcpts, _ := recipientsFromMessage(part)
+		rec := newRecord(id, part, rcpts)
+		var res []types.SendResult
+		if i == 0 {
+			res = append(newResults(id, rcpts, invalid), rejectedResults(st, rules, id, rejected)...)
+		} else {
+			res = newResults(id, rcpts[:len(part.To)], nil)
+		}
+		switch {
+		case len(rcpts) == 0:
+			rec.Status = undeliverableStatus(rejected)
+			st.SaveMessage(rec)
+			delivery.RecordRejects(st, id, res)
+		case scheduledAt != nil && scheduledAt.After(time.Now()):
+			rec.Status = "scheduled"
+			st.AddScheduled(rec)
+			setStatus(res, "scheduled", "")
+		default:
+			deliverRecord(cfg, st, q, rec, res, async)
+		}
+		results = append(results, res...)
+	}
+	return results
+}
+
+// deliverRecord stores rec and delivers it, updating results with the
+// outcome: sent, rejected for recipients the server refused, or queued for
+// deferred ones. Async sends and large batches are handed to q and stay
+// queued.
+func deliverRecord(cfg config.Config, st *store.Store, q *delivery.Queue, rec *types.MessageRecord, results []types.SendResult, async bool) {
+	job := q.NewJob(rec)
+	st.SaveMessage(rec)
+	delivery.RecordRejects(st, rec.ID, results)
+	if async || cfg.AsyncThreshold > 0 && len(job.Rcpts) > cfg.AsyncThreshold {
+		q.Enqueue(job)
+		return
+	}
+	res := q.Deliver(job)
+	for i := range results {
+		for _, rcpt := range res.Sent {
+			if results[i].Status == "queued" && strings.EqualFold(results[i].Email, strings.TrimSpace(rcpt)) {
+				results[i].Status = "sent"
+			}
+		}
+		for _, b := range res.Bounced {
+			if results[i].Status == "queued" && strings.EqualFold(results[i].Email, strings.TrimSpace(b.Email)) {
+				results[i].Status, results[i].RejectReason = "rejected", "soft-bounce"
+				if b.Hard {
+					results[i].RejectReason = "hard-bounce"
+				}
+			}
+		}
+	}
+}
+
+// setStatus updates every deliverable result; invalid and rejected
+// recipients keep their status.
+func setStatus(results []types.SendResult, status, reason string) {
+	for i := range results {
+		if results[i].Status != "queued" {
+			continue
+		}
+		results[i].Status = status
+		results[i].RejectReason = reason
 	}
-	return rcpts
 }
 
 // isDebug reports whether debug logging/behaviors are enabled via env
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestRecipientsFromMessage(t *testing.T) {
+	m := types.MandrillMessage{
+		To: []types.MandrillRecipient{
+			{Email: " a@example.com "},
+			{Email: "b@mailhog", Type: "cc"},
+			{Email: ""},
+			{Email: "c@example.org", Type: "bcc"},
+		},
+		BccAddress: "audit@example.com",
+	}
+	valid, invalid := recipientsFromMessage(m)
+	if want := []string{"a@example.com", "c@example.org", "audit@example.com"}; !reflect.DeepEqual(valid, want) {
+		t.Errorf("valid = %q, want %q", valid, want)
+	}
+	if want := []string{"b@mailhog"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("invalid = %q, want %q", invalid, want)
+	}
+
+	kept := withoutRecipients(m, invalid)
+	if len(kept.To) != 3 || kept.To[1].Email != "" || len(m.To) != 4 {
+		t.Errorf("withoutRecipients kept %+v", kept.To)
+	}
+	if kept = withoutRecipients(m, []string{"audit@example.com"}); kept.BccAddress != "" {
+		t.Errorf("withoutRecipients kept bcc_address %q", kept.BccAddress)
+	}
+
+	results := newResults("id1", valid, invalid)
+	setStatus(results, "rejected", "blocked")
+	want := []types.SendResult{
+		{Email: "a@example.com", Status: "rejected", RejectReason: "blocked", ID: "id1"},
+		{Email: "c@example.org", Status: "rejected", RejectReason: "blocked", ID: "id1"},
+		{Email: "audit@example.com", Status: "rejected", RejectReason: "blocked", ID: "id1"},
+		{Email: "b@mailhog", Status: "invalid", ID: "id1"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+}
+
+func TestHeaderRecipients(t *testing.T) {
+	tests := []struct {
+		header  string
+		valid   []string
+		invalid []string
+	}{
+		{`a@example.com, Bob <b@example.org>`, []string{"a@example.com", "b@example.org"}, nil},
+		{`"Doe, John" <j@example.com>, x@example.org`, []string{"j@example.com", "x@example.org"}, nil},
+		{`a@example.com, b@mailhog`, []string{"a@example.com"}, []string{"b@mailhog"}},
+		{`"Doe, John" <j@example.com>, broken@, x@example.org`, []string{"j@example.com", "x@example.org"}, []string{"broken@"}},
+		{`a@example.com, , <nope>`, []string{"a@example.com"}, []string{"<nope>"}},
+	}
+	for _, tt := range tests {
+		valid, invalid := headerRecipients(tt.header)
+		if !reflect.DeepEqual(valid, tt.valid) || !reflect.DeepEqual(invalid, tt.invalid) {
+			t.Errorf("headerRecipients(%q) = %q, %q; want %q, %q", tt.header, valid, invalid, tt.valid, tt.invalid)
+		}
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	to := []types.MandrillRecipient{{Email: "a@example.com"}, {Email: "b@example.com", Type: "cc"}}
+	vars := []types.MandrillRcptMergeVars{
+		{Rcpt: "a@example.com", Vars: []types.MandrillMergeVar{{Name: "NAME", Content: "Ann"}}},
+		{Rcpt: "B@example.com", Vars: []types.MandrillMergeVar{{Name: "NAME", Content: "Bob"}}},
+	}
+	tests := []struct {
+		name     string
+		m        types.MandrillMessage
+		subjects []string
+	}{
+		{
+			name:     "per-recipient vars",
+			m:        types.MandrillMessage{Subject: "Hi *|NAME|*", To: to, MergeVars: vars, BccAddress: "audit@example.com"},
+			subjects: []string{"Hi Ann", "Hi Bob"},
+		},
+		{
+			name:     "preserve_recipients",
+			m:        types.MandrillMessage{Subject: "Hi *|NAME|*", To: to, MergeVars: vars, PreserveRecipients: true},
+			subjects: []string{"Hi *|NAME|*"},
+		},
+		{
+			name:     "global vars only",
+			m:        types.MandrillMessage{Subject: "Hi *|NAME|*", To: to, GlobalMergeVars: []types.MandrillMergeVar{{Name: "NAME", Content: "all"}}},
+			subjects: []string{"Hi all"},
+		},
+		{
+			name:     "single recipient",
+			m:        types.MandrillMessage{Subject: "Hi *|NAME|*", To: to[:1], MergeVars: vars},
+			subjects: []string{"Hi Ann"},
+		},
+	}
+	for _, tt := range tests {
+		parts := splitRecipients(tt.m)
+		if len(parts) != len(tt.subjects) {
+			t.Errorf("%s: got %d messages, want %d", tt.name, len(parts), len(tt.subjects))
+			continue
+		}
+		for i, p := range parts {
+			mergeMessage(&p, nil)
+			if p.Subject != tt.subjects[i] {
+				t.Errorf("%s: message %d subject = %q, want %q", tt.name, i, p.Subject, tt.subjects[i])
+			}
+			if len(parts) > 1 && (len(p.To) != 1 || p.To[0].Type != "to" || p.BccAddress != tt.m.BccAddress) {
+				t.Errorf("%s: message %d to %+v, bcc %q", tt.name, i, p.To, p.BccAddress)
+			}
+		}
+		if tt.m.Subject != "Hi *|NAME|*" || to[1].Type != "cc" {
+			t.Errorf("%s: the original message changed", tt.name)
+		}
+	}
+}
+
+// TestDeliverRecordAsync checks that async sends and sends above the
+// threshold return queued without waiting for a worker.
+func TestDeliverRecordAsync(t *testing.T) {
+	cfg := config.Config{Transport: "null", AsyncThreshold: 1}
+	m, err := mailer.New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := routing.New(cfg)
+	st := store.NewStore()
+	q := delivery.NewQueue(cfg, st, m, rt, nil) // no workers, no room
+
+	tests := []struct {
+		name  string
+		to    []string
+		async bool
+	}{
+		{"async", []string{"a@x.test"}, true},
+		{"above threshold", []string{"a@x.test", "b@x.test"}, false},
+	}
+	for i, tt := range tests {
+		id := fmt.Sprintf("m%d", i)
+		msg := types.MandrillMessage{FromEmail: "s@example.com", Subject: "hi", Text: "body"}
+		var results []types.SendResult
+		for _, a := range tt.to {
+			msg.To = append(msg.To, types.MandrillRecipient{Email: a})
+			results = append(results, types.SendResult{Email: a, Status: "queued", ID: id})
+		}
+		rec := &types.MessageRecord{ID: id, Status: "queued", From: msg.FromEmail, To: tt.to, Message: msg}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			deliverRecord(cfg, st, q, rec, results, tt.async)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: send waited for a worker", tt.name)
+		}
+		for _, r := range results {
+			if r.Status != "queued" {
+				t.Errorf("%s: %s is %q, want queued", tt.name, r.Email, r.Status)
+			}
+		}
+		if q.Len() != i+1 {
+			t.Errorf("%s: queue has %d jobs, want %d", tt.name, q.Len(), i+1)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// handleSendersDomains lists the sending domains seen in messages and
+// signing keys. With DKIM signing on, each entry carries the TXT record
+// to publish for its key; domains without a key yet have none.
+func handleSendersDomains(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, keys *dkim.Keyring) {
+	var req types.SendersDomainsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, cfg, http.StatusBadRequest, errValidation, err.Error())
+		return
+	}
+	if err := requireKey(cfg, req.Key); err != nil {
+		writeError(w, cfg, http.StatusUnauthorized, errInvalidKey, err.Error())
+		return
+	}
+
+	first := map[string]time.Time{}
+	see := func(domain string, at time.Time) {
+		if domain == "" {
+			return
+		}
+		if t, ok := first[domain]; !ok || at.Before(t) {
+			first[domain] = at
+		}
+	}
+	for _, m := range st.Messages() {
+		if at := strings.LastIndexByte(m.From, '@'); at >= 0 {
+			see(strings.ToLower(m.From[at+1:]), m.CreatedAt)
+		}
+		see(strings.ToLower(m.Message.SigningDomain), m.CreatedAt)
+	}
+	now := time.Now()
+	if cfg.DKIMSign {
+		for _, k := range keys.List() {
+			see(k.Domain, now)
+		}
+	}
+
+	out := make([]types.SenderDomain, 0, len(first))
+	for domain, created := range first {
+		d := types.SenderDomain{
+			Domain:       domain,
+			CreatedAt:    created.UTC().Format(mandrillTimeLayout),
+			LastTestedAt: now.UTC().Format(mandrillTimeLayout),
+			SPF:          types.DomainCheck{Valid: true},
+			DKIM:         types.DomainCheck{Valid: false, Error: "DKIM signing is disabled"},
+		}
+		if cfg.DKIMSign {
+			// Keys are created when mail is signed, never by listing.
+			if k, ok := keys.Lookup(domain); !ok {
+				d.DKIM.Error = "no DKIM key yet; one is generated when mail from this domain is signed"
+			} else {
+				d.DKIM = types.DomainCheck{Valid: true}
+				d.ValidSigning = true
+				d.VerifiedAt = d.CreatedAt
+				d.DKIMRecord = &types.DomainDNSRecord{Name: k.RecordName(), Type: "TXT", Value: k.TXTRecord()}
+			}
+		}
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	writeJSON(w, http.StatusOK, out)
+}
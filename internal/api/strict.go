@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Formats Mandrill accepts for send_at and search dates (always UTC).
+const (
+	mandrillTimeLayout = "2006-01-02 15:04:05"
+	mandrillDateLayout = "2006-01-02"
+)
+
+// Field limits enforced in strict mode.
+const (
+	maxTagLength     = 50
+	maxMetadataBytes = 1024
+	maxSearchLimit   = 1000
+)
+
+// parseSendAt parses an optional send_at value. Lenient mode accepts any
+// format parseTime understands and ignores garbage; strict mode only
+// accepts Mandrill's UTC "YYYY-MM-DD HH:MM:SS" and reports anything else.
+func parseSendAt(cfg config.Config, s string) (*time.Time, error) {
+	return parseOptionalTime(cfg, "send_at", s, mandrillTimeLayout)
+}
+
+// parseSearchDate parses date_from/date_to for search endpoints.
+func parseSearchDate(cfg config.Config, field, s string) (*time.Time, error) {
+	return parseOptionalTime(cfg, field, s, mandrillDateLayout, mandrillTimeLayout)
+}
+
+func parseOptionalTime(cfg config.Config, field, s string, layouts ...string) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !cfg.Strict {
+		if t, err := parseTime(s); err == nil {
+			return &t, nil
+		}
+		return nil, nil
+	}
+	for _, l := range layouts {
+		if t, err := time.ParseInLocation(l, s, time.UTC); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: invalid date %q, expected format %s", field, s, layouts[0])
+}
+
+// checkMessageConstraints enforces Mandrill's limits on a message that the
+// lenient mode lets through.
+func checkMessageConstraints(m types.MandrillMessage) error {
+	if strings.TrimSpace(m.FromEmail) == "" {
+		return fmt.Errorf("message.from_email: required")
+	}
+	for i, t := range m.Tags {
+		if len(t) > maxTagLength {
+			return fmt.Errorf("message.tags[%d]: must be %d characters or less", i, maxTagLength)
+		}
+		if strings.HasPrefix(t, "_") {
+			return fmt.Errorf("message.tags[%d]: tags starting with an underscore are reserved", i)
+		}
+	}
+	if len(m.Metadata) > 0 {
+		if b, _ := json.Marshal(m.Metadata); len(b) > maxMetadataBytes {
+			return fmt.Errorf("message.metadata: must be %d bytes or less", maxMetadataBytes)
+		}
+	}
+	for i, rm := range m.RecipientMetadata {
+		if b, _ := json.Marshal(rm.Values); len(b) > maxMetadataBytes {
+			return fmt.Errorf("message.recipient_metadata[%d].values: must be %d bytes or less", i, maxMetadataBytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/store"
+)
+
+func newTestMux(t *testing.T, cfg config.Config) http.Handler {
+	t.Helper()
+	cfg.Transport = "null"
+	m, err := mailer.New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := routing.New(cfg)
+	st := store.NewStore()
+	return NewMux(cfg, st, delivery.NewQueue(cfg, st, m, rt, nil), dkim.NewKeyring("", "mandrill", ""))
+}
+
+func TestStrictErrors(t *testing.T) {
+	t.Setenv("MANDRILL_KEYS", "good")
+	tests := []struct {
+		name   string
+		strict bool
+		method string
+		path   string
+		body   string
+		cookie string
+		status int
+		error  string // expected error name, if any
+	}{
+		{"wrong key", true, "POST", "/messages/search-time-series.json", `{"key":"bad"}`, "", 500, errInvalidKey},
+		{"missing key", true, "POST", "/messages/search-time-series.json", `{}`, "", 500, errInvalidKey},
+		{"malformed body", true, "POST", "/messages/search-time-series.json", `{"key":`, "", 500, errValidation},
+		{"valid key", true, "POST", "/messages/search-time-series.json", `{"key":"good"}`, "", 200, ""},
+		{"lenient empty body", false, "POST", "/messages/search-time-series.json", ``, "", 200, ""},
+		{"lenient wrong key", false, "POST", "/messages/search-time-series.json", `{"key":"bad"}`, "", 200, ""},
+		{"dev endpoint without key", true, "GET", "/dev/captured", ``, "", 500, errInvalidKey},
+		{"dev endpoint with key", true, "GET", "/dev/captured?key=good", ``, "", 200, ""},
+		{"dev endpoint with cookie", true, "GET", "/dev/captured", ``, "good", 200, ""},
+		{"dev endpoint with wrong cookie", true, "GET", "/dev/captured", ``, "bad", 500, errInvalidKey},
+		{"lenient dev endpoint", false, "GET", "/dev/captured", ``, "", 200, ""},
+		{"lenient validation error", false, "POST", "/messages/info.json", `{"key":`, "", 400, errValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := newTestMux(t, config.Config{Strict: tt.strict})
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: keyCookie, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.error == "" {
+				return
+			}
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if body["status"] != "error" || body["name"] != tt.error || body["code"] != float64(errorCodes[tt.error]) || body["message"] == "" {
+				t.Errorf("body = %v, want a %s error", body, tt.error)
+			}
+			// Mandrill's error body has exactly these fields; the
+			// lenient one adds "error" for older clients.
+			if _, ok := body["error"]; ok == tt.strict {
+				t.Errorf("strict=%v: body = %v", tt.strict, body)
+			}
+		})
+	}
+}
+
+// TestStrictKeyCookie checks that a key given once is remembered for the
+// requests the inbox page makes afterwards.
+func TestStrictKeyCookie(t *testing.T) {
+	t.Setenv("MANDRILL_KEYS", "good")
+	mux := newTestMux(t, config.Config{Strict: true, Inbox: true})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/inbox/?key=good", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != keyCookie || cookies[0].Value != "good" || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	req := httptest.NewRequest("GET", "/inbox/api/messages", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 200 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("with the cookie: status %d, cookies %v", rec.Code, rec.Result().Cookies())
+	}
+}
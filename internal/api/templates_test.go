@@ -0,0 +1,77 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestImportTemplate(t *testing.T) {
+	cfg := config.Config{}
+	st := store.NewStore()
+	first, err := ImportTemplate(cfg, st, types.TemplateAddRequest{Name: "welcome", Subject: "Hi", Code: "<p>v1</p>", Publish: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, published := first.CreatedAt, *first.PublishedAt
+	time.Sleep(2 * time.Millisecond)
+
+	// Same content again: nothing is republished.
+	again, err := ImportTemplate(cfg, st, types.TemplateAddRequest{Name: "welcome", Subject: "Hi", Code: "<p>v1</p>", Publish: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.CreatedAt.Equal(created) || !again.PublishedAt.Equal(published) {
+		t.Errorf("unchanged reload: created %v, published %v; want %v, %v", again.CreatedAt, again.PublishedAt, created, published)
+	}
+
+	// A draft-only reload keeps the published version.
+	draft, err := ImportTemplate(cfg, st, types.TemplateAddRequest{Name: "Welcome", Subject: "Hi", Code: "<p>v2</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draft.Code != "<p>v2</p>" || draft.PublishedCode != "<p>v1</p>" || !draft.PublishedAt.Equal(published) || !draft.CreatedAt.Equal(created) {
+		t.Errorf("draft reload = %+v", draft)
+	}
+
+	// Publishing new content updates the published version only.
+	time.Sleep(2 * time.Millisecond)
+	edited, err := ImportTemplate(cfg, st, types.TemplateAddRequest{Name: "welcome", Subject: "Hello", Code: "<p>v3</p>", Publish: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.PublishedCode != "<p>v3</p>" || edited.PublishedSubject != "Hello" || !edited.PublishedAt.After(published) || !edited.CreatedAt.Equal(created) {
+		t.Errorf("edited reload = %+v", edited)
+	}
+	if stored, _ := st.GetTemplate("welcome"); stored.PublishedCode != "<p>v3</p>" {
+		t.Errorf("stored template = %+v", stored)
+	}
+}
+
+func TestImportTemplateValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		req    types.TemplateAddRequest
+		ok     bool
+	}{
+		{"valid", false, types.TemplateAddRequest{Name: "a", FromEmail: "dev@example.com"}, true},
+		{"missing name", false, types.TemplateAddRequest{Name: " "}, false},
+		{"bad sender", false, types.TemplateAddRequest{Name: "a", FromEmail: "dev"}, false},
+		{"single-label sender", false, types.TemplateAddRequest{Name: "a", FromEmail: "dev@mailhog"}, true},
+		{"strict single-label sender", true, types.TemplateAddRequest{Name: "a", FromEmail: "dev@mailhog"}, false},
+	}
+	for _, tt := range tests {
+		st := store.NewStore()
+		_, err := ImportTemplate(config.Config{Strict: tt.strict}, st, tt.req)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ImportTemplate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if _, stored := st.GetTemplate(tt.req.Name); stored != tt.ok {
+			t.Errorf("%s: stored = %v, want %v", tt.name, stored, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/tracking"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// pixelGIF is a transparent 1x1 GIF served for tracked opens.
+var pixelGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// handleTrackOpen records an open and always answers with the pixel so mail
+// clients never show a broken image.
+func handleTrackOpen(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	if id, err := tracking.ParseOpenToken(strings.TrimPrefix(r.URL.Path, tracking.OpenPath)); err == nil {
+		e := engagement(r, "")
+		st.RecordEvent(id, types.MessageEvent{Event: "open", TS: e.TS, IP: e.IP, UserAgent: e.UserAgent}, func(m *types.MessageRecord) {
+			m.Opens++
+			m.OpensDetail = append(m.OpensDetail, e)
+		})
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	_, _ = w.Write(pixelGIF)
+}
+
+// handleTrackClick records a click and redirects to the original URL. Links
+// for messages this server doesn't know about are not followed. With
+// url_strip_qs the recorded URL loses its query string; the redirect keeps it.
+func handleTrackClick(w http.ResponseWriter, r *http.Request, st *store.Store) {
+	id, url, err := tracking.ParseClickToken(strings.TrimPrefix(r.URL.Path, tracking.ClickPath))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	recorded := url
+	if m, ok := st.GetMessage(id); ok && m.Message.URLStripQS {
+		recorded = tracking.StripQuery(url)
+	}
+	e := engagement(r, recorded)
+	ok := st.RecordEvent(id, types.MessageEvent{Event: "click", TS: e.TS, IP: e.IP, UserAgent: e.UserAgent, URL: recorded}, func(m *types.MessageRecord) {
+		m.Clicks++
+		m.ClicksDetail = append(m.ClicksDetail, e)
+	})
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func engagement(r *http.Request, url string) types.Engagement {
+	ip := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(ip); err == nil {
+		ip = h
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		ip = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return types.Engagement{TS: time.Now().Unix(), IP: ip, UserAgent: r.UserAgent(), URL: url}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// decodeRequest decodes a JSON body and describes type mismatches by field
+// path so clients learn which part of their payload is wrong.
+func decodeRequest(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body: expected %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		field := indexRe.ReplaceAllString(typeErr.Field, "[$1]")
+		return fmt.Errorf("%s: expected %s, got %s", field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("invalid json at offset %d: %v", syntaxErr.Offset, err)
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("invalid json: empty body")
+	}
+	return fmt.Errorf("invalid json: %v", err)
+}
+
+// indexRe matches array indexes in encoding/json field paths (to.0.email).
+var indexRe = regexp.MustCompile(`\.(\d+)\b`)
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return t.String()
+}
+
+var (
+	recipientTypes = map[string]bool{"to": true, "cc": true, "bcc": true}
+	mergeLanguages = map[string]bool{"mailchimp": true, "handlebars": true}
+)
+
+func required(field, v string) error {
+	if strings.TrimSpace(v) == "" {
+		return fmt.Errorf("%s: required", field)
+	}
+	return nil
+}
+
+// checkEmail reports whether addr is a single bare email address.
+func checkEmail(field, addr string) error {
+	if !validRecipient(addr) {
+		return fmt.Errorf("%s: invalid email address %q", field, addr)
+	}
+	return nil
+}
+
+// checkSender validates a from address. Outside strict mode the domain may
+// also be a single label such as localhost or mailhog, which dev setups use.
+func checkSender(cfg config.Config, field, addr string) error {
+	if validRecipient(addr) || !cfg.Strict && validLocalAddress(addr) {
+		return nil
+	}
+	return fmt.Errorf("%s: invalid email address %q", field, addr)
+}
+
+// validLocalAddress reports whether addr is a bare address whose domain is a
+// single host name label.
+func validLocalAddress(addr string) bool {
+	addr = strings.TrimSpace(addr)
+	a, err := mail.ParseAddress(addr)
+	if err != nil || a.Address != addr {
+		return false
+	}
+	at := strings.LastIndexByte(addr, '@')
+	d := addr[at+1:]
+	return at > 0 && validLabel(d) && strings.Trim(d, "0123456789") != ""
+}
+
+// validRecipient reports whether addr parses as a bare RFC 5322 address
+// whose domain is syntactically valid.
+func validRecipient(addr string) bool {
+	addr = strings.TrimSpace(addr)
+	a, err := mail.ParseAddress(addr)
+	if err != nil || a.Address != addr {
+		return false
+	}
+	at := strings.LastIndexByte(addr, '@')
+	return at > 0 && validDomain(addr[at+1:])
+}
+
+// validDomain accepts IP literals ([192.0.2.1]), localhost and dotted host
+// names made of LDH labels whose top-level label is not numeric.
+func validDomain(d string) bool {
+	if strings.HasPrefix(d, "[") && strings.HasSuffix(d, "]") {
+		ip := strings.TrimPrefix(d[1:len(d)-1], "IPv6:")
+		return net.ParseIP(ip) != nil
+	}
+	d = strings.TrimSuffix(d, ".")
+	if strings.EqualFold(d, "localhost") {
+		return true
+	}
+	if len(d) > 253 {
+		return false
+	}
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if !validLabel(l) {
+			return false
+		}
+	}
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
+
+// validLabel reports whether l is an LDH host name label.
+func validLabel(l string) bool {
+	if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c >= 0x80) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDomain validates an optional domain name field.
+func checkDomain(field, d string) error {
+	if d != "" && !validDomain(d) {
+		return fmt.Errorf("%s: invalid domain %q", field, d)
+	}
+	return nil
+}
+
+// checkHeaderName enforces RFC 5322 field names: printable ASCII without
+// spaces or colons.
+func checkHeaderName(field, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s: header name required", field)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return fmt.Errorf("%s: invalid header name %q", field, name)
+		}
+	}
+	return nil
+}
+
+func checkMergeLanguage(field, lang string) error {
+	if lang != "" && !mergeLanguages[strings.ToLower(lang)] {
+		return fmt.Errorf("%s: must be one of mailchimp, handlebars", field)
+	}
+	return nil
+}
+
+func checkMergeVars(field string, vars []types.MandrillMergeVar) error {
+	for i, v := range vars {
+		f := fmt.Sprintf("%s[%d].name", field, i)
+		if err := required(f, v.Name); err != nil {
+			return err
+		}
+		if strings.HasPrefix(v.Name, "_") {
+			return fmt.Errorf("%s: merge var names can't start with an underscore", f)
+		}
+	}
+	return nil
+}
+
+func checkAttachments(field string, list []types.MandrillAttachment, images bool) error {
+	for i, a := range list {
+		f := fmt.Sprintf("%s[%d]", field, i)
+		if err := required(f+".name", a.Name); err != nil {
+			return err
+		}
+		if images && !strings.HasPrefix(strings.ToLower(a.Type), "image/") {
+			return fmt.Errorf("%s.type: must start with image/", f)
+		}
+		if _, err := base64.StdEncoding.DecodeString(stripWhitespace(a.Content)); err != nil {
+			return fmt.Errorf("%s.content: invalid base64", f)
+		}
+	}
+	return nil
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// validateMessage checks the message object shared by send and
+// send-template. Recipient addresses, bcc_address included, are checked per
+// recipient when sending.
+func validateMessage(cfg config.Config, m types.MandrillMessage) error {
+	if m.FromEmail != "" {
+		if err := checkSender(cfg, "message.from_email", m.FromEmail); err != nil {
+			return err
+		}
+	}
+	for i, r := range m.To {
+		f := fmt.Sprintf("message.to[%d]", i)
+		if err := required(f+".email", r.Email); err != nil {
+			return err
+		}
+		if r.Type != "" && !recipientTypes[strings.ToLower(r.Type)] {
+			return fmt.Errorf("%s.type: must be one of to, cc, bcc", f)
+		}
+	}
+	if err := checkDomain("message.return_path_domain", m.ReturnPathDomain); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkHeaderName("message.headers", name); err != nil {
+			return err
+		}
+	}
+	if _, err := simulate.FromHeaders(m.Headers); err != nil {
+		return fmt.Errorf("message.headers: %v", err)
+	}
+	if err := checkMergeLanguage("message.merge_language", m.MergeLanguage); err != nil {
+		return err
+	}
+	if err := checkMergeVars("message.global_merge_vars", m.GlobalMergeVars); err != nil {
+		return err
+	}
+	for i, rv := range m.MergeVars {
+		f := fmt.Sprintf("message.merge_vars[%d]", i)
+		if err := required(f+".rcpt", rv.Rcpt); err != nil {
+			return err
+		}
+		if err := checkMergeVars(f+".vars", rv.Vars); err != nil {
+			return err
+		}
+	}
+	for i, rm := range m.RecipientMetadata {
+		if err := required(fmt.Sprintf("message.recipient_metadata[%d].rcpt", i), rm.Rcpt); err != nil {
+			return err
+		}
+	}
+	if err := checkAttachments("message.attachments", m.Attachments, false); err != nil {
+		return err
+	}
+	return checkAttachments("message.images", m.Images, true)
+}
+
+func validateSend(cfg config.Config, req types.SendRequest) error {
+	return validateMessage(cfg, req.Message)
+}
+
+func validateSendTemplate(cfg config.Config, req types.SendTemplateRequest) error {
+	if err := required("template_name", req.TemplateName); err != nil {
+		return err
+	}
+	for i, tc := range req.TemplateContent {
+		if err := required(fmt.Sprintf("template_content[%d].name", i), tc.Name); err != nil {
+			return err
+		}
+	}
+	return validateMessage(cfg, req.Message)
+}
+
+func validateSendRaw(cfg config.Config, req types.SendRawRequest) error {
+	if err := required("raw_message", req.RawMessage); err != nil {
+		return err
+	}
+	if req.FromEmail != "" {
+		if err := checkSender(cfg, "from_email", req.FromEmail); err != nil {
+			return err
+		}
+	}
+	return checkDomain("return_path_domain", req.ReturnPathDomain)
+}
+
+func validateTemplateFields(cfg config.Config, name, fromEmail string) error {
+	if err := required("name", name); err != nil {
+		return err
+	}
+	if fromEmail != "" {
+		return checkSender(cfg, "from_email", fromEmail)
+	}
+	return nil
+}
+
+func validateTemplateUpdate(cfg config.Config, req types.TemplateUpdateRequest) error {
+	fromEmail := ""
+	if req.FromEmail != nil {
+		fromEmail = *req.FromEmail
+	}
+	return validateTemplateFields(cfg, req.Name, fromEmail)
+}
+
+func validateTemplateRender(req types.TemplateRenderRequest) error {
+	if err := required("template_name", req.TemplateName); err != nil {
+		return err
+	}
+	for i, tc := range req.TemplateContent {
+		if err := required(fmt.Sprintf("template_content[%d].name", i), tc.Name); err != nil {
+			return err
+		}
+	}
+	if err := checkMergeLanguage("merge_language", req.MergeLanguage); err != nil {
+		return err
+	}
+	return checkMergeVars("merge_vars", req.MergeVars)
+}
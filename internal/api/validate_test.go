@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"key":"k","message":{"subject":"hi"}}`, ""},
+		{``, "invalid json: empty body"},
+		{`{"message":`, "invalid json"},
+		{`[]`, "request body: expected object, got array"},
+		{`{"message":{"to":"a@example.com"}}`, "message.to: expected array, got string"},
+		{`{"message":{"to":[{"email":1}]}}`, "message.to[0].email: expected string, got number"},
+	}
+	for _, tt := range tests {
+		var req types.SendRequest
+		err := decodeRequest(httptest.NewRequest("POST", "/", strings.NewReader(tt.body)), &req)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("decodeRequest(%s) = %v", tt.body, err)
+		case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+			t.Errorf("decodeRequest(%s) = %v, want %q", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestValidRecipient(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"a@example.com", true},
+		{"a+tag@sub.example.co", true},
+		{"a@localhost", true},
+		{"a@[192.0.2.1]", true},
+		{"a@[IPv6:2001:db8::1]", true},
+		{"a@mailhog", false},
+		{"a@example.123", false},
+		{"a@-example.com", false},
+		{"a@example..com", false},
+		{"Ann <a@example.com>", false},
+		{"a@", false},
+		{"@example.com", false},
+		{"a@@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validRecipient(tt.addr); got != tt.want {
+			t.Errorf("validRecipient(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	tests := []struct {
+		addr   string
+		strict bool
+		ok     bool
+	}{
+		{"dev@example.com", false, true},
+		{"dev@example.com", true, true},
+		{"dev@localhost", true, true},
+		{"dev@mailhog", false, true},
+		{"dev@mailhog", true, false},
+		{"dev@123", false, false},
+		{"dev@-x", false, false},
+		{"dev", false, false},
+	}
+	for _, tt := range tests {
+		err := checkSender(config.Config{Strict: tt.strict}, "from_email", tt.addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkSender(%q, strict=%v) = %v, want ok %v", tt.addr, tt.strict, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		m    types.MandrillMessage
+		want string
+	}{
+		{"empty", types.MandrillMessage{}, ""},
+		{"invalid bcc_address is checked per recipient", types.MandrillMessage{BccAddress: "not an address"}, ""},
+		{"single-label sender", types.MandrillMessage{FromEmail: "dev@mailhog"}, ""},
+		{"bad from_email", types.MandrillMessage{FromEmail: "Ann <a@example.com>"}, "message.from_email: invalid email address"},
+		{"missing recipient email", types.MandrillMessage{To: []types.MandrillRecipient{{Name: "Ann"}}}, "message.to[0].email: required"},
+		{"bad recipient type", types.MandrillMessage{To: []types.MandrillRecipient{{Email: "a@example.com", Type: "from"}}}, "message.to[0].type"},
+		{"bad header name", types.MandrillMessage{Headers: map[string]string{"X Bad": "1"}}, "message.headers: invalid header name"},
+		{"bad merge_language", types.MandrillMessage{MergeLanguage: "jinja"}, "message.merge_language"},
+		{"underscore merge var", types.MandrillMessage{GlobalMergeVars: []types.MandrillMergeVar{{Name: "_X"}}}, "message.global_merge_vars[0].name"},
+		{"merge_vars without rcpt", types.MandrillMessage{MergeVars: []types.MandrillRcptMergeVars{{}}}, "message.merge_vars[0].rcpt: required"},
+		{"line-wrapped base64", types.MandrillMessage{Attachments: []types.MandrillAttachment{{Name: "a.txt", Content: "aGVs\r\nbG8=\n"}}}, ""},
+		{"bad base64", types.MandrillMessage{Attachments: []types.MandrillAttachment{{Name: "a.txt", Content: "a*b"}}}, "message.attachments[0].content"},
+		{"non-image image", types.MandrillMessage{Images: []types.MandrillAttachment{{Name: "a", Type: "text/plain"}}}, "message.images[0].type"},
+	}
+	for _, tt := range tests {
+		err := validateMessage(config.Config{}, tt.m)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: validateMessage() = %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+			t.Errorf("%s: validateMessage() = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/mailer"
+)
+
+// Report is what a bounce says about a message this server sent.
+type Report struct {
+	MessageID  string      `json:"message_id"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+// Recipient is the outcome for one failed (or delayed) address.
+type Recipient struct {
+	Email       string `json:"email"`
+	Action      string `json:"action"`
+	Status      string `json:"status"`
+	Diagnostic  string `json:"diag"`
+	Description string `json:"bounce_description"`
+	Hard        bool   `json:"hard"`
+}
+
+var (
+	messageIDRe    = regexp.MustCompile(`(?im)^Message-ID:\s*<([0-9A-Za-z]+)@mandrill-dev\.local>`)
+	verpRe         = regexp.MustCompile(`(?i)bounce-md_[0-9A-Za-z]+@[A-Za-z0-9.\-]+`)
+	enhancedCodeRe = regexp.MustCompile(`(?:^|[^\d.])([245]\.\d{1,3}\.\d{1,3})(?:[^\d.]|\.?$|\.\s)`)
+	replyCodeRe    = regexp.MustCompile(`\b([45])\d\d\b`)
+	addressRe      = regexp.MustCompile(`[A-Za-z0-9._%+\-=]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+`)
+	angleAddrRe    = regexp.MustCompile(`(?m)^<([^<>\s]+@[^<>\s]+)>:?`)
+	statusRe       = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+)
+
+// Parse reads a bounce message. RFC 3464 delivery status notifications are
+// read field by field; anything else (Exim, qmail, Postfix and other
+// free-form bounces) is scanned for failed addresses and SMTP codes.
+// envelopeTo is the address the bounce was delivered to, if known; a VERP
+// address there identifies the original message.
+func Parse(raw []byte, envelopeTo string) (*Report, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("bounce: %w", err)
+	}
+	r := &Report{}
+	if id, ok := mailer.ParseVERP(envelopeTo); ok {
+		r.MessageID = id
+	}
+	for _, h := range []string{"To", "Delivered-To", "X-Original-To"} {
+		if r.MessageID != "" {
+			break
+		}
+		if m := verpRe.FindString(msg.Header.Get(h)); m != "" {
+			r.MessageID, _ = mailer.ParseVERP(m)
+		}
+	}
+
+	var text strings.Builder
+	walk(textproto.MIMEHeader(msg.Header), msg.Body, func(ctype string, body []byte) {
+		switch ctype {
+		case "message/delivery-status", "message/global-delivery-status":
+			r.Recipients = append(r.Recipients, parseDeliveryStatus(body)...)
+		case "text/plain", "message/rfc822", "text/rfc822-headers", "message/rfc822-headers":
+			text.Write(body)
+			text.WriteString("\n")
+		}
+	})
+	body := text.String()
+	if r.MessageID == "" {
+		if m := messageIDRe.FindStringSubmatch(body); m != nil {
+			r.MessageID = m[1]
+		}
+	}
+	if len(r.Recipients) == 0 {
+		r.Recipients = scanText(msg.Header.Get("X-Failed-Recipients"), body)
+	}
+	for i := range r.Recipients {
+		classify(&r.Recipients[i])
+	}
+	if len(r.Recipients) == 0 {
+		return r, fmt.Errorf("bounce: no failed recipients found")
+	}
+	return r, nil
+}
+
+// FromReply describes rcpt refused by an SMTP server replying code and msg
+// (550, "5.1.1 User unknown"). Code 0 means the server could not be
+// reached; msg is then the connection error.
+func FromReply(rcpt string, code int, msg string) Recipient {
+	r := Recipient{Email: rcpt, Action: "failed", Diagnostic: fmt.Sprintf("%d %s", code, msg)}
+	if code == 0 {
+		r.Status, r.Diagnostic = "4.4.1", msg
+	}
+	classify(&r)
+	return r
+}
+
+// walk calls fn with the decoded body of every leaf part.
+func walk(h textproto.MIMEHeader, body io.Reader, fn func(ctype string, body []byte)) {
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype = "text/plain"
+	}
+	if strings.HasPrefix(ctype, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			walk(p.Header, p, fn)
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &whitespaceStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, _ := io.ReadAll(body)
+	fn(ctype, b)
+}
+
+// parseDeliveryStatus reads the per-recipient field groups of a
+// message/delivery-status part.
+func parseDeliveryStatus(body []byte) []Recipient {
+	var out []Recipient
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(bytes.TrimLeft(body, "\r\n"))))
+	for {
+		h, err := tr.ReadMIMEHeader()
+		if len(h) > 0 {
+			rcpt := h.Get("Final-Recipient")
+			if rcpt == "" {
+				rcpt = h.Get("Original-Recipient")
+			}
+			if rcpt != "" {
+				out = append(out, Recipient{
+					Email:      addressPart(rcpt),
+					Action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+					Status:     statusField(h.Get("Status")),
+					Diagnostic: addressPart(h.Get("Diagnostic-Code")),
+				})
+			}
+		}
+		if err != nil {
+			return out
+		}
+	}
+}
+
+// statusField returns the status code of a DSN Status field ("5.1.1
+// (user unknown)"), or "" when it is missing or malformed, leaving
+// classify to work it out.
+func statusField(v string) string {
+	f := strings.Fields(v)
+	if len(f) == 0 || !statusRe.MatchString(f[0]) {
+		return ""
+	}
+	return f[0]
+}
+
+// addressPart drops the type prefix of DSN fields ("rfc822; a@b", "smtp; 550 ...").
+func addressPart(v string) string {
+	if _, rest, ok := strings.Cut(v, ";"); ok {
+		v = rest
+	}
+	return strings.Join(strings.Fields(v), " ")
+}
+
+// scanText finds failed recipients in a free-form bounce.
+func scanText(failedHeader, body string) []Recipient {
+	var emails []string
+	seen := map[string]bool{}
+	add := func(e string) {
+		e = strings.Trim(strings.TrimSpace(e), "<>")
+		l := strings.ToLower(e)
+		if e == "" || seen[l] || verpRe.MatchString(e) || strings.HasPrefix(l, "mailer-daemon@") || strings.HasPrefix(l, "postmaster@") {
+			return
+		}
+		seen[l] = true
+		emails = append(emails, e)
+	}
+	for _, e := range strings.Split(failedHeader, ",") {
+		add(e)
+	}
+	// qmail and Postfix list failed recipients as "<addr>:" lines.
+	for _, m := range angleAddrRe.FindAllStringSubmatch(body, -1) {
+		add(m[1])
+	}
+	lines := strings.Split(body, "\n")
+	diag := ""
+	for _, l := range lines {
+		if replyCodeRe.MatchString(l) || enhancedCodeRe.MatchString(l) {
+			diag = strings.Join(strings.Fields(l), " ")
+			break
+		}
+	}
+	if len(emails) == 0 {
+		// Last resort: the first address mentioned next to the error.
+		for _, l := range lines {
+			if strings.Contains(strings.ToLower(l), "message-id") {
+				continue
+			}
+			if m := addressRe.FindString(l); m != "" && (diag == "" || strings.Contains(l, m)) {
+				add(m)
+				if len(emails) > 0 {
+					break
+				}
+			}
+		}
+	}
+	out := make([]Recipient, 0, len(emails))
+	for _, e := range emails {
+		out = append(out, Recipient{Email: e, Action: "failed", Diagnostic: diag})
+	}
+	return out
+}
+
+// classify sets Mandrill's bounce_description and whether the bounce is
+// permanent.
+func classify(r *Recipient) {
+	if r.Status == "" {
+		if m := enhancedCode(r.Diagnostic); m != "" {
+			r.Status = m
+		} else if m := replyCodeRe.FindString(r.Diagnostic); m != "" {
+			r.Status = m[:1] + ".0.0"
+		} else if strings.EqualFold(r.Action, "delayed") {
+			r.Status = "4.0.0"
+		} else {
+			r.Status = "5.0.0"
+		}
+	}
+	if r.Action == "" {
+		r.Action = "failed"
+	}
+	diag := strings.ToLower(r.Diagnostic)
+	sub := r.Status[strings.IndexByte(r.Status, '.')+1:]
+	switch {
+	case sub == "2.2" || strings.Contains(diag, "quota") || strings.Contains(diag, "mailbox full") || strings.Contains(diag, "mailbox is full"):
+		r.Description = "mailbox_full"
+	case sub == "1.1" || sub == "1.0" || sub == "1.6" || strings.Contains(diag, "user unknown") || strings.Contains(diag, "no such user") || strings.Contains(diag, "does not exist"):
+		r.Description = "bad_mailbox"
+	case sub == "1.2" || sub == "4.4" || strings.Contains(diag, "host not found") || strings.Contains(diag, "domain not found"):
+		r.Description = "invalid_domain"
+	case sub == "3.4" || sub == "2.3":
+		r.Description = "message_too_large"
+	case strings.HasPrefix(sub, "7.") && strings.Contains(diag, "spam"):
+		r.Description = "spam_related"
+	case strings.HasPrefix(sub, "7."):
+		r.Description = "policy_related"
+	default:
+		r.Description = "general"
+	}
+	r.Hard = r.Status[0] == '5' && r.Action != "delayed" && r.Description != "mailbox_full"
+}
+
+// enhancedCode finds an RFC 3463 status code ("5.1.1") in s, skipping
+// anything that is part of a longer dotted number such as an IP address.
+func enhancedCode(s string) string {
+	if m := enhancedCodeRe.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// whitespaceStripper drops line breaks from base64 bodies.
+type whitespaceStripper struct{ r io.Reader }
+
+func (w *whitespaceStripper) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+			p[j] = c
+			j++
+		}
+	}
+	return j, err
+}
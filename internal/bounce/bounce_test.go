@@ -0,0 +1,287 @@
+package bounce
+
+import (
+	"strings"
+	"testing"
+)
+
+// crlf turns a readable fixture into a message with CRLF line endings.
+func crlf(s string) []byte {
+	return []byte(strings.ReplaceAll(strings.TrimLeft(s, "\n"), "\n", "\r\n"))
+}
+
+const postfixDSN = `
+From: MAILER-DAEMON@mx.example.net (Mail Delivery System)
+To: bounce-md_0123456789abcdef01234567@bounces.example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="B1"
+
+--B1
+Content-Type: text/plain; charset=us-ascii
+
+This is the mail system at host mx.example.net.
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+--B1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.net
+Arrival-Date: Mon, 19 Oct 2026 13:41:00 +0000
+
+Final-Recipient: rfc822; alice@example.org
+Original-Recipient: rfc822;alice@example.org
+Action: failed
+Status: 5.1.1
+Remote-MTA: dns; mail.example.org
+Diagnostic-Code: smtp; 550 5.1.1 <alice@example.org>: Recipient address
+    rejected: User unknown in local recipient table
+
+Final-Recipient: rfc822; bob@example.org
+Action: delayed
+Status: 4.2.2 (over quota)
+Diagnostic-Code: smtp; 452 4.2.2 Mailbox full
+
+--B1
+Content-Type: message/rfc822
+
+Message-ID: <0123456789abcdef01234567@mandrill-dev.local>
+Subject: Hello
+
+--B1--
+`
+
+const eximBounce = `
+From: Mail Delivery System <Mailer-Daemon@mx.example.net>
+To: sender@example.com
+Subject: Mail delivery failed: returning message to sender
+X-Failed-Recipients: carol@example.org
+
+This message was created automatically by mail delivery software.
+
+A message that you sent could not be delivered to one or more of its
+recipients. This is a permanent error. The following address(es) failed:
+
+  carol@example.org
+    host mail.example.org [192.0.2.10]
+    SMTP error from remote mail server after RCPT TO:<carol@example.org>:
+    550 5.1.2 Host not found
+
+------ This is a copy of the message, including all the headers. ------
+
+Message-ID: <fedcba9876543210fedcba98@mandrill-dev.local>
+Subject: Hello
+`
+
+const qmailBounce = `
+From: MAILER-DAEMON@mx.example.net
+To: bounce-md_aaaaaaaaaaaaaaaaaaaaaaaa@bounces.example.com
+Subject: failure notice
+
+Hi. This is the qmail-send program at mx.example.net.
+I'm afraid I wasn't able to deliver your message to the following addresses.
+This is a permanent error; I've given up. Sorry it didn't work out.
+
+<dave@example.org>:
+192.0.2.20 does not like recipient.
+Remote host said: 554 5.7.1 Message rejected as spam
+Giving up on 192.0.2.20.
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		envelopeTo string
+		messageID  string
+		want       []Recipient
+	}{
+		{
+			name:      "postfix DSN",
+			raw:       postfixDSN,
+			messageID: "0123456789abcdef01234567",
+			want: []Recipient{
+				{Email: "alice@example.org", Action: "failed", Status: "5.1.1", Description: "bad_mailbox", Hard: true},
+				{Email: "bob@example.org", Action: "delayed", Status: "4.2.2", Description: "mailbox_full"},
+			},
+		},
+		{
+			name:      "exim",
+			raw:       eximBounce,
+			messageID: "fedcba9876543210fedcba98",
+			want: []Recipient{
+				{Email: "carol@example.org", Action: "failed", Status: "5.1.2", Description: "invalid_domain", Hard: true},
+			},
+		},
+		{
+			name:      "qmail",
+			raw:       qmailBounce,
+			messageID: "aaaaaaaaaaaaaaaaaaaaaaaa",
+			want: []Recipient{
+				{Email: "dave@example.org", Action: "failed", Status: "5.7.1", Description: "spam_related", Hard: true},
+			},
+		},
+		{
+			name:       "VERP envelope wins",
+			raw:        eximBounce,
+			envelopeTo: "<bounce-md_bbbbbbbbbbbbbbbbbbbbbbbb@bounces.example.com>",
+			messageID:  "bbbbbbbbbbbbbbbbbbbbbbbb",
+			want: []Recipient{
+				{Email: "carol@example.org", Action: "failed", Status: "5.1.2", Description: "invalid_domain", Hard: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(crlf(tt.raw), tt.envelopeTo)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if r.MessageID != tt.messageID {
+				t.Errorf("MessageID = %q, want %q", r.MessageID, tt.messageID)
+			}
+			if len(r.Recipients) != len(tt.want) {
+				t.Fatalf("got %d recipients, want %d: %+v", len(r.Recipients), len(tt.want), r.Recipients)
+			}
+			for i, want := range tt.want {
+				got := r.Recipients[i]
+				got.Diagnostic = ""
+				if got != want {
+					t.Errorf("recipient %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []Recipient
+		wantErr bool
+	}{
+		{
+			name: "missing Status",
+			raw: `
+From: MAILER-DAEMON@mx.example.net
+To: bounce-md_0123456789abcdef01234567@bounces.example.com
+Content-Type: multipart/report; report-type=delivery-status; boundary="B1"
+
+--B1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.net
+
+Final-Recipient: rfc822; alice@example.org
+Action: failed
+
+Final-Recipient: rfc822; bob@example.org
+Action: delayed
+
+--B1--
+`,
+			want: []Recipient{
+				{Email: "alice@example.org", Action: "failed", Status: "5.0.0", Description: "general", Hard: true},
+				{Email: "bob@example.org", Action: "delayed", Status: "4.0.0", Description: "general"},
+			},
+		},
+		{
+			name: "malformed Status",
+			raw: `
+From: MAILER-DAEMON@mx.example.net
+Content-Type: multipart/report; report-type=delivery-status; boundary="B1"
+
+--B1
+Content-Type: message/delivery-status
+
+Final-Recipient: rfc822; alice@example.org
+Action: failed
+Status: x
+Diagnostic-Code: smtp; 550 5.1.1 User unknown
+
+--B1--
+`,
+			want: []Recipient{
+				{Email: "alice@example.org", Action: "failed", Status: "5.1.1", Description: "bad_mailbox", Hard: true},
+			},
+		},
+		{
+			name: "missing delivery-status part",
+			raw: `
+From: MAILER-DAEMON@mx.example.net
+Content-Type: multipart/report; report-type=delivery-status; boundary="B1"
+
+--B1
+Content-Type: text/plain
+
+<erin@example.org>: 550 5.1.1 User unknown
+
+--B1--
+`,
+			want: []Recipient{
+				{Email: "erin@example.org", Action: "failed", Status: "5.1.1", Description: "bad_mailbox", Hard: true},
+			},
+		},
+		{
+			name: "non-multipart without recipients",
+			raw: `
+From: MAILER-DAEMON@mx.example.net
+Content-Type: multipart/report; boundary="B1"
+
+Something went wrong.
+`,
+			wantErr: true,
+		},
+		{
+			name:    "empty delivery-status",
+			raw:     "Content-Type: message/delivery-status\n\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(crlf(tt.raw), "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse: want error, got %+v", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(r.Recipients) != len(tt.want) {
+				t.Fatalf("got %d recipients, want %d: %+v", len(r.Recipients), len(tt.want), r.Recipients)
+			}
+			for i, want := range tt.want {
+				got := r.Recipients[i]
+				got.Diagnostic = ""
+				if got != want {
+					t.Errorf("recipient %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFromReply(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want Recipient
+	}{
+		{550, "5.1.1 User unknown", Recipient{Status: "5.1.1", Description: "bad_mailbox", Hard: true}},
+		{552, "5.2.2 Mailbox full", Recipient{Status: "5.2.2", Description: "mailbox_full"}},
+		{451, "Try again later", Recipient{Status: "4.0.0", Description: "general"}},
+		{0, "dial tcp: connection refused", Recipient{Status: "4.4.1", Description: "general"}},
+	}
+	for _, tt := range tests {
+		got := FromReply("a@example.org", tt.code, tt.msg)
+		if got.Status != tt.want.Status || got.Description != tt.want.Description || got.Hard != tt.want.Hard {
+			t.Errorf("FromReply(%d, %q) = %+v, want %+v", tt.code, tt.msg, got, tt.want)
+		}
+	}
+}
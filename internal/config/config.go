@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type SMTPMode string
@@ -21,6 +23,83 @@ type Config struct {
 	SMTPMode        SMTPMode
 	InsecureTLS     bool
 	DefaultFromName string
+	TemplatesDir    string
+	// Strict mirrors production Mandrill instead of the permissive defaults:
+	// every endpoint requires a key, unknown templates and bad dates fail.
+	Strict bool
+	// TrackingURL is the public base URL used for open pixels and click
+	// redirects in tracked messages.
+	TrackingURL string
+	// TrackingSecret signs tracking links; empty means a random secret per
+	// process.
+	TrackingSecret string
+	// WebhookURLs receive Mandrill-style event batches; WebhookKey signs them.
+	WebhookURLs []string
+	WebhookKey  string
+	// AutoTextKeys are API keys whose messages get auto_text by default when
+	// no text part is given; "*" applies to every key.
+	AutoTextKeys []string
+	// DKIMSign signs outgoing mail with per-domain keys from DKIMKeysDir,
+	// generating (and saving) keys for domains that have none.
+	DKIMSign      bool
+	DKIMKeysDir   string
+	DKIMSelector  string
+	DKIMAlgorithm string
+	// ReturnPathDomain, when set, makes the envelope sender a VERP address
+	// (bounce-md_<id>@domain) for messages without their own return_path_domain.
+	ReturnPathDomain string
+	// SimulateRules give matching recipients a fixed outcome (bounce, defer,
+	// spam complaint, ...); SimulateDefaults adds the built-in test addresses.
+	SimulateRules    []string
+	SimulateDefaults bool
+	// Sends with async set, or with more than AsyncThreshold recipients
+	// (0 disables), return "queued" and are delivered by QueueWorkers
+	// background workers; QueueSize jobs wait in the queue, the rest in an
+	// overflow list.
+	AsyncThreshold int
+	QueueWorkers   int
+	QueueSize      int
+	// Deferred deliveries are retried after RetryInitial, doubling up to
+	// RetryMaxInterval, until the message is RetryMaxAge old.
+	RetryInitial     time.Duration
+	RetryMaxInterval time.Duration
+	RetryMaxAge      time.Duration
+	// SMTPPoolSize caps the connections open to an upstream at once; they
+	// are kept for reuse until idle for SMTPPoolIdleTimeout. 0 opens a new
+	// connection per message.
+	SMTPPoolSize        int
+	SMTPPoolIdleTimeout time.Duration
+	// Transport is where messages are delivered: "smtp" (the default),
+	// "smtp://HOST", "maildir:DIR", "mbox:FILE", "eml:DIR", "sendmail[:CMD]",
+	// "lmtp:ADDR", "capture" (the embedded SMTP server), "stdout" or "null".
+	Transport string
+	// Upstreams are extra named transports ("name=transport"); Routes pick
+	// them by recipient domain, subaccount, tag, ip_pool or API key, with
+	// failover ("field:pattern=upstream|fallback"). UpstreamTimeout bounds
+	// each attempt.
+	Upstreams       []string
+	Routes          []string
+	UpstreamTimeout time.Duration
+	// RedirectTo, when set, receives every message in place of its
+	// recipients, plus-addressed (catchall+user=domain@...) with
+	// RedirectPlus. Recipients in RedirectAllowDomains (or their
+	// subdomains) are delivered as normal.
+	RedirectTo           string
+	RedirectPlus         bool
+	RedirectAllowDomains []string
+	// SMTPDAddr is where the embedded SMTP capture server listens (empty:
+	// only the in-process "capture" transport reaches it). SMTPDAuth,
+	// "user:password", makes it require AUTH; SMTPDTLSCert and SMTPDTLSKey
+	// replace the self-signed STARTTLS certificate. SMTPDMaxMessages caps the
+	// messages kept, dropping the oldest (0 keeps all).
+	SMTPDAddr        string
+	SMTPDHostname    string
+	SMTPDAuth        string
+	SMTPDTLSCert     string
+	SMTPDTLSKey      string
+	SMTPDMaxMessages int
+	// Inbox serves the web inbox at /inbox/.
+	Inbox bool
 }
 
 func envOr(k, def string) string {
@@ -31,17 +110,77 @@ func envOr(k, def string) string {
 	return v
 }
 
+// envDuration reads a duration such as "30s"; invalid values fall back to def.
+func envDuration(k, def string) time.Duration {
+	d, err := time.ParseDuration(envOr(k, def))
+	if err != nil || d <= 0 {
+		d, _ = time.ParseDuration(def)
+	}
+	return d
+}
+
 func Load() Config {
 	port, _ := strconv.Atoi(envOr("SMTP_PORT", "1025"))
 	mode := envOr("SMTP_TLS", "none")
 	insecure := envOr("SMTP_INSECURE_TLS", "false") == "true"
+	asyncThreshold, _ := strconv.Atoi(envOr("ASYNC_THRESHOLD", "10"))
+	workers, _ := strconv.Atoi(envOr("QUEUE_WORKERS", "4"))
+	queueSize, _ := strconv.Atoi(envOr("QUEUE_SIZE", "1000"))
+	poolSize, _ := strconv.Atoi(envOr("SMTP_POOL_SIZE", "4"))
+	smtpdMax, _ := strconv.Atoi(envOr("SMTPD_MAX_MESSAGES", "1000"))
 	return Config{
-		SMTPHost:        envOr("SMTP_HOST", "localhost"),
-		SMTPPort:        port,
-		SMTPUsername:    envOr("SMTP_USERNAME", ""),
-		SMTPPassword:    envOr("SMTP_PASSWORD", ""),
-		SMTPMode:        SMTPMode(mode),
-		InsecureTLS:     insecure,
-		DefaultFromName: envOr("DEFAULT_FROM_NAME", "Mandrill Dev"),
+		SMTPHost:             envOr("SMTP_HOST", "localhost"),
+		SMTPPort:             port,
+		SMTPUsername:         envOr("SMTP_USERNAME", ""),
+		SMTPPassword:         envOr("SMTP_PASSWORD", ""),
+		SMTPMode:             SMTPMode(mode),
+		InsecureTLS:          insecure,
+		DefaultFromName:      envOr("DEFAULT_FROM_NAME", "Mandrill Dev"),
+		TemplatesDir:         envOr("TEMPLATES_DIR", ""),
+		Strict:               envOr("STRICT", "false") == "true",
+		TrackingSecret:       envOr("TRACKING_SECRET", ""),
+		TrackingURL:          strings.TrimRight(envOr("TRACKING_URL", "http://localhost:"+envOr("PORT", "8080")), "/"),
+		WebhookURLs:          splitList(envOr("WEBHOOK_URLS", "")),
+		WebhookKey:           envOr("WEBHOOK_KEY", ""),
+		AutoTextKeys:         splitList(envOr("AUTO_TEXT_KEYS", "")),
+		DKIMSign:             envOr("DKIM_SIGN", "false") == "true" || os.Getenv("DKIM_KEYS_DIR") != "",
+		DKIMKeysDir:          envOr("DKIM_KEYS_DIR", ""),
+		DKIMSelector:         envOr("DKIM_SELECTOR", "mandrill"),
+		DKIMAlgorithm:        envOr("DKIM_ALGORITHM", "rsa-sha256"),
+		ReturnPathDomain:     envOr("RETURN_PATH_DOMAIN", ""),
+		SimulateRules:        splitList(envOr("SIMULATE_RULES", "")),
+		SimulateDefaults:     envOr("SIMULATE_DEFAULTS", "true") == "true",
+		AsyncThreshold:       asyncThreshold,
+		QueueWorkers:         workers,
+		QueueSize:            queueSize,
+		RetryInitial:         envDuration("RETRY_INITIAL", "10s"),
+		RetryMaxInterval:     envDuration("RETRY_MAX_INTERVAL", "10m"),
+		RetryMaxAge:          envDuration("RETRY_MAX_AGE", "24h"),
+		SMTPPoolSize:         poolSize,
+		SMTPPoolIdleTimeout:  envDuration("SMTP_POOL_IDLE_TIMEOUT", "30s"),
+		Transport:            envOr("TRANSPORT", "smtp"),
+		Upstreams:            splitList(envOr("UPSTREAMS", "")),
+		Routes:               splitList(envOr("ROUTES", "")),
+		UpstreamTimeout:      envDuration("UPSTREAM_TIMEOUT", "30s"),
+		RedirectTo:           strings.TrimSpace(envOr("REDIRECT_TO", "")),
+		RedirectPlus:         envOr("REDIRECT_PLUS", "false") == "true",
+		RedirectAllowDomains: splitList(envOr("REDIRECT_ALLOW_DOMAINS", "")),
+		SMTPDAddr:            envOr("SMTPD_ADDR", ""),
+		SMTPDHostname:        envOr("SMTPD_HOSTNAME", "mandrill-dev.local"),
+		SMTPDAuth:            envOr("SMTPD_AUTH", ""),
+		SMTPDTLSCert:         envOr("SMTPD_TLS_CERT", ""),
+		SMTPDTLSKey:          envOr("SMTPD_TLS_KEY", ""),
+		SMTPDMaxMessages:     smtpdMax,
+		Inbox:                envOr("INBOX", "true") == "true",
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
 	}
+	return out
 }
@@ -0,0 +1,275 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/bounce"
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Job is a built message ready to be relayed.
+type Job struct {
+	ID     string
+	Sender string // envelope sender
+	Rcpts  []string
+	Raw    []byte
+	// Directives are the message's X-MandrillDev-Simulate overrides.
+	Directives simulate.Directives
+	// Route is what routing rules match on to pick upstreams.
+	Route routing.Message
+	// Redirect maps recipients to the catch-all addresses they are
+	// delivered to in redirect mode.
+	Redirect map[string]string
+	// Attempt counts delivery attempts so far; Since is when the first
+	// one was made.
+	Attempt int
+	Since   time.Time
+}
+
+// Result is what a delivery attempt did with each recipient.
+type Result struct {
+	Sent     []string
+	Deferred []string
+	Bounced  []bounce.Recipient
+}
+
+// NewJob builds the job for rec. Messages from send-raw carry the original
+// message in Raw and are relayed as given; others are built from
+// rec.Message and the result is kept in rec.Raw. NewJob writes to rec, so
+// it must not be a record other goroutines can see yet; copy stored ones.
+func (q *Queue) NewJob(rec *types.MessageRecord) Job {
+	job := Job{ID: rec.ID, Route: routing.Message{Subaccount: rec.Message.Subaccount, Tags: rec.Tags, IPPool: rec.IPPool, Key: rec.Key}}
+	if len(rec.Raw) > 0 {
+		job.Sender, job.Raw = q.mailer.PrepareRaw(rec.From, rec.Raw, rec.ID, rec.Message.ReturnPathDomain)
+		job.Rcpts = rec.To
+		job.Raw, job.Redirect = redirect(q.cfg, rec, job.Rcpts, job.Raw)
+		return job
+	}
+	job.Sender, job.Rcpts, job.Raw = q.mailer.Build(rec.Message, rec.ID)
+	job.Raw, job.Redirect = redirect(q.cfg, rec, job.Rcpts, job.Raw)
+	job.Directives, _ = simulate.FromHeaders(rec.Message.Headers)
+	rec.Raw = job.Raw
+	return job
+}
+
+// Deliver makes one delivery attempt for job and records the outcome on
+// the stored message: its state, an smtp_events entry and a send,
+// deferral or bounce event per recipient, which subscribers such as
+// webhooks see like any other event.
+//
+// A 5xx reply bounces the recipients it applies to. 4xx replies and
+// connection errors defer them: they are queued again with exponential
+// backoff and soft-bounce once the message is older than RetryMaxAge.
+// Simulation rules and the job's directives stand in for the SMTP server
+// where they apply; bounces, complaints and opens they call for follow
+// delivery after the rule's delay. A job with a delay directive isn't
+// attempted yet: it is queued again once the delay is up and its
+// recipients are in none of the result's lists.
+func (q *Queue) Deliver(job Job) Result {
+	if d := job.Directives.Delay; d > 0 {
+		job.Directives.Delay = 0
+		q.retry(job, job.Rcpts, d)
+		return Result{}
+	}
+	cfg, st := q.cfg, q.st
+	job.Attempt++
+	if job.Since.IsZero() {
+		job.Since = time.Now()
+	}
+	rules := job.Directives.Rules(q.rules)
+
+	var res Result
+	var relay []string
+	for _, rcpt := range job.Rcpts {
+		if r, ok := rules.Match(rcpt); ok && r.Action == simulate.Defer && job.Attempt <= r.Count {
+			deferral(st, job.ID, rcpt, fmt.Sprintf("451 4.7.1 <%s>: Recipient address rejected: Greylisted, try again later", rcpt))
+			q.retry(job, []string{rcpt}, r.Delay)
+			res.Deferred = append(res.Deferred, rcpt)
+			continue
+		}
+		relay = append(relay, rcpt)
+	}
+	if len(relay) == 0 {
+		return res
+	}
+
+	refused := mailer.RecipientErrors{}
+	if job.Directives.SMTPError != "" {
+		addRefused(refused, relay, smtpError(job.Directives.SMTPError))
+	} else {
+		q.send(job, relay, refused)
+	}
+
+	var temporary []string
+	giveUp := time.Since(job.Since) >= cfg.RetryMaxAge
+	for _, rcpt := range relay {
+		reply, failed := refused[rcpt]
+		switch {
+		case !failed:
+			delivered(st, rules, job.ID, rcpt)
+			res.Sent = append(res.Sent, rcpt)
+		case reply.Code >= 500 || giveUp:
+			b := bounce.FromReply(rcpt, reply.Code, reply.Msg)
+			if reply.Code < 500 {
+				b.Hard = false
+			}
+			refusedBounce(st, job.ID, b)
+			res.Bounced = append(res.Bounced, b)
+		default:
+			deferral(st, job.ID, rcpt, bounce.FromReply(rcpt, reply.Code, reply.Msg).Diagnostic)
+			temporary = append(temporary, rcpt)
+		}
+	}
+	if len(temporary) > 0 {
+		q.retry(job, temporary, backoff(cfg, job.Attempt))
+		res.Deferred = append(res.Deferred, temporary...)
+	}
+	return res
+}
+
+// send relays job to rcpts through the upstreams routing picks for them,
+// grouping recipients that share a route. When an upstream can't take the
+// message (it is unreachable, times out or refuses the whole transaction
+// with a 4xx) the route's next upstream is tried. Recipients that were
+// not accepted are added to refused.
+func (q *Queue) send(job Job, rcpts []string, refused mailer.RecipientErrors) {
+	rt := q.router
+	groups := map[string][]string{}
+	var routes []string
+	for _, rcpt := range rcpts {
+		route := strings.Join(rt.Route(job.Route, rcpt), "|")
+		if _, ok := groups[route]; !ok {
+			routes = append(routes, route)
+		}
+		groups[route] = append(groups[route], rcpt)
+	}
+	for _, route := range routes {
+		var err error
+		addrs, orig := job.redirected(groups[route])
+		upstreams := strings.Split(route, "|")
+		for i, name := range upstreams {
+			err = q.mailer.Relay(rt.Transport(name), job.Sender, addrs, job.Raw)
+			if !failover(err) {
+				break
+			}
+			if i+1 < len(upstreams) {
+				log.Printf("delivery id=%s upstream=%s: %v; trying %s", job.ID, name, err, upstreams[i+1])
+			}
+		}
+		if err != nil {
+			log.Printf("delivery id=%s attempt=%d: %v", job.ID, job.Attempt, err)
+			addRefused(refused, groups[route], originalErrors(err, orig))
+		}
+	}
+}
+
+// failover reports whether err means the upstream couldn't take the
+// message at all, rather than answering for it.
+func failover(err error) bool {
+	var refused mailer.RecipientErrors
+	if err == nil || errors.As(err, &refused) {
+		return false
+	}
+	var reply *textproto.Error
+	return !errors.As(err, &reply) || reply.Code < 500
+}
+
+// addRefused records err for rcpts: per recipient for RecipientErrors,
+// otherwise the whole transaction failed for all of them.
+func addRefused(refused mailer.RecipientErrors, rcpts []string, err error) {
+	var errs mailer.RecipientErrors
+	if errors.As(err, &errs) {
+		for rcpt, reply := range errs {
+			refused[rcpt] = reply
+		}
+		return
+	}
+	for _, rcpt := range rcpts {
+		refused[rcpt] = asReply(err)
+	}
+}
+
+// retry queues job again for rcpts after d.
+func (q *Queue) retry(job Job, rcpts []string, d time.Duration) {
+	job.Rcpts = rcpts
+	time.AfterFunc(d, func() { q.Enqueue(job) })
+}
+
+// backoff is the wait before the attempt following attempt: RetryInitial,
+// doubling up to RetryMaxInterval.
+func backoff(cfg config.Config, attempt int) time.Duration {
+	d := cfg.RetryInitial
+	for i := 1; i < attempt && d < cfg.RetryMaxInterval; i++ {
+		d *= 2
+	}
+	return min(d, cfg.RetryMaxInterval)
+}
+
+// delivered records a successful hand-off to rcpt and schedules whatever
+// a simulation rule says happens next.
+func delivered(st *store.Store, rules simulate.Rules, id, rcpt string) {
+	now := time.Now()
+	st.RecordEvent(id, types.MessageEvent{Event: "send", TS: now.Unix(), Email: rcpt}, func(m *types.MessageRecord) {
+		m.SMTPEvents = append(m.SMTPEvents, types.SMTPEvent{TS: now.Unix(), Type: "sent", Diag: "250 2.0.0 OK"})
+		if pending(m.Status) {
+			m.Status = "sent"
+		}
+		if m.SentAt == nil {
+			m.SentAt = &now
+		}
+	})
+	if rule, ok := rules.Match(rcpt); ok {
+		followUp(st, id, rcpt, rule)
+	}
+}
+
+// deferral records a temporary failure for rcpt.
+func deferral(st *store.Store, id, rcpt, diag string) {
+	now := time.Now()
+	st.RecordEvent(id, types.MessageEvent{Event: "deferral", TS: now.Unix(), Email: rcpt}, func(m *types.MessageRecord) {
+		m.SMTPEvents = append(m.SMTPEvents, types.SMTPEvent{TS: now.Unix(), Type: "deferred", Diag: diag})
+		if pending(m.Status) {
+			m.Status = "deferred"
+		}
+	})
+}
+
+// asReply treats an error that isn't an SMTP reply (a refused or dropped
+// connection, a TLS failure) as a reply without a code.
+func asReply(err error) *textproto.Error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply
+	}
+	return &textproto.Error{Msg: err.Error()}
+}
+
+// smtpError builds the error a server replying with reply would cause,
+// e.g. "451" or "550 5.7.1 Blocked".
+func smtpError(reply string) error {
+	code, msg, _ := strings.Cut(strings.TrimSpace(reply), " ")
+	n, _ := strconv.Atoi(code)
+	if msg = strings.TrimSpace(msg); msg == "" {
+		msg = "4.0.0 Simulated temporary failure"
+		if n >= 500 {
+			msg = "5.0.0 Simulated permanent failure"
+		}
+	}
+	return &textproto.Error{Code: n, Msg: msg}
+}
+
+// pending reports whether a message in state s has not been delivered yet.
+func pending(s string) bool {
+	return s == "queued" || s == "scheduled" || s == "deferred"
+}
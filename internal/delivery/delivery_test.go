@@ -0,0 +1,151 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// newQueue sets up a queue the way main does, with a transport open for
+// every upstream.
+func newQueue(t *testing.T, cfg config.Config, st *store.Store, rules simulate.Rules) *Queue {
+	t.Helper()
+	rt, err := routing.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstreams []string
+	for _, transport := range rt.Transports() {
+		upstreams = append(upstreams, transport)
+	}
+	m, err := mailer.New(cfg, nil, upstreams...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewQueue(cfg, st, m, rt, rules)
+}
+
+func TestFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"delivered", nil, false},
+		{"connection refused", errors.New("dial tcp 127.0.0.1:1: connect: connection refused"), true},
+		{"temporary reply", &textproto.Error{Code: 451, Msg: "4.3.0 Try later"}, true},
+		{"wrapped temporary reply", fmt.Errorf("data: %w", &textproto.Error{Code: 421, Msg: "closing"}), true},
+		{"permanent reply", &textproto.Error{Code: 554, Msg: "5.7.1 Rejected"}, false},
+		{"recipients refused", mailer.RecipientErrors{"a@x.test": {Code: 450, Msg: "busy"}}, false},
+	}
+	for _, tt := range tests {
+		if got := failover(tt.err); got != tt.want {
+			t.Errorf("%s: failover() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestDeliverFailover routes recipients through an unreachable upstream
+// and checks that only those with a fallback are delivered.
+func TestDeliverFailover(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{
+		Transport: "null",
+		Upstreams: []string{"down=smtp://127.0.0.1:1", "backup=maildir:" + dir},
+		Routes: []string{
+			"domain:fail.test=down|backup",
+			"domain:dead.test=down",
+		},
+		UpstreamTimeout: 2 * time.Second,
+	}
+	st := store.NewStore()
+	st.SaveMessage(&types.MessageRecord{ID: "m1", Status: "queued"})
+	q := newQueue(t, cfg, st, nil)
+
+	tests := []struct {
+		rcpt string
+		sent bool
+	}{
+		{"a@fail.test", true},
+		{"b@dead.test", false},
+		{"c@example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rcpt, func(t *testing.T) {
+			res := q.Deliver(Job{ID: "m1", Sender: "s@example.com", Rcpts: []string{tt.rcpt}, Raw: []byte("Subject: hi\r\n\r\nbody\r\n")})
+			if sent := len(res.Sent) == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v (result %+v)", sent, tt.sent, res)
+			}
+			if !tt.sent && len(res.Bounced)+len(res.Deferred) != 1 {
+				t.Errorf("undelivered recipient neither bounced nor deferred: %+v", res)
+			}
+		})
+	}
+	files, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Errorf("backup upstream got %d messages, want 1", len(files))
+	}
+}
+
+// TestDeliverRules checks that a queue applies the rules it was given and
+// no others.
+func TestDeliverRules(t *testing.T) {
+	cfg := config.Config{Transport: "null", RetryInitial: time.Hour, RetryMaxAge: time.Hour}
+	rules, err := simulate.ParseAll([]string{"*@slow.test=defer"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.NewStore()
+	st.SaveMessage(&types.MessageRecord{ID: "m1", Status: "queued"})
+	job := Job{ID: "m1", Sender: "s@example.com", Rcpts: []string{"a@slow.test"}, Raw: []byte("Subject: hi\r\n\r\nbody\r\n")}
+
+	if res := newQueue(t, cfg, st, rules).Deliver(job); len(res.Deferred) != 1 {
+		t.Errorf("with the rule: %+v, want a@slow.test deferred", res)
+	}
+	if res := newQueue(t, cfg, st, nil).Deliver(job); len(res.Sent) != 1 {
+		t.Errorf("without rules: %+v, want a@slow.test sent", res)
+	}
+}
+
+// TestDeliverDelay checks that a delay directive doesn't hold up Deliver:
+// the job comes back through the queue once the delay is up.
+func TestDeliverDelay(t *testing.T) {
+	cfg := config.Config{Transport: "null", QueueSize: 1}
+	st := store.NewStore()
+	st.SaveMessage(&types.MessageRecord{ID: "m1", Status: "queued"})
+	q := newQueue(t, cfg, st, nil)
+
+	job := Job{ID: "m1", Sender: "s@example.com", Rcpts: []string{"a@x.test"}, Raw: []byte("Subject: hi\r\n\r\nbody\r\n"),
+		Directives: simulate.Directives{Delay: 50 * time.Millisecond}}
+	start := time.Now()
+	res := q.Deliver(job)
+	if time.Since(start) >= 50*time.Millisecond {
+		t.Errorf("Deliver waited %v", time.Since(start))
+	}
+	if len(res.Sent)+len(res.Deferred)+len(res.Bounced) != 0 {
+		t.Errorf("delayed job was attempted: %+v", res)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 1 {
+		t.Fatal("delayed job was not queued again")
+	}
+	q.Start()
+	q.Stop()
+	if m, _ := st.GetMessage("m1"); m.Status != "sent" {
+		t.Errorf("status = %q after the delay, want sent", m.Status)
+	}
+}
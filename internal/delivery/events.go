@@ -0,0 +1,107 @@
+package delivery
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/bounce"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// timeLayout is Mandrill's API timestamp format.
+const timeLayout = "2006-01-02 15:04:05"
+
+// Bounce applies a bounce for one recipient of message id: the message
+// moves to bounced or soft-bounced, a hard-bounced address joins the
+// rejects list and a hard_bounce or soft_bounce event is recorded. It
+// reports whether the message exists.
+func Bounce(st *store.Store, id string, r bounce.Recipient) bool {
+	return applyBounce(st, id, r, nil)
+}
+
+// refusedBounce applies a bounce the SMTP server gave during delivery.
+func refusedBounce(st *store.Store, id string, r bounce.Recipient) {
+	now := time.Now().Unix()
+	applyBounce(st, id, r, func(m *types.MessageRecord) {
+		m.SMTPEvents = append(m.SMTPEvents, types.SMTPEvent{TS: now, Type: "bounced", Diag: r.Diagnostic})
+	})
+}
+
+func applyBounce(st *store.Store, id string, r bounce.Recipient, fn func(m *types.MessageRecord)) bool {
+	rec, ok := st.GetMessage(id)
+	if !ok {
+		return false
+	}
+	ev := types.MessageEvent{Event: "soft_bounce", TS: time.Now().Unix(), Email: r.Email}
+	if r.Hard {
+		ev.Event = "hard_bounce"
+		AddReject(st, r.Email, "hard-bounce", r.Diagnostic, rec.From)
+	}
+	return st.RecordEvent(id, ev, func(m *types.MessageRecord) {
+		if r.Hard {
+			m.Status = "bounced"
+		} else if m.Status != "bounced" {
+			m.Status = "soft-bounced"
+		}
+		m.BounceDescription = r.Description
+		m.Diag = r.Diagnostic
+		if fn != nil {
+			fn(m)
+		}
+	})
+}
+
+// AddReject puts email on the rejects list.
+func AddReject(st *store.Store, email, reason, detail, sender string) *types.Reject {
+	now := time.Now().UTC().Format(timeLayout)
+	r := &types.Reject{Email: strings.TrimSpace(email), Reason: reason, Detail: detail, CreatedAt: now, LastEventAt: now, Sender: sender}
+	st.SaveReject(r)
+	return r
+}
+
+// RecordRejects records a reject event for every rejected result.
+func RecordRejects(st *store.Store, id string, results []types.SendResult) {
+	for _, r := range results {
+		if r.Status == "rejected" {
+			st.RecordEvent(id, types.MessageEvent{Event: "reject", TS: time.Now().Unix(), Email: r.Email}, nil)
+		}
+	}
+}
+
+// followUp schedules the bounce, spam complaint or open a simulation rule
+// produces after delivery.
+func followUp(st *store.Store, id, rcpt string, rule simulate.Rule) {
+	var fn func()
+	switch rule.Action {
+	case simulate.HardBounce, simulate.SoftBounce:
+		fn = func() { Bounce(st, id, rule.Bounce(rcpt)) }
+	case simulate.Spam:
+		fn = func() { complaint(st, id, rcpt) }
+	case simulate.Open:
+		fn = func() { open(st, id, rcpt) }
+	default:
+		return
+	}
+	time.AfterFunc(rule.Delay, fn)
+}
+
+// complaint records a spam report, which also puts the address on the
+// rejects list.
+func complaint(st *store.Store, id, rcpt string) {
+	rec, ok := st.GetMessage(id)
+	if !ok {
+		return
+	}
+	AddReject(st, rcpt, "spam", "", rec.From)
+	st.RecordEvent(id, types.MessageEvent{Event: "spam", TS: time.Now().Unix(), Email: rcpt}, nil)
+}
+
+func open(st *store.Store, id, rcpt string) {
+	e := types.Engagement{TS: time.Now().Unix(), IP: "127.0.0.1", UserAgent: "mandrill-dev simulator"}
+	st.RecordEvent(id, types.MessageEvent{Event: "open", TS: e.TS, Email: rcpt, IP: e.IP, UserAgent: e.UserAgent}, func(m *types.MessageRecord) {
+		m.Opens++
+		m.OpensDetail = append(m.OpensDetail, e)
+	})
+}
@@ -0,0 +1,122 @@
+package delivery
+
+import (
+	"sync"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/simulate"
+	"github.com/jerson/mandrillfordev/internal/store"
+)
+
+// Queue delivers jobs in the background with a fixed pool of workers and
+// takes back deferred recipients for retrying. Up to cfg.QueueSize jobs
+// wait for a worker; beyond that they overflow into a list a feeder moves
+// along as room frees up, so adding a job never blocks.
+type Queue struct {
+	cfg    config.Config
+	st     *store.Store
+	mailer *mailer.Mailer
+	router *routing.Router
+	rules  simulate.Rules
+	jobs   chan Job
+	wg     sync.WaitGroup
+	feeder sync.WaitGroup
+
+	mu       sync.Mutex
+	overflow []Job
+	more     *sync.Cond // signalled when overflow grows or the queue closes
+	closed   bool
+}
+
+// NewQueue returns a queue that sends through m to the upstreams rt picks,
+// with rules standing in for the SMTP server where they match. m must have
+// every upstream's transport open.
+func NewQueue(cfg config.Config, st *store.Store, m *mailer.Mailer, rt *routing.Router, rules simulate.Rules) *Queue {
+	q := &Queue{cfg: cfg, st: st, mailer: m, router: rt, rules: rules, jobs: make(chan Job, max(cfg.QueueSize, 0))}
+	q.more = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start launches the workers and the overflow feeder.
+func (q *Queue) Start() {
+	for i := 0; i < max(q.cfg.QueueWorkers, 1); i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				q.Deliver(job)
+			}
+		}()
+	}
+	q.feeder.Add(1)
+	go q.feed()
+}
+
+// feed moves overflowed jobs into the queue, oldest first, until the queue
+// is closed and the overflow is empty.
+func (q *Queue) feed() {
+	defer q.feeder.Done()
+	for {
+		q.mu.Lock()
+		for len(q.overflow) == 0 && !q.closed {
+			q.more.Wait()
+		}
+		if len(q.overflow) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		job := q.overflow[0]
+		q.overflow = q.overflow[1:]
+		q.mu.Unlock()
+		q.jobs <- job
+	}
+}
+
+// Stop stops taking jobs and waits for the queued and overflowed ones to
+// be delivered. Retries that come due afterwards are dropped.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	wasClosed := q.closed
+	q.closed = true
+	q.more.Broadcast()
+	q.mu.Unlock()
+	if wasClosed {
+		return
+	}
+	q.feeder.Wait()
+	close(q.jobs)
+	q.wg.Wait()
+}
+
+// Enqueue adds job to the queue, or to the overflow when the queue is full.
+// It doesn't wait for a worker.
+func (q *Queue) Enqueue(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if len(q.overflow) == 0 {
+		select {
+		case q.jobs <- job:
+			return
+		default:
+		}
+	}
+	q.overflow = append(q.overflow, job)
+	q.more.Signal()
+}
+
+// Rules are the configured simulation rules.
+func (q *Queue) Rules() simulate.Rules {
+	return q.rules
+}
+
+// Len is the number of jobs waiting for a worker.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs) + len(q.overflow)
+}
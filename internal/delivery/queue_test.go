@@ -0,0 +1,104 @@
+package delivery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// TestEnqueueOverflow fills a queue with no workers running: Enqueue must
+// not wait, and every job is delivered once workers start.
+func TestEnqueueOverflow(t *testing.T) {
+	cfg := config.Config{Transport: "null", QueueSize: 1, QueueWorkers: 2}
+	st := store.NewStore()
+	q := newQueue(t, cfg, st, nil)
+
+	const n = 5
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			id := fmt.Sprintf("m%d", i)
+			st.SaveMessage(&types.MessageRecord{ID: id, Status: "queued"})
+			q.Enqueue(Job{ID: id, Sender: "s@example.com", Rcpts: []string{"a@x.test"}, Raw: []byte("Subject: hi\r\n\r\nbody\r\n")})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Enqueue blocked on a full queue")
+	}
+	if q.Len() != n {
+		t.Errorf("Len() = %d, want %d", q.Len(), n)
+	}
+
+	q.Start()
+	q.Stop()
+	for i := 0; i < n; i++ {
+		if m, _ := st.GetMessage(fmt.Sprintf("m%d", i)); m.Status != "sent" {
+			t.Errorf("m%d: status %q, want sent", i, m.Status)
+		}
+	}
+	q.Enqueue(Job{ID: "late"})
+	if q.Len() != 0 {
+		t.Error("a stopped queue took a job")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := config.Config{RetryInitial: time.Second, RetryMaxInterval: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := backoff(cfg, i+1); got != w {
+			t.Errorf("backoff(attempt %d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+// TestDeliverRetry sends to an unreachable upstream: a new message is
+// deferred and queued again after the backoff, one older than RetryMaxAge
+// soft-bounces.
+func TestDeliverRetry(t *testing.T) {
+	cfg := config.Config{
+		Transport:        "smtp://127.0.0.1:1",
+		UpstreamTimeout:  2 * time.Second,
+		QueueSize:        1,
+		RetryInitial:     10 * time.Millisecond,
+		RetryMaxInterval: 10 * time.Millisecond,
+		RetryMaxAge:      time.Hour,
+	}
+	st := store.NewStore()
+	st.SaveMessage(&types.MessageRecord{ID: "new", Status: "queued"})
+	st.SaveMessage(&types.MessageRecord{ID: "old", Status: "queued"})
+	q := newQueue(t, cfg, st, nil)
+	job := Job{Sender: "s@example.com", Rcpts: []string{"a@x.test"}, Raw: []byte("Subject: hi\r\n\r\nbody\r\n")}
+
+	job.ID = "new"
+	if res := q.Deliver(job); len(res.Deferred) != 1 {
+		t.Fatalf("new: %+v, want a@x.test deferred", res)
+	}
+	if m, _ := st.GetMessage("new"); m.Status != "deferred" {
+		t.Errorf("new: status %q, want deferred", m.Status)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if q.Len() != 1 {
+		t.Error("deferred job was not queued for a retry")
+	}
+
+	job.ID, job.Since = "old", time.Now().Add(-2*time.Hour)
+	res := q.Deliver(job)
+	if len(res.Bounced) != 1 || res.Bounced[0].Hard {
+		t.Fatalf("old: %+v, want a@x.test soft-bounced", res)
+	}
+	m, _ := st.GetMessage("old")
+	if last := m.Events[len(m.Events)-1]; last.Event != "soft_bounce" {
+		t.Errorf("old: last event %q, want soft_bounce", last.Event)
+	}
+}
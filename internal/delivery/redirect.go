@@ -0,0 +1,115 @@
+package delivery
+
+import (
+	"bytes"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// redirect applies the staging catch-all, when REDIRECT_TO is set: the
+// original To, Cc and Bcc are kept on rec and in X-Original-* headers
+// added to raw, and the returned map gives the address each recipient is
+// delivered to.
+func redirect(cfg config.Config, rec *types.MessageRecord, rcpts []string, raw []byte) ([]byte, map[string]string) {
+	if cfg.RedirectTo == "" {
+		return raw, nil
+	}
+	r := &types.Redirect{Rcpts: map[string]string{}}
+	named := map[string]bool{}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		for _, h := range []struct {
+			name string
+			list *[]string
+		}{{"To", &r.To}, {"Cc", &r.Cc}, {"Bcc", &r.Bcc}} {
+			addrs, _ := msg.Header.AddressList(h.name)
+			for _, a := range addrs {
+				*h.list = append(*h.list, a.Address)
+				named[strings.ToLower(a.Address)] = true
+			}
+		}
+	}
+	for _, rcpt := range rcpts {
+		if !named[strings.ToLower(rcpt)] {
+			r.Bcc = append(r.Bcc, rcpt)
+		}
+		r.Rcpts[rcpt] = redirectAddress(cfg, rcpt)
+	}
+	rec.Redirect = r
+
+	var hdr bytes.Buffer
+	for _, h := range []struct {
+		name  string
+		addrs []string
+	}{{"X-Original-To", r.To}, {"X-Original-Cc", r.Cc}, {"X-Original-Bcc", r.Bcc}} {
+		if len(h.addrs) > 0 {
+			hdr.WriteString(h.name + ": " + strings.Join(h.addrs, ", ") + "\r\n")
+		}
+	}
+	// Keep Return-Path first, where delivery agents expect it.
+	at := 0
+	if bytes.HasPrefix(bytes.ToLower(raw), []byte("return-path:")) {
+		at = bytes.IndexByte(raw, '\n') + 1
+	}
+	out := append(append(append([]byte(nil), raw[:at]...), hdr.Bytes()...), raw[at:]...)
+	return out, r.Rcpts
+}
+
+// redirectAddress is where rcpt is delivered in redirect mode: itself if
+// its domain is allowlisted, otherwise the catch-all, plus-addressed as
+// catchall+user=domain@host with RedirectPlus.
+func redirectAddress(cfg config.Config, rcpt string) string {
+	_, domain, _ := strings.Cut(strings.ToLower(strings.TrimSpace(rcpt)), "@")
+	for _, d := range cfg.RedirectAllowDomains {
+		d = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(d), "*"), ".")
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return rcpt
+		}
+	}
+	at := strings.LastIndexByte(cfg.RedirectTo, '@')
+	if !cfg.RedirectPlus || at < 0 {
+		return cfg.RedirectTo
+	}
+	return cfg.RedirectTo[:at] + "+" + strings.ReplaceAll(strings.TrimSpace(rcpt), "@", "=") + cfg.RedirectTo[at:]
+}
+
+// redirected returns the addresses rcpts are delivered to, each once, and
+// the original recipients behind each address. Without a redirect both
+// are rcpts themselves.
+func (job Job) redirected(rcpts []string) (addrs []string, orig map[string][]string) {
+	if job.Redirect == nil {
+		return rcpts, nil
+	}
+	orig = map[string][]string{}
+	for _, rcpt := range rcpts {
+		addr, ok := job.Redirect[rcpt]
+		if !ok {
+			addr = rcpt
+		}
+		if _, seen := orig[addr]; !seen {
+			addrs = append(addrs, addr)
+		}
+		orig[addr] = append(orig[addr], rcpt)
+	}
+	return addrs, orig
+}
+
+// originalErrors rekeys RecipientErrors from delivered addresses to the
+// original recipients.
+func originalErrors(err error, orig map[string][]string) error {
+	var errs mailer.RecipientErrors
+	if orig == nil || !errors.As(err, &errs) {
+		return err
+	}
+	out := mailer.RecipientErrors{}
+	for addr, reply := range errs {
+		for _, rcpt := range orig[addr] {
+			out[rcpt] = reply
+		}
+	}
+	return out
+}
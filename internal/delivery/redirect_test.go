@@ -0,0 +1,125 @@
+package delivery
+
+import (
+	"bytes"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestRedirectAddress(t *testing.T) {
+	tests := []struct {
+		rcpt string
+		plus bool
+		want string
+	}{
+		{"jane@customer.com", false, "catchall@staging.test"},
+		{"jane@customer.com", true, "catchall+jane=customer.com@staging.test"},
+		{"dev@example.com", true, "dev@example.com"},
+		{"dev@eu.example.com", false, "dev@eu.example.com"},
+		{"dev@notexample.com", false, "catchall@staging.test"},
+		{"qa@corp.test", false, "qa@corp.test"},
+	}
+	for _, tt := range tests {
+		cfg := config.Config{RedirectTo: "catchall@staging.test", RedirectPlus: tt.plus, RedirectAllowDomains: []string{"example.com", "*.corp.test", "corp.test"}}
+		if got := redirectAddress(cfg, tt.rcpt); got != tt.want {
+			t.Errorf("redirectAddress(%q, plus=%v) = %q, want %q", tt.rcpt, tt.plus, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectHeaders(t *testing.T) {
+	cfg := config.Config{RedirectTo: "catchall@staging.test"}
+	raw := []byte("Return-Path: <b@example.com>\r\nTo: a@customer.com\r\nCc: c@customer.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	rec := &types.MessageRecord{}
+	out, rcpts := redirect(cfg, rec, []string{"a@customer.com", "c@customer.com", "hidden@customer.com"}, raw)
+	want := "Return-Path: <b@example.com>\r\n" +
+		"X-Original-To: a@customer.com\r\n" +
+		"X-Original-Cc: c@customer.com\r\n" +
+		"X-Original-Bcc: hidden@customer.com\r\n" +
+		"To: a@customer.com\r\nCc: c@customer.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	if string(out) != want {
+		t.Errorf("redirect() =\n%s\nwant\n%s", out, want)
+	}
+	if len(rcpts) != 3 || rcpts["hidden@customer.com"] != "catchall@staging.test" {
+		t.Errorf("rcpts = %v", rcpts)
+	}
+	if rec.Redirect == nil || !reflect.DeepEqual(rec.Redirect.Bcc, []string{"hidden@customer.com"}) {
+		t.Errorf("rec.Redirect = %+v", rec.Redirect)
+	}
+	if out, rcpts := redirect(config.Config{}, rec, []string{"a@customer.com"}, raw); !bytes.Equal(out, raw) || rcpts != nil {
+		t.Error("redirect changed the message with REDIRECT_TO unset")
+	}
+}
+
+func TestRedirected(t *testing.T) {
+	job := Job{Redirect: map[string]string{
+		"a@customer.com":  "catchall@staging.test",
+		"b@customer.com":  "catchall@staging.test",
+		"dev@example.com": "dev@example.com",
+	}}
+	addrs, orig := job.redirected([]string{"a@customer.com", "dev@example.com", "b@customer.com"})
+	if want := []string{"catchall@staging.test", "dev@example.com"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addrs = %v, want %v", addrs, want)
+	}
+	reply := &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+	err := originalErrors(mailer.RecipientErrors{"catchall@staging.test": reply}, orig)
+	var errs mailer.RecipientErrors
+	if !errors.As(err, &errs) || len(errs) != 2 || errs["a@customer.com"] != reply || errs["b@customer.com"] != reply {
+		t.Errorf("originalErrors() = %v, want the reply for a@ and b@customer.com", err)
+	}
+}
+
+// TestRedirectDelivery sends a message with To, Cc and Bcc recipients in
+// redirect mode and checks that the transport is only given the catch-all
+// and allowlisted addresses, and that a sendmail -t transport, which reads
+// recipients from the headers, is refused.
+func TestRedirectDelivery(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{
+		Transport:            "eml:" + dir,
+		RedirectTo:           "catchall@staging.test",
+		RedirectAllowDomains: []string{"example.com"},
+	}
+	st := store.NewStore()
+	q := newQueue(t, cfg, st, nil)
+	rec := &types.MessageRecord{ID: "m1", Status: "queued", From: "shop@example.com",
+		To: []string{"a@customer.com", "c@customer.com", "hidden@customer.com", "dev@example.com"},
+		Message: types.MandrillMessage{FromEmail: "shop@example.com", Subject: "hi", Text: "body", To: []types.MandrillRecipient{
+			{Email: "a@customer.com"}, {Email: "c@customer.com", Type: "cc"}, {Email: "hidden@customer.com", Type: "bcc"}, {Email: "dev@example.com"},
+		}}}
+	job := q.NewJob(rec)
+	st.SaveMessage(rec)
+	if res := q.Deliver(job); len(res.Sent) != 4 {
+		t.Fatalf("Deliver() = %+v, want all 4 sent", res)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "m1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, _, _ := strings.Cut(string(b), "\r\n")
+	if want := "X-Envelope-To: catchall@staging.test, dev@example.com"; envelope != want {
+		t.Errorf("envelope = %q, want %q", envelope, want)
+	}
+
+	sendmail := filepath.Join(t.TempDir(), "sendmail")
+	if err := os.WriteFile(sendmail, []byte("#!/bin/sh\ncat >/dev/null\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailer.New(config.Config{Transport: "sendmail:" + sendmail + " -t", RedirectTo: "catchall@staging.test"}, nil); err == nil {
+		t.Error("sendmail -t accepted in redirect mode")
+	}
+	if _, err := mailer.New(config.Config{Transport: "sendmail:" + sendmail + " -i", RedirectTo: "catchall@staging.test"}, nil); err != nil {
+		t.Errorf("sendmail without -t refused in redirect mode: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Signing algorithms.
+const (
+	RSASHA256     = "rsa-sha256"
+	Ed25519SHA256 = "ed25519-sha256"
+)
+
+// Key is a domain's DKIM signing key.
+type Key struct {
+	Domain    string
+	Selector  string
+	Algorithm string
+	signer    crypto.Signer
+}
+
+// RecordName is the DNS name of the key's TXT record.
+func (k *Key) RecordName() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// TXTRecord is the public key record to publish at RecordName.
+func (k *Key) TXTRecord() string {
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+}
+
+// Keyring holds per-domain keys. Keys are read from <dir>/<domain>.pem
+// (PKCS#1 or PKCS#8, RSA or Ed25519); missing keys are generated and, when
+// a directory is configured, written there so they survive restarts.
+type Keyring struct {
+	dir       string
+	selector  string
+	algorithm string
+
+	mu   sync.Mutex
+	keys map[string]*Key
+}
+
+func NewKeyring(dir, selector, algorithm string) *Keyring {
+	return &Keyring{dir: dir, selector: selector, algorithm: algorithm, keys: make(map[string]*Key)}
+}
+
+// Key returns the key for domain, loading or generating it on first use.
+func (r *Keyring) Key(domain string) (*Key, error) {
+	domain = normalizeDomain(domain)
+	if domain == "" || strings.ContainsAny(domain, `/\`) {
+		return nil, fmt.Errorf("dkim: invalid domain %q", domain)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if k, ok := r.keys[domain]; ok {
+		return k, nil
+	}
+	signer, err := r.load(domain)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		if signer, err = r.generate(domain); err != nil {
+			return nil, err
+		}
+	}
+	return r.add(domain, signer), nil
+}
+
+// Lookup returns the key for domain if it has been loaded or generated,
+// without creating one.
+func (r *Keyring) Lookup(domain string) (*Key, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[normalizeDomain(domain)]
+	return k, ok
+}
+
+// LoadAll reads every <domain>.pem in the keyring's directory, so keys
+// are listed before they are first used.
+func (r *Keyring) LoadAll() error {
+	if r.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+	if err != nil {
+		return fmt.Errorf("dkim: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range paths {
+		domain := normalizeDomain(strings.TrimSuffix(filepath.Base(p), ".pem"))
+		if _, ok := r.keys[domain]; ok || domain == "" {
+			continue
+		}
+		signer, err := r.load(domain)
+		if err != nil {
+			return err
+		}
+		r.add(domain, signer)
+	}
+	return nil
+}
+
+// add stores signer as domain's key; r.mu is held.
+func (r *Keyring) add(domain string, signer crypto.Signer) *Key {
+	k := &Key{Domain: domain, Selector: r.selector, Algorithm: RSASHA256, signer: signer}
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		k.Algorithm = Ed25519SHA256
+	}
+	r.keys[domain] = k
+	return k
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// List returns the keys loaded from the directory or created so far, by
+// domain.
+func (r *Keyring) List() []*Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*Key, 0, len(r.keys))
+	for _, k := range r.keys {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	return out
+}
+
+func (r *Keyring) path(domain string) string {
+	return filepath.Join(r.dir, domain+".pem")
+}
+
+func (r *Keyring) load(domain string) (crypto.Signer, error) {
+	if r.dir == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(r.path(domain))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("dkim: %s: no PEM data", r.path(domain))
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %s: %w", r.path(domain), err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("dkim: %s: unsupported key type %T", r.path(domain), key)
+}
+
+func (r *Keyring) generate(domain string) (crypto.Signer, error) {
+	var signer crypto.Signer
+	var err error
+	if r.algorithm == Ed25519SHA256 || r.algorithm == "ed25519" {
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: generate key for %s: %w", domain, err)
+	}
+	if r.dir == "" {
+		return signer, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	if err := os.MkdirAll(r.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(r.path(domain), data, 0o600); err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	return signer, nil
+}
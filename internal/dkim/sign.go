@@ -0,0 +1,153 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// signedHeaders are signed when present, in this order.
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "List-Unsubscribe",
+}
+
+// Sign prepends a DKIM-Signature header to raw using relaxed/relaxed
+// canonicalization (RFC 6376, RFC 8463 for Ed25519). Line endings are
+// normalized to CRLF first so the signature survives SMTP transfer.
+func Sign(raw []byte, k *Key) ([]byte, error) {
+	raw = normalizeCRLF(raw)
+	head, body, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !ok {
+		head, body = bytes.TrimSuffix(raw, []byte("\r\n")), nil
+	}
+	fields := parseHeaders(string(head))
+
+	bh := sha256.Sum256(canonicalBody(body))
+	var names []string
+	h := sha256.New()
+	for _, name := range signedHeaders {
+		if v, ok := lastField(fields, name); ok {
+			names = append(names, strings.ToLower(name))
+			h.Write([]byte(canonicalHeader(name, v) + "\r\n"))
+		}
+	}
+	sig := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		k.Algorithm, k.Domain, k.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+	h.Write([]byte(canonicalHeader("DKIM-Signature", sig)))
+	digest := h.Sum(nil)
+
+	var b []byte
+	var err error
+	if key, ok := k.signer.(ed25519.PrivateKey); ok {
+		b = ed25519.Sign(key, digest)
+	} else {
+		b, err = k.signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: sign: %w", err)
+	}
+	header := "DKIM-Signature: " + fold(sig+base64.StdEncoding.EncodeToString(b)) + "\r\n"
+	return append([]byte(header), raw...), nil
+}
+
+type field struct{ name, value string }
+
+// parseHeaders splits a header block into fields, keeping folded values
+// as they appear.
+func parseHeaders(head string) []field {
+	var out []field
+	for _, line := range strings.Split(head, "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(out) > 0 {
+			out[len(out)-1].value += "\r\n" + line
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			out = append(out, field{name, value})
+		}
+	}
+	return out
+}
+
+// lastField returns the bottom-most instance of name, which is the one a
+// verifier picks first.
+func lastField(fields []field, name string) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(strings.TrimSpace(fields[i].name), name) {
+			return fields[i].value, true
+		}
+	}
+	return "", false
+}
+
+// canonicalHeader applies relaxed header canonicalization.
+func canonicalHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(value))
+}
+
+// canonicalBody applies relaxed body canonicalization.
+func canonicalBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(l), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// fold wraps a long header value at tag boundaries.
+func fold(v string) string {
+	var b strings.Builder
+	n := len("DKIM-Signature: ")
+	for i, part := range strings.SplitAfter(v, "; ") {
+		if i > 0 && n+len(part) > 76 {
+			// Drop the space before the break; relaxed canonicalization
+			// turns the folding tab back into it.
+			trimmed := strings.TrimSuffix(b.String(), " ")
+			b.Reset()
+			b.WriteString(trimmed + "\r\n\t")
+			n = 1
+		}
+		b.WriteString(part)
+		n += len(part)
+	}
+	return b.String()
+}
+
+func normalizeCRLF(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,236 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const message = "From: Ann <ann@example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\tagain\r\n" +
+	"Date: Mon, 19 Oct 2026 13:41:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"X-Unsigned: yes\r\n" +
+	"\r\n" +
+	"Hi  Bob,\r\n" +
+	"\r\n" +
+	"bye\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestSignVerify(t *testing.T) {
+	keys := map[string]*Key{}
+	for _, alg := range []string{RSASHA256, Ed25519SHA256} {
+		k, err := NewKeyring("", "mdev", alg).Key("Example.com.")
+		if err != nil {
+			t.Fatalf("%s: Key: %v", alg, err)
+		}
+		if k.Algorithm != alg || k.Domain != "example.com" {
+			t.Fatalf("%s: got key %s for %s", alg, k.Algorithm, k.Domain)
+		}
+		keys[alg] = k
+	}
+	tests := []struct {
+		name    string
+		raw     string
+		tamper  func(signed string) string
+		wantErr string
+	}{
+		{name: "as signed", raw: message},
+		{name: "LF line endings", raw: strings.ReplaceAll(message, "\r\n", "\n")},
+		{
+			name:   "whitespace changes survive relaxed canonicalization",
+			raw:    message,
+			tamper: func(s string) string { return strings.Replace(s, "Hi  Bob,", "Hi   Bob, ", 1) + "\r\n" },
+		},
+		{
+			name:   "unsigned header changed",
+			raw:    message,
+			tamper: func(s string) string { return strings.Replace(s, "X-Unsigned: yes", "X-Unsigned: no", 1) },
+		},
+		{
+			name:    "body changed",
+			raw:     message,
+			tamper:  func(s string) string { return strings.Replace(s, "bye", "Bye", 1) },
+			wantErr: "body hash",
+		},
+		{
+			name:    "signed header changed",
+			raw:     message,
+			tamper:  func(s string) string { return strings.Replace(s, "Subject: Hello", "Subject: Hullo", 1) },
+			wantErr: "signature",
+		},
+		{
+			name:    "signed header added",
+			raw:     message,
+			tamper:  func(s string) string { return strings.Replace(s, "\r\n\r\n", "\r\nSubject: Other\r\n\r\n", 1) },
+			wantErr: "signature",
+		},
+	}
+	for alg, k := range keys {
+		for _, tt := range tests {
+			t.Run(alg+"/"+tt.name, func(t *testing.T) {
+				signed, err := Sign([]byte(tt.raw), k)
+				if err != nil {
+					t.Fatalf("Sign: %v", err)
+				}
+				s := string(signed)
+				if tt.tamper != nil {
+					s = tt.tamper(s)
+				}
+				err = verify(s, k.TXTRecord())
+				switch {
+				case tt.wantErr == "" && err != nil:
+					t.Errorf("verify: %v\n%s", err, s)
+				case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+					t.Errorf("verify = %v, want %s error", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	dir := t.TempDir()
+	k, err := NewKeyring(dir, "mdev", RSASHA256).Key("example.com")
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com.pem")); err != nil {
+		t.Fatalf("key not written: %v", err)
+	}
+	r := NewKeyring(dir, "mdev", RSASHA256)
+	if _, ok := r.Lookup("example.com"); ok {
+		t.Fatal("Lookup found a key before LoadAll")
+	}
+	if err := r.LoadAll(); err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	got, ok := r.Lookup("EXAMPLE.com")
+	if !ok || got.TXTRecord() != k.TXTRecord() {
+		t.Fatalf("Lookup after LoadAll = %v, %v; want the stored key", got, ok)
+	}
+	if _, ok := r.Lookup("example.org"); ok {
+		t.Error("Lookup created a key for example.org")
+	}
+	if n := len(r.List()); n != 1 {
+		t.Errorf("List has %d keys, want 1", n)
+	}
+}
+
+var tagRe = regexp.MustCompile(`\s*([a-z]+)\s*=\s*([^;]*);?`)
+
+// verify checks the top DKIM-Signature of raw against the public key in
+// a TXT record, following RFC 6376 for relaxed/relaxed signatures.
+func verify(raw, txt string) error {
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+	var fields []string
+	for _, line := range strings.Split(head, "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	if !strings.HasPrefix(fields[0], "DKIM-Signature:") {
+		return errors.New("no DKIM-Signature")
+	}
+	sigField := fields[0]
+	tags := map[string]string{}
+	for _, m := range tagRe.FindAllStringSubmatch(relaxValue(strings.TrimPrefix(sigField, "DKIM-Signature:")), -1) {
+		tags[m[1]] = strings.ReplaceAll(strings.TrimSpace(m[2]), " ", "")
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected c=%s", tags["c"])
+	}
+
+	bh := sha256.Sum256([]byte(relaxBody(body)))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	// h= names the fields to hash, each taken from the bottom up.
+	used := map[string]int{}
+	h := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		seen := 0
+		for i := len(fields) - 1; i > 0; i-- {
+			n, v, _ := strings.Cut(fields[i], ":")
+			if !strings.EqualFold(strings.TrimSpace(n), name) {
+				continue
+			}
+			if seen == used[name] {
+				h.Write([]byte(relaxHeader(n, v) + "\r\n"))
+				break
+			}
+			seen++
+		}
+		used[name]++
+	}
+	n, v, _ := strings.Cut(sigField, ":")
+	unsigned := regexp.MustCompile(`(b\s*=)[^;]*$`).ReplaceAllString(v, "$1")
+	h.Write([]byte(relaxHeader(n, unsigned)))
+	digest := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("b=: %v", err)
+	}
+	p := txt[strings.Index(txt, "p=")+2:]
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return fmt.Errorf("p=: %v", err)
+	}
+	switch tags["a"] {
+	case Ed25519SHA256:
+		if !ed25519.Verify(ed25519.PublicKey(der), digest, sig) {
+			return errors.New("bad signature")
+		}
+	case RSASHA256:
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest, sig); err != nil {
+			return fmt.Errorf("bad signature: %v", err)
+		}
+	default:
+		return fmt.Errorf("unexpected a=%s", tags["a"])
+	}
+	return nil
+}
+
+var wspRe = regexp.MustCompile(`[ \t]+`)
+
+func relaxValue(v string) string {
+	return strings.TrimSpace(wspRe.ReplaceAllString(strings.ReplaceAll(v, "\r\n", ""), " "))
+}
+
+func relaxHeader(name, value string) string {
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + relaxValue(value)
+}
+
+func relaxBody(body string) string {
+	var b bytes.Buffer
+	for _, line := range strings.Split(body, "\r\n") {
+		b.WriteString(strings.TrimRight(wspRe.ReplaceAllString(line, " "), " ") + "\r\n")
+	}
+	out := strings.TrimRight(b.String(), "\r\n")
+	if out == "" {
+		return ""
+	}
+	return out + "\r\n"
+}
@@ -0,0 +1,56 @@
+package htmlconv
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	linkRe      = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+|\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+\b`)
+	paragraphRe = regexp.MustCompile(`\n[ \t]*\n\s*`)
+)
+
+// FromText renders plain text as HTML: the text is escaped, URLs and email
+// addresses become links, blank-line separated paragraphs are wrapped in
+// <p> and remaining line breaks become <br>.
+func FromText(text string) string {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if text == "" {
+		return ""
+	}
+	var b strings.Builder
+	for i, p := range paragraphRe.Split(text, -1) {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString("<p>")
+		b.WriteString(strings.ReplaceAll(autolink(p), "\n", "<br>\n"))
+		b.WriteString("</p>")
+	}
+	return b.String()
+}
+
+// autolink escapes s and wraps URLs and email addresses in anchors.
+func autolink(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range linkRe.FindAllStringIndex(s, -1) {
+		start, end := m[0], m[1]
+		// Sentence punctuation after a link is not part of it.
+		end = start + len(strings.TrimRight(s[start:end], ".,;:!?)'"))
+		b.WriteString(html.EscapeString(s[last:start]))
+		target := s[start:end]
+		href := target
+		switch {
+		case strings.Contains(target, "@") && !strings.Contains(target, "/"):
+			href = "mailto:" + target
+		case strings.HasPrefix(strings.ToLower(target), "www."):
+			href = "http://" + target
+		}
+		b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(target) + `</a>`)
+		last = end
+	}
+	b.WriteString(html.EscapeString(s[last:]))
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package htmlconv
+
+import "testing"
+
+func TestFromText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "paragraphs and links",
+			text: "Hello Ann,\n\nSee https://x.test/a?b=1&c=2.\nMail me@example.com or www.x.test!",
+			want: "<p>Hello Ann,</p>\n<p>See <a href=\"https://x.test/a?b=1&amp;c=2\">https://x.test/a?b=1&amp;c=2</a>.<br>\nMail <a href=\"mailto:me@example.com\">me@example.com</a> or <a href=\"http://www.x.test\">www.x.test</a>!</p>",
+		},
+		{
+			name: "escaped",
+			text: "a <b> & c",
+			want: "<p>a &lt;b&gt; &amp; c</p>",
+		},
+		{
+			name: "blank",
+			text: "  \r\n ",
+			want: "",
+		},
+		{
+			name: "CRLF and blank line runs",
+			text: "one\r\ntwo\r\n\r\n\r\nthree",
+			want: "<p>one<br>\ntwo</p>\n<p>three</p>",
+		},
+		{
+			name: "closing parenthesis outside link",
+			text: "(see https://x.test/path)",
+			want: "<p>(see <a href=\"https://x.test/path\">https://x.test/path</a>)</p>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromText(tt.text); got != tt.want {
+				t.Errorf("FromText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRoundTrip checks that text survives conversion to HTML and back.
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		"Hello Ann,\n\nYour order shipped.",
+		"Track it at https://x.test/t/1 or write to help@example.com.",
+		"a < b & c > d",
+		"one\ntwo\n\nthree",
+	}
+	for _, text := range tests {
+		if got := ToText(FromText(text)); got != text {
+			t.Errorf("ToText(FromText(%q)) = %q", text, got)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package htmlconv
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	hrefAttrRe = regexp.MustCompile(`(?is)\shref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	blankRunRe = regexp.MustCompile(`\n{3,}`)
+)
+
+// skipped elements have their content dropped entirely.
+var skipped = map[string]bool{"script": true, "style": true, "head": true, "title": true, "noscript": true, "template": true}
+
+// paragraphs are separated from surrounding text by a blank line; blocks by
+// a line break.
+var (
+	paragraphs = map[string]bool{"p": true, "blockquote": true, "pre": true, "table": true, "ul": true, "ol": true, "dl": true}
+	blocks     = map[string]bool{"div": true, "tr": true, "section": true, "article": true, "header": true, "footer": true, "nav": true, "aside": true, "main": true, "center": true, "address": true, "form": true, "dt": true, "dd": true, "figure": true, "figcaption": true, "tbody": true, "thead": true, "tfoot": true, "body": true}
+)
+
+// ToText renders an HTML document as readable plain text: headings are
+// underlined, links become "text (url)", list items are bulleted or
+// numbered, table rows are flattened onto one line each, and scripts and
+// styles are dropped.
+func ToText(doc string) string {
+	c := &textWriter{}
+	for i := 0; i < len(doc); {
+		if doc[i] != '<' {
+			j := strings.IndexByte(doc[i:], '<')
+			if j < 0 {
+				j = len(doc) - i
+			}
+			c.text(html.UnescapeString(doc[i : i+j]))
+			i += j
+			continue
+		}
+		switch {
+		case strings.HasPrefix(doc[i:], "<!--"):
+			i = skipPast(doc, i, "-->")
+		case strings.HasPrefix(doc[i:], "<!") || strings.HasPrefix(doc[i:], "<?"):
+			i = skipPast(doc, i, ">")
+		case !startsTag(doc, i):
+			c.text("<")
+			i++
+		default:
+			end := tagEnd(doc, i)
+			tag := doc[i:end]
+			name, closing := tagName(tag)
+			i = end
+			if !closing && skipped[name] && !strings.HasSuffix(tag, "/>") {
+				i = skipElement(doc, i, name)
+				continue
+			}
+			c.tag(name, tag, closing)
+		}
+	}
+	return c.String()
+}
+
+type list struct {
+	ordered bool
+	n       int
+}
+
+type textWriter struct {
+	buf     strings.Builder
+	pending int    // line breaks owed before the next text
+	space   bool   // whitespace seen since the last word
+	prefix  string // list marker written before the next text
+	pre     int
+	lists   []list
+	links   []link
+	heading int // buffer offset where the open heading starts
+}
+
+type link struct {
+	href  string
+	start int
+}
+
+func (c *textWriter) newline(n int) {
+	if n > c.pending {
+		c.pending = n
+	}
+	c.space = false
+}
+
+// flush writes owed line breaks and any list marker before new text.
+func (c *textWriter) flush() {
+	if c.buf.Len() > 0 && c.pending > 0 {
+		s := c.buf.String()
+		have := len(s) - len(strings.TrimRight(s, "\n"))
+		for ; have < c.pending; have++ {
+			c.buf.WriteByte('\n')
+		}
+	}
+	c.pending = 0
+	if c.prefix != "" {
+		c.buf.WriteString(c.prefix)
+		c.prefix = ""
+		c.space = false
+	}
+}
+
+func (c *textWriter) atLineStart() bool {
+	s := c.buf.String()
+	return len(s) == 0 || s[len(s)-1] == '\n' || strings.HasSuffix(s, " ")
+}
+
+func (c *textWriter) text(s string) {
+	if c.pre > 0 {
+		if s != "" {
+			c.flush()
+			c.buf.WriteString(strings.ReplaceAll(s, "\r\n", "\n"))
+		}
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			c.space = true
+		}
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		c.space = true
+	}
+	c.flush()
+	for i, w := range words {
+		if (i > 0 || c.space) && !c.atLineStart() {
+			c.buf.WriteByte(' ')
+		}
+		c.buf.WriteString(w)
+	}
+	last := s[len(s)-1]
+	c.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+func (c *textWriter) tag(name, raw string, closing bool) {
+	switch {
+	case name == "br":
+		if c.buf.Len() > 0 {
+			c.flush()
+			c.buf.WriteByte('\n')
+		}
+		c.space = false
+	case name == "hr":
+		c.newline(2)
+		c.flush()
+		c.buf.WriteString(strings.Repeat("-", 40))
+		c.newline(2)
+	case len(name) == 2 && name[0] == 'h' && name[1] >= '1' && name[1] <= '6':
+		c.newline(2)
+		if !closing {
+			c.flush()
+			c.heading = c.buf.Len()
+			return
+		}
+		s := c.buf.String()
+		title := strings.TrimSpace(s[min(c.heading, len(s)):])
+		if title != "" {
+			if i := strings.LastIndexByte(title, '\n'); i >= 0 {
+				title = title[i+1:]
+			}
+			mark := "-"
+			if name == "h1" {
+				mark = "="
+			}
+			c.buf.WriteByte('\n')
+			c.buf.WriteString(strings.Repeat(mark, utf8.RuneCountInString(title)))
+		}
+	case name == "a":
+		if !closing {
+			href := ""
+			if m := hrefAttrRe.FindStringSubmatch(raw); m != nil {
+				href = html.UnescapeString(strings.Trim(m[1], `"'`))
+			}
+			c.links = append(c.links, link{href: strings.TrimSpace(href), start: c.buf.Len()})
+			return
+		}
+		if len(c.links) == 0 {
+			return
+		}
+		l := c.links[len(c.links)-1]
+		c.links = c.links[:len(c.links)-1]
+		s := c.buf.String()
+		label := strings.TrimSpace(s[min(l.start, len(s)):])
+		if shown := linkTarget(l.href); shown != "" && shown != label {
+			c.flush()
+			if label == "" {
+				if !c.atLineStart() {
+					c.buf.WriteByte(' ')
+				}
+				c.buf.WriteString(shown)
+			} else {
+				c.buf.WriteString(" (" + shown + ")")
+			}
+		}
+	case name == "ul" || name == "ol":
+		if !closing {
+			c.lists = append(c.lists, list{ordered: name == "ol"})
+		} else if len(c.lists) > 0 {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+		if len(c.lists) > 0 {
+			c.newline(1)
+		} else {
+			c.newline(2)
+		}
+	case name == "li":
+		c.newline(1)
+		if closing {
+			c.prefix = ""
+			return
+		}
+		depth := len(c.lists)
+		marker := "* "
+		if depth > 0 {
+			l := &c.lists[depth-1]
+			l.n++
+			if l.ordered {
+				marker = fmt.Sprintf("%d. ", l.n)
+			}
+			depth--
+		}
+		c.prefix = strings.Repeat("  ", depth) + marker
+	case name == "td" || name == "th":
+		if !closing {
+			c.space = true
+		}
+	case name == "pre":
+		if closing {
+			c.pre = max(c.pre-1, 0)
+		} else {
+			c.pre++
+		}
+		c.newline(2)
+	case paragraphs[name]:
+		c.newline(2)
+	case blocks[name]:
+		c.newline(1)
+	}
+}
+
+// linkTarget is the part of an href worth showing after the link text.
+func linkTarget(href string) string {
+	l := strings.ToLower(href)
+	switch {
+	case href == "", strings.HasPrefix(href, "#"), strings.HasPrefix(l, "javascript:"):
+		return ""
+	case strings.HasPrefix(l, "mailto:"):
+		addr := href[len("mailto:"):]
+		if i := strings.IndexByte(addr, '?'); i >= 0 {
+			addr = addr[:i]
+		}
+		return addr
+	}
+	return href
+}
+
+func (c *textWriter) String() string {
+	lines := strings.Split(c.buf.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	out := blankRunRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(out)
+}
+
+// tagEnd returns the index just past the tag starting at i, honouring quoted
+// attribute values.
+func tagEnd(doc string, i int) int {
+	var quote byte
+	for j := i + 1; j < len(doc); j++ {
+		switch ch := doc[j]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '>':
+			return j + 1
+		}
+	}
+	return len(doc)
+}
+
+// startsTag reports whether the '<' at i opens a tag rather than being text
+// like "a < b".
+func startsTag(doc string, i int) bool {
+	if i+1 >= len(doc) {
+		return false
+	}
+	ch := doc[i+1]
+	if ch == '/' && i+2 < len(doc) {
+		ch = doc[i+2]
+	}
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+// tagName returns the lowercased element name of a tag and whether it is a
+// closing tag.
+func tagName(tag string) (string, bool) {
+	s := tag[1:]
+	closing := strings.HasPrefix(s, "/")
+	if closing {
+		s = s[1:]
+	}
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || n > 0 && s[n] >= '0' && s[n] <= '9') {
+		n++
+	}
+	return strings.ToLower(s[:n]), closing
+}
+
+func skipPast(doc string, i int, marker string) int {
+	j := strings.Index(doc[i:], marker)
+	if j < 0 {
+		return len(doc)
+	}
+	return i + j + len(marker)
+}
+
+// skipElement jumps past the closing tag of name, starting after its open tag.
+func skipElement(doc string, i int, name string) int {
+	j := strings.Index(strings.ToLower(doc[i:]), "</"+name)
+	if j < 0 {
+		return len(doc)
+	}
+	return tagEnd(doc, i+j)
+}
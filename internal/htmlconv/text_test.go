@@ -0,0 +1,59 @@
+package htmlconv
+
+import "testing"
+
+func TestToText(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{
+			name: "heading, paragraphs and link",
+			doc:  `<h1>Welcome</h1><p>Hello <b>Ann</b>,</p><p>See <a href="https://x.test/a?b=1&amp;c=2">the docs</a>.</p>`,
+			want: "Welcome\n=======\n\nHello Ann,\n\nSee the docs (https://x.test/a?b=1&c=2).",
+		},
+		{
+			name: "link text is its url",
+			doc:  `<p>Visit <a href="https://x.test">https://x.test</a></p>`,
+			want: "Visit https://x.test",
+		},
+		{
+			name: "lists",
+			doc:  "<ul><li>one</li><li>two</li></ul><ol><li>a</li><li>b</li></ol>",
+			want: "* one\n* two\n\n1. a\n2. b",
+		},
+		{
+			name: "table rows",
+			doc:  "<table><tr><td>Item</td><td>$5</td></tr><tr><td>Tax</td><td>$1</td></tr></table>",
+			want: "Item $5\nTax $1",
+		},
+		{
+			name: "head, scripts and comments dropped",
+			doc:  "<html><head><title>T</title><style>p{}</style></head><body><script>x()</script><p>a &amp; b &lt;3</p><!-- c --></body></html>",
+			want: "a & b <3",
+		},
+		{
+			name: "br and pre",
+			doc:  "<p>line<br>break</p><pre>  keep\n    this</pre>",
+			want: "line\nbreak\n\n  keep\n    this",
+		},
+		{
+			name: "whitespace collapsed",
+			doc:  "a   b\n\n\n\nc",
+			want: "a b c",
+		},
+		{
+			name: "stray less-than",
+			doc:  "<p>1 < 2</p>",
+			want: "1 < 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToText(tt.doc); got != tt.want {
+				t.Errorf("ToText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package inbox
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// Handler serves the web inbox under /inbox/: the page itself, a JSON API
+// over the stored messages and a stream of change notifications.
+//
+//	GET /inbox/                          the page
+//	GET /inbox/api/messages              summaries, filtered by rcpt, tag, template, status and q
+//	GET /inbox/api/messages/<id>         one message, parsed
+//	GET /inbox/api/messages/<id>/html    its HTML body, for a sandboxed iframe
+//	GET /inbox/api/messages/<id>/raw     its source (?download=1 for a .eml file)
+//	GET /inbox/api/messages/<id>/parts/N a body part or attachment (?download=1)
+//	GET /inbox/events                    server-sent events, one per changed message
+type Handler struct {
+	cfg config.Config
+	st  *store.Store
+}
+
+func NewHandler(cfg config.Config, st *store.Store) *Handler {
+	return &Handler{cfg: cfg, st: st}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	p := strings.TrimPrefix(path.Clean(r.URL.Path), "/inbox")
+	switch {
+	case p == "" || p == "/":
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, "/inbox/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(indexHTML)
+	case p == "/events":
+		h.events(w, r)
+	case p == "/api/messages":
+		h.list(w, r)
+	case strings.HasPrefix(p, "/api/messages/"):
+		id, rest, _ := strings.Cut(strings.TrimPrefix(p, "/api/messages/"), "/")
+		rec, ok := h.st.GetMessage(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case rest == "":
+			h.detail(w, rec)
+		case rest == "html":
+			h.html(w, rec)
+		case rest == "raw":
+			h.raw(w, r, rec)
+		case strings.HasPrefix(rest, "parts/"):
+			n, err := strconv.Atoi(strings.TrimPrefix(rest, "parts/"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			h.part(w, r, rec, n)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// summary is a message as listed in the inbox.
+type summary struct {
+	ID          string     `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	Status      string     `json:"status"`
+	From        string     `json:"from"`
+	To          []string   `json:"to"`
+	Subject     string     `json:"subject"`
+	Tags        []string   `json:"tags"`
+	Template    string     `json:"template,omitempty"`
+	Attachments int        `json:"attachments"`
+	Opens       int        `json:"opens"`
+	Clicks      int        `json:"clicks"`
+}
+
+func newSummary(m *types.MessageRecord) summary {
+	return summary{
+		ID:          m.ID,
+		CreatedAt:   m.CreatedAt,
+		SentAt:      m.SentAt,
+		Status:      m.Status,
+		From:        m.From,
+		To:          m.To,
+		Subject:     m.Subject,
+		Tags:        m.Tags,
+		Template:    m.TemplateName,
+		Attachments: len(m.Message.Attachments),
+		Opens:       m.Opens,
+		Clicks:      m.Clicks,
+	}
+}
+
+// list returns the matching messages, newest first, with the tags,
+// templates and states of all messages to filter on.
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rcpt := strings.ToLower(strings.TrimSpace(q.Get("rcpt")))
+	text := strings.ToLower(strings.TrimSpace(q.Get("q")))
+	tag, tmpl, status := q.Get("tag"), q.Get("template"), q.Get("status")
+
+	all := h.st.Messages()
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.After(all[j].CreatedAt) })
+	out := []summary{}
+	tags, templates, states := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, m := range all {
+		for _, t := range m.Tags {
+			tags[t] = true
+		}
+		if m.TemplateName != "" {
+			templates[m.TemplateName] = true
+		}
+		states[m.Status] = true
+		switch {
+		case rcpt != "" && !anyContains(m.To, rcpt):
+		case tag != "" && !contains(m.Tags, tag):
+		case tmpl != "" && !strings.EqualFold(m.TemplateName, tmpl):
+		case status != "" && m.Status != status:
+		case text != "" && !anyContains([]string{m.Subject, m.From, m.ID}, text):
+		default:
+			out = append(out, newSummary(m))
+		}
+	}
+	writeJSON(w, map[string]any{
+		"messages":  out,
+		"total":     len(all),
+		"tags":      keys(tags),
+		"templates": keys(templates),
+		"states":    keys(states),
+	})
+}
+
+// entry is one step in a message's timeline: its creation, a delivery
+// attempt or an event such as an open.
+type entry struct {
+	TS     int64  `json:"ts"`
+	Kind   string `json:"kind"`
+	Event  string `json:"event"`
+	Email  string `json:"email,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func timeline(m *types.MessageRecord) []entry {
+	out := []entry{{TS: m.CreatedAt.Unix(), Kind: "state", Event: "created"}}
+	if m.ScheduledAt != nil {
+		out = append(out, entry{TS: m.CreatedAt.Unix(), Kind: "state", Event: "scheduled", Detail: "for " + m.ScheduledAt.UTC().Format(time.RFC3339)})
+	}
+	for _, e := range m.SMTPEvents {
+		out = append(out, entry{TS: e.TS, Kind: "smtp", Event: e.Type, Detail: e.Diag})
+	}
+	for _, e := range m.Events {
+		detail := e.URL
+		if detail == "" && e.UserAgent != "" {
+			detail = e.UserAgent
+		}
+		out = append(out, entry{TS: e.TS, Kind: "event", Event: e.Event, Email: e.Email, Detail: detail})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].TS < out[j].TS })
+	return out
+}
+
+// source is the message as delivered or, for one that hasn't been, as it
+// would be built.
+func (h *Handler) source(m *types.MessageRecord) []byte {
+	if len(m.Raw) > 0 {
+		return m.Raw
+	}
+	return mailer.Preview(h.cfg, m.Message, m.ID)
+}
+
+func (h *Handler) detail(w http.ResponseWriter, m *types.MessageRecord) {
+	p := parse(h.source(m))
+	text := ""
+	if p.text != nil {
+		text = string(p.text.data)
+	}
+	writeJSON(w, map[string]any{
+		"summary":            newSummary(m),
+		"delivered":          len(m.Raw) > 0,
+		"headers":            p.headers,
+		"has_html":           p.html != nil,
+		"text":               text,
+		"attachments":        p.attachments(),
+		"metadata":           m.Message.Metadata,
+		"recipient_metadata": m.Message.RecipientMetadata,
+		"subaccount":         m.Message.Subaccount,
+		"ip_pool":            m.IPPool,
+		"reject_reason":      m.RejectReason,
+		"bounce_description": m.BounceDescription,
+		"diag":               m.Diag,
+		"redirect":           m.Redirect,
+		"lint":               m.Lint,
+		"timeline":           timeline(m),
+	})
+}
+
+// html serves the HTML body with cid: images pointing at their parts.
+// The page shows it in a sandboxed iframe; the CSP sandbox keeps it
+// contained when opened directly too. Links open in a new tab.
+func (h *Handler) html(w http.ResponseWriter, m *types.MessageRecord) {
+	p := parse(h.source(m))
+	if p.html == nil {
+		http.Error(w, "no HTML body", http.StatusNotFound)
+		return
+	}
+	body := p.resolveCIDs(p.html.data)
+	base := []byte(`<base target="_blank">`)
+	if i := indexFold(body, "<head>"); i >= 0 {
+		body = append(append(append([]byte(nil), body[:i+len("<head>")]...), base...), body[i+len("<head>"):]...)
+	} else {
+		body = append(base, body...)
+	}
+	charset := p.html.charset
+	if charset == "" {
+		charset = "utf-8"
+	}
+	w.Header().Set("Content-Type", "text/html; charset="+charset)
+	w.Header().Set("Content-Security-Policy", "sandbox allow-popups allow-popups-to-escape-sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(body)
+}
+
+func (h *Handler) raw(w http.ResponseWriter, r *http.Request, m *types.MessageRecord) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.eml"`, m.ID))
+	}
+	_, _ = w.Write(h.source(m))
+}
+
+func (h *Handler) part(w http.ResponseWriter, r *http.Request, m *types.MessageRecord, n int) {
+	p := parse(h.source(m))
+	if n < 0 || n >= len(p.parts) {
+		http.NotFound(w, r)
+		return
+	}
+	pt := p.parts[n]
+	ctype := pt.ContentType
+	if pt.charset != "" {
+		ctype += "; charset=" + pt.charset
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("download") != "" {
+		name := pt.Filename
+		if name == "" {
+			name = "part-" + strconv.Itoa(n)
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	_, _ = w.Write(pt.data)
+}
+
+// events streams the id of every message that is saved or changes, so the
+// page can refresh what it shows.
+func (h *Handler) events(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	changed := make(chan string, 64)
+	cancel := h.st.Watch(func(id string) {
+		select {
+		case changed <- id:
+		default: // the client is behind; it refreshes on the next one
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = fmt.Fprint(w, "retry: 2000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case id := <-changed:
+			_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", id)
+		case <-ping.C:
+			_, _ = fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// anyContains reports whether any of list contains sub, which is lower
+// case.
+func anyContains(list []string, sub string) bool {
+	for _, v := range list {
+		if strings.Contains(strings.ToLower(v), sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func keys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// indexFold is bytes.Index ignoring ASCII case.
+func indexFold(s []byte, sub string) int {
+	return bytes.Index(bytes.ToLower(s), []byte(sub))
+}
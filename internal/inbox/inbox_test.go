@@ -0,0 +1,157 @@
+package inbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func newInbox(t *testing.T) (*store.Store, http.Handler) {
+	t.Helper()
+	st := store.NewStore()
+	now := time.Now()
+	st.SaveMessage(&types.MessageRecord{ID: "m1", CreatedAt: now.Add(-time.Minute), Status: "sent", From: "ann@example.com", To: []string{"bob@example.org"}, Subject: "Hello", Tags: []string{"welcome"}, Raw: []byte(alternative)})
+	st.SaveMessage(&types.MessageRecord{ID: "m2", CreatedAt: now, Status: "queued", From: "ann@example.com", To: []string{"cy@example.net"}, Subject: "Invoice", TemplateName: "invoice",
+		Message: types.MandrillMessage{FromEmail: "ann@example.com", Subject: "Invoice", Text: "Due", To: []types.MandrillRecipient{{Email: "cy@example.net"}}}})
+	return st, NewHandler(config.Config{}, st)
+}
+
+func get(h http.Handler, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+func TestList(t *testing.T) {
+	_, h := newInbox(t)
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"m2", "m1"}},
+		{"?rcpt=BOB", []string{"m1"}},
+		{"?tag=welcome", []string{"m1"}},
+		{"?template=INVOICE", []string{"m2"}},
+		{"?status=queued", []string{"m2"}},
+		{"?q=hello", []string{"m1"}},
+		{"?q=nothing", []string{}},
+	}
+	for _, tt := range tests {
+		var body struct {
+			Messages []summary
+			Total    int
+			Tags     []string
+		}
+		if err := json.NewDecoder(get(h, "/inbox/api/messages"+tt.query).Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		ids := []string{}
+		for _, m := range body.Messages {
+			ids = append(ids, m.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.ids, ",") || body.Total != 2 || len(body.Tags) != 1 {
+			t.Errorf("%q: ids %v, total %d, tags %v", tt.query, ids, body.Total, body.Tags)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	_, h := newInbox(t)
+	tests := []struct {
+		url         string
+		code        int
+		contentType string
+		disposition string
+		body        string
+	}{
+		{url: "/inbox", code: http.StatusFound},
+		{url: "/inbox/", code: 200, contentType: "text/html; charset=utf-8"},
+		{url: "/inbox/api/messages/m1/html", code: 200, contentType: "text/html; charset=iso-8859-1", body: `<base target="_blank"><p>Menu <img src="parts/2"></p>`},
+		{url: "/inbox/api/messages/m1/parts/3", code: 200, contentType: "text/plain", body: "soup"},
+		{url: "/inbox/api/messages/m1/parts/3?download=1", code: 200, contentType: "text/plain", disposition: "attachment; filename*=utf-8''men%C3%BA.txt", body: "soup"},
+		{url: "/inbox/api/messages/m1/parts/2?download=1", code: 200, contentType: "image/png", disposition: "attachment; filename=part-2", body: "\x89PNG"},
+		{url: "/inbox/api/messages/m1/parts/9", code: 404},
+		{url: "/inbox/api/messages/m1/raw?download=1", code: 200, contentType: "message/rfc822", disposition: `attachment; filename="m1.eml"`, body: alternative},
+		{url: "/inbox/api/messages/m2/html", code: 404},
+		{url: "/inbox/api/messages/nope", code: 404},
+	}
+	for _, tt := range tests {
+		w := get(h, tt.url)
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", tt.url, got, tt.contentType)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+			t.Errorf("%s: Content-Disposition %q, want %q", tt.url, got, tt.disposition)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.url, w.Body.String(), tt.body)
+		}
+	}
+
+	// A message that hasn't been delivered is shown as it would be built.
+	var detail struct {
+		Delivered   bool
+		Text        string
+		HasHTML     bool `json:"has_html"`
+		Attachments []part
+	}
+	if err := json.NewDecoder(get(h, "/inbox/api/messages/m2").Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Delivered || strings.TrimSpace(detail.Text) != "Due" || detail.HasHTML || len(detail.Attachments) != 0 {
+		t.Errorf("detail = %+v", detail)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	st, h := newInbox(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/inbox/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	r := bufio.NewReader(res.Body)
+	next := func() string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading events: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	if got := next(); got != "retry: 2000\n" {
+		t.Fatalf("first event %q", got)
+	}
+	st.SaveMessage(&types.MessageRecord{ID: "m3"})
+	st.UpdateMessage("m1", func(m *types.MessageRecord) { m.Opens++ })
+	for _, id := range []string{"m3", "m1"} {
+		if got, want := next(), "event: message\ndata: "+id+"\n"; got != want {
+			t.Errorf("event %q, want %q", got, want)
+		}
+	}
+}
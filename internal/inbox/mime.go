@@ -0,0 +1,169 @@
+package inbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// part is a leaf MIME part of a message.
+type part struct {
+	Index       int    `json:"index"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+	charset     string
+	attachment  bool
+	data        []byte
+}
+
+// header is one message header, decoded, in the order it appears.
+type header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// parsed is a message split into its headers, body parts and
+// attachments.
+type parsed struct {
+	headers []header
+	parts   []*part
+	html    *part
+	text    *part
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+// parse reads raw leniently: a broken part ends the walk, keeping what was
+// read so far.
+func parse(raw []byte) *parsed {
+	p := &parsed{}
+	head, body := raw, []byte(nil)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			head, body = raw[:i], raw[i+len(sep):]
+			break
+		}
+	}
+	mh := textproto.MIMEHeader{}
+	for _, line := range strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(p.headers) > 0 {
+			p.headers[len(p.headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		p.headers = append(p.headers, header{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	for i, h := range p.headers {
+		mh.Add(h.Name, h.Value)
+		if d, err := wordDecoder.DecodeHeader(h.Value); err == nil {
+			p.headers[i].Value = d
+		}
+	}
+	p.walk(mh, bytes.NewReader(body))
+	for _, pt := range p.parts {
+		switch {
+		case pt.attachment:
+		case pt.ContentType == "text/html" && p.html == nil:
+			p.html = pt
+		case pt.ContentType == "text/plain" && p.text == nil:
+			p.text = pt
+		}
+	}
+	return p
+}
+
+func (p *parsed) walk(h textproto.MIMEHeader, body io.Reader) {
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype, params = "text/plain", nil
+	}
+	if strings.HasPrefix(ctype, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			sub, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			p.walk(sub.Header, sub)
+		}
+	}
+	data, _ := io.ReadAll(body)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data)
+		if d, err := base64.StdEncoding.DecodeString(string(clean)); err == nil {
+			data = d
+		}
+	case "quoted-printable":
+		if d, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data))); err == nil {
+			data = d
+		}
+	}
+	disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if d, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = d
+	}
+	p.parts = append(p.parts, &part{
+		Index:       len(p.parts),
+		ContentType: ctype,
+		Filename:    name,
+		ContentID:   strings.Trim(strings.TrimSpace(h.Get("Content-ID")), "<>"),
+		Size:        len(data),
+		charset:     params["charset"],
+		attachment:  disp == "attachment" || name != "" || !strings.HasPrefix(ctype, "text/"),
+		data:        data,
+	})
+}
+
+// attachments returns the parts that aren't the message's HTML or text
+// body, inline images included.
+func (p *parsed) attachments() []*part {
+	out := []*part{}
+	for _, pt := range p.parts {
+		if pt != p.html && pt != p.text {
+			out = append(out, pt)
+		}
+	}
+	return out
+}
+
+var cidRe = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// resolveCIDs points cid: references in the HTML body at the parts they
+// name, served relative to the HTML itself.
+func (p *parsed) resolveCIDs(html []byte) []byte {
+	return cidRe.ReplaceAllFunc(html, func(ref []byte) []byte {
+		cid := string(ref[len("cid:"):])
+		if u, err := url.PathUnescape(cid); err == nil {
+			cid = u
+		}
+		for _, pt := range p.parts {
+			if pt.ContentID != "" && strings.EqualFold(pt.ContentID, cid) {
+				return []byte("parts/" + strconv.Itoa(pt.Index))
+			}
+		}
+		return ref
+	})
+}
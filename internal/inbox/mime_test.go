@@ -0,0 +1,108 @@
+package inbox
+
+import (
+	"strings"
+	"testing"
+)
+
+const alternative = "From: =?utf-8?q?Ann_L=C3=A9e?= <ann@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"\tagain\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+	"\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 menu=\r\n" +
+	" today\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"\r\n" +
+	"<p>Menu <img src=\"cid:logo@x\"></p>\r\n" +
+	"--alt--\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-ID: <logo@x>\r\n" +
+	"\r\n" +
+	"iVBO\r\nRw==\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain; name=\"=?utf-8?q?men=C3=BA.txt?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c291cA==\r\n" +
+	"--mixed--\r\n"
+
+func TestParse(t *testing.T) {
+	p := parse([]byte(alternative))
+
+	want := []header{
+		{"From", "Ann Lée <ann@example.com>"},
+		{"Subject", "Hello again"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/mixed; boundary="mixed"`},
+	}
+	if len(p.headers) != len(want) {
+		t.Fatalf("headers = %+v", p.headers)
+	}
+	for i, h := range want {
+		if p.headers[i] != h {
+			t.Errorf("header %d = %+v, want %+v", i, p.headers[i], h)
+		}
+	}
+
+	if len(p.parts) != 4 {
+		t.Fatalf("got %d parts, want 4", len(p.parts))
+	}
+	if p.text == nil || string(p.text.data) != "Café menu today" || p.text.charset != "utf-8" {
+		t.Errorf("text part = %+v", p.text)
+	}
+	if p.html == nil || !strings.HasPrefix(string(p.html.data), "<p>Menu") || p.html.charset != "iso-8859-1" {
+		t.Errorf("html part = %+v", p.html)
+	}
+
+	atts := p.attachments()
+	if len(atts) != 2 {
+		t.Fatalf("got %d attachments, want 2", len(atts))
+	}
+	if img := atts[0]; img.ContentType != "image/png" || img.ContentID != "logo@x" || img.Size != 4 || string(img.data) != "\x89PNG" {
+		t.Errorf("image = %+v", img)
+	}
+	if file := atts[1]; file.Filename != "menú.txt" || file.Index != 3 || string(file.data) != "soup" {
+		t.Errorf("attachment = %+v", file)
+	}
+
+	if got := string(p.resolveCIDs(p.html.data)); got != "<p>Menu <img src=\"parts/2\"></p>" {
+		t.Errorf("resolveCIDs = %q", got)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		parts int
+		text  string
+	}{
+		{"plain LF message", "Subject: hi\n\nbody\n", 1, "body\n"},
+		{"headers only", "Subject: hi", 1, ""},
+		{"bad content type", "Content-Type: ;;\r\n\r\nbody", 1, "body"},
+		{"truncated multipart", "Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nfirst\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>cut", 2, "first"},
+	}
+	for _, tt := range tests {
+		p := parse([]byte(tt.raw))
+		text := ""
+		if p.text != nil {
+			text = string(p.text.data)
+		}
+		if len(p.parts) != tt.parts || text != tt.text {
+			t.Errorf("%s: %d parts, text %q; want %d, %q", tt.name, len(p.parts), text, tt.parts, tt.text)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package inliner
+
+import (
+	"regexp"
+	"strings"
+)
+
+var commentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// rule is a stylesheet rule that can be moved into style attributes.
+type rule struct {
+	sel   selector
+	decls []declaration
+	order int
+}
+
+type declaration struct {
+	prop      string
+	value     string
+	important bool
+}
+
+// parseSheet splits css into inlinable rules and the source of everything
+// that has to stay in a <style> block (at-rules such as @media, and rules
+// whose selectors depend on state, like :hover).
+func parseSheet(css string, order *int) ([]rule, string) {
+	css = commentRe.ReplaceAllString(css, "")
+	var rules []rule
+	var keep strings.Builder
+	for i := 0; i < len(css); {
+		for i < len(css) && isSpace(css[i]) {
+			i++
+		}
+		if i >= len(css) {
+			break
+		}
+		if css[i] == '@' {
+			end := atRuleEnd(css, i)
+			keep.WriteString(strings.TrimSpace(css[i:end]))
+			keep.WriteByte('\n')
+			i = end
+			continue
+		}
+		open := strings.IndexByte(css[i:], '{')
+		if open < 0 {
+			break
+		}
+		close := strings.IndexByte(css[i+open:], '}')
+		if close < 0 {
+			close = len(css) - i - open
+		}
+		prelude := strings.TrimSpace(css[i : i+open])
+		body := css[i+open+1 : min(i+open+close, len(css))]
+		i = min(i+open+close+1, len(css))
+		decls := parseDeclarations(body)
+		if prelude == "" || len(decls) == 0 {
+			continue
+		}
+		var kept []string
+		for _, s := range splitSelectors(prelude) {
+			sel, ok := parseSelector(s)
+			if !ok {
+				kept = append(kept, s)
+				continue
+			}
+			*order++
+			rules = append(rules, rule{sel: sel, decls: decls, order: *order})
+		}
+		if len(kept) > 0 {
+			keep.WriteString(strings.Join(kept, ", ") + " {" + strings.TrimSpace(body) + "}\n")
+		}
+	}
+	return rules, strings.TrimSpace(keep.String())
+}
+
+// atRuleEnd returns the index after an at-rule starting at i: either its
+// terminating semicolon or its balanced block.
+func atRuleEnd(css string, i int) int {
+	depth := 0
+	for j := i; j < len(css); j++ {
+		switch css[j] {
+		case ';':
+			if depth == 0 {
+				return j + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth <= 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// parseDeclarations parses "a: b; c: d !important" into declarations.
+func parseDeclarations(body string) []declaration {
+	var out []declaration
+	for _, part := range splitOutside(body, ';') {
+		prop, value, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		value = strings.TrimSpace(value)
+		important := false
+		if i := strings.LastIndex(strings.ToLower(value), "!important"); i >= 0 && strings.TrimSpace(value[i+len("!important"):]) == "" {
+			important = true
+			value = strings.TrimSpace(value[:i])
+		}
+		if prop == "" || value == "" {
+			continue
+		}
+		out = append(out, declaration{prop: prop, value: value, important: important})
+	}
+	return out
+}
+
+func splitSelectors(prelude string) []string {
+	var out []string
+	for _, s := range splitOutside(prelude, ',') {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// splitOutside splits s on sep, ignoring separators inside quotes,
+// parentheses and brackets (url(data:...;base64,...), [a="x,y"]).
+func splitOutside(s string, sep byte) []string {
+	var out []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == sep && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,307 @@
+package inliner
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	attrRe      = regexp.MustCompile(`([^\s"'=<>/]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+	styleAttrRe = regexp.MustCompile(`(?is)(\sstyle\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+	mediaAttrRe = regexp.MustCompile(`(?is)\smedia\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// rawText elements contain text that must not be parsed as markup.
+var rawText = map[string]bool{"script": true, "style": true, "textarea": true, "title": true}
+
+type node struct {
+	name     string
+	attrs    map[string]string
+	parent   *node
+	children []*node
+	index    int // position among parent.children
+	start    int // offsets of the start tag in the source
+	end      int
+}
+
+func (n *node) attr(name string) string { return n.attrs[name] }
+
+func (n *node) prevSibling() *node {
+	if n.parent == nil || n.index == 0 {
+		return nil
+	}
+	return n.parent.children[n.index-1]
+}
+
+func (n *node) nextSibling() *node {
+	if n.parent == nil || n.index+1 >= len(n.parent.children) {
+		return nil
+	}
+	return n.parent.children[n.index+1]
+}
+
+// styleBlock is a <style> element: its full extent and its CSS text.
+type styleBlock struct {
+	start, end       int
+	cssStart, cssEnd int
+	screen           bool // applies to screen rendering, so it can be inlined
+}
+
+type edit struct {
+	start, end int
+	text       string
+}
+
+// Inline moves rules from <style> blocks into style attributes, honouring
+// selector specificity, source order, !important and existing inline
+// styles. Rules that can't be inlined (media queries and other at-rules,
+// :hover and friends) stay behind in their <style> block; blocks left
+// empty are removed.
+func Inline(doc string) string {
+	root, styles := parse(doc)
+	var rules []rule
+	var edits []edit
+	order := 0
+	for _, sb := range styles {
+		if !sb.screen {
+			continue
+		}
+		r, keep := parseSheet(doc[sb.cssStart:sb.cssEnd], &order)
+		rules = append(rules, r...)
+		if keep == "" {
+			edits = append(edits, edit{sb.start, sb.end, ""})
+		} else {
+			edits = append(edits, edit{sb.cssStart, sb.cssEnd, "\n" + keep + "\n"})
+		}
+	}
+	if len(edits) == 0 {
+		return doc
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].sel.spec != rules[j].sel.spec {
+			return specLess(rules[i].sel.spec, rules[j].sel.spec)
+		}
+		return rules[i].order < rules[j].order
+	})
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, c := range n.children {
+			if c.name == "head" || c.name == "style" || c.name == "script" {
+				continue
+			}
+			if style, ok := cascade(c, rules); ok {
+				edits = append(edits, edit{c.start, c.end, withStyle(doc[c.start:c.end], style)})
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		doc = doc[:e.start] + e.text + doc[e.end:]
+	}
+	return doc
+}
+
+// cascade computes the style attribute for n. Rules arrive sorted from
+// lowest to highest precedence; important declarations beat normal ones
+// and the element's own style attribute beats the stylesheet.
+func cascade(n *node, rules []rule) (string, bool) {
+	type winner struct {
+		decl   declaration
+		inline bool
+	}
+	var props []string
+	won := map[string]winner{}
+	set := func(d declaration, inline bool) {
+		cur, ok := won[d.prop]
+		if !ok {
+			props = append(props, d.prop)
+		} else if cur.decl.important && !d.important {
+			return
+		}
+		if ok && cur.inline && !inline && !d.important {
+			return
+		}
+		won[d.prop] = winner{d, inline}
+	}
+	matched := false
+	for _, r := range rules {
+		if r.sel.matches(n) {
+			matched = true
+			for _, d := range r.decls {
+				set(d, false)
+			}
+		}
+	}
+	if !matched {
+		return "", false
+	}
+	if s, ok := n.attrs["style"]; ok {
+		for _, d := range parseDeclarations(s) {
+			set(d, true)
+		}
+	}
+	parts := make([]string, 0, len(props))
+	for _, p := range props {
+		parts = append(parts, p+": "+won[p].decl.value)
+	}
+	return strings.Join(parts, "; ") + ";", true
+}
+
+// withStyle sets the style attribute of a start tag.
+func withStyle(tag, style string) string {
+	quoted := `"` + strings.ReplaceAll(strings.ReplaceAll(style, "&", "&amp;"), `"`, "&quot;") + `"`
+	if loc := styleAttrRe.FindStringSubmatchIndex(tag); loc != nil {
+		return tag[:loc[4]] + quoted + tag[loc[5]:]
+	}
+	end := len(tag) - 1
+	if strings.HasSuffix(tag, "/>") {
+		end--
+		for end > 0 && isSpace(tag[end-1]) {
+			end--
+		}
+	}
+	return tag[:end] + " style=" + quoted + tag[end:]
+}
+
+func specLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// parse builds a lenient element tree of doc and collects its <style> blocks.
+func parse(doc string) (*node, []styleBlock) {
+	root := &node{}
+	stack := []*node{root}
+	var styles []styleBlock
+	for i := 0; i < len(doc); {
+		j := strings.IndexByte(doc[i:], '<')
+		if j < 0 {
+			break
+		}
+		i += j
+		switch {
+		case strings.HasPrefix(doc[i:], "<!--"):
+			i = skipPast(doc, i, "-->")
+			continue
+		case strings.HasPrefix(doc[i:], "<!") || strings.HasPrefix(doc[i:], "<?"):
+			i = skipPast(doc, i, ">")
+			continue
+		case !startsTag(doc, i):
+			i++
+			continue
+		}
+		end := tagEnd(doc, i)
+		tag := doc[i:end]
+		name, closing := tagName(tag)
+		if closing {
+			for k := len(stack) - 1; k > 0; k-- {
+				if stack[k].name == name {
+					stack = stack[:k]
+					break
+				}
+			}
+			i = end
+			continue
+		}
+		parent := stack[len(stack)-1]
+		n := &node{name: name, attrs: parseAttrs(tag, name), parent: parent, index: len(parent.children), start: i, end: end}
+		parent.children = append(parent.children, n)
+		i = end
+		if rawText[name] {
+			closeAt := strings.Index(strings.ToLower(doc[i:]), "</"+name)
+			if closeAt < 0 {
+				closeAt = len(doc) - i
+			}
+			if name == "style" {
+				media := ""
+				if m := mediaAttrRe.FindStringSubmatch(tag); m != nil {
+					media = strings.ToLower(strings.Trim(m[1], `"'`))
+				}
+				styles = append(styles, styleBlock{
+					start: n.start, end: tagEnd(doc, i+closeAt),
+					cssStart: i, cssEnd: i + closeAt,
+					screen: media == "" || media == "all" || media == "screen",
+				})
+			}
+			i = tagEnd(doc, i+closeAt)
+			continue
+		}
+		if !voidElements[name] && !strings.HasSuffix(tag, "/>") {
+			stack = append(stack, n)
+		}
+	}
+	return root, styles
+}
+
+func parseAttrs(tag, name string) map[string]string {
+	attrs := map[string]string{}
+	body := strings.TrimSuffix(strings.TrimSuffix(tag, ">"), "/")
+	body = body[min(1+len(name), len(body)):]
+	for _, m := range attrRe.FindAllStringSubmatch(body, -1) {
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(strings.Trim(m[2], `"'`))
+	}
+	return attrs
+}
+
+func tagEnd(doc string, i int) int {
+	var quote byte
+	for j := i + 1; j < len(doc); j++ {
+		switch ch := doc[j]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '>':
+			return j + 1
+		}
+	}
+	return len(doc)
+}
+
+func tagName(tag string) (string, bool) {
+	s := tag[1:]
+	closing := strings.HasPrefix(s, "/")
+	if closing {
+		s = s[1:]
+	}
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || n > 0 && (s[n] >= '0' && s[n] <= '9' || s[n] == '-' || s[n] == ':')) {
+		n++
+	}
+	return strings.ToLower(s[:n]), closing
+}
+
+func startsTag(doc string, i int) bool {
+	if i+1 >= len(doc) {
+		return false
+	}
+	ch := doc[i+1]
+	if ch == '/' && i+2 < len(doc) {
+		ch = doc[i+2]
+	}
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+func skipPast(doc string, i int, marker string) int {
+	j := strings.Index(doc[i:], marker)
+	if j < 0 {
+		return len(doc)
+	}
+	return i + j + len(marker)
+}
@@ -0,0 +1,69 @@
+package inliner
+
+import "testing"
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{
+			name: "id beats class beats type",
+			doc:  `<style>p{color:red}.a{color:blue}#b{color:green}</style><p class="a" id="b">x</p>`,
+			want: `<p class="a" id="b" style="color: green;">x</p>`,
+		},
+		{
+			name: "specificity beats source order",
+			doc:  `<style>#b{color:green}.a{color:blue}p{color:red}</style><p class="a" id="b">x</p>`,
+			want: `<p class="a" id="b" style="color: green;">x</p>`,
+		},
+		{
+			name: "later rule wins at equal specificity",
+			doc:  `<style>.a{color:blue}.b{color:red}</style><p class="a b">x</p>`,
+			want: `<p class="a b" style="color: red;">x</p>`,
+		},
+		{
+			name: "important beats specificity",
+			doc:  `<style>p{color:red !important}#b{color:green}</style><p id="b">x</p>`,
+			want: `<p id="b" style="color: red;">x</p>`,
+		},
+		{
+			name: "inline style beats the stylesheet",
+			doc:  `<style>p{color:red;margin:0}</style><p style="color:black">x</p>`,
+			want: `<p style="color: black; margin: 0;">x</p>`,
+		},
+		{
+			name: "important beats inline style",
+			doc:  `<style>p{color:red !important}</style><p style="color:black">x</p>`,
+			want: `<p style="color: red;">x</p>`,
+		},
+		{
+			name: "combinators",
+			doc:  `<style>div p{color:red}div > p.a{color:blue}</style><div><p class="a">x</p><p>y</p></div>`,
+			want: `<div><p class="a" style="color: blue;">x</p><p style="color: red;">y</p></div>`,
+		},
+		{
+			name: "attribute and sibling selectors",
+			doc:  `<style>td[align=right]{font-weight:bold} li + li {margin:1px}</style><table><tr><td align="right">1</td></tr></table><ul><li>a</li><li>b</li></ul>`,
+			want: `<table><tr><td align="right" style="font-weight: bold;">1</td></tr></table><ul><li>a</li><li style="margin: 1px;">b</li></ul>`,
+		},
+		{
+			name: "pseudo-classes and media queries stay behind",
+			doc:  `<style>a:hover{color:red}@media (max-width:600px){p{color:blue}}p{margin:0}</style><p><a href="#">x</a></p>`,
+			want: "<style>\na:hover {color:red}\n@media (max-width:600px){p{color:blue}}\n</style><p style=\"margin: 0;\"><a href=\"#\">x</a></p>",
+		},
+		{
+			name: "print stylesheet untouched",
+			doc:  `<style media="print">p{color:red}</style><p>x</p>`,
+			want: `<style media="print">p{color:red}</style><p>x</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Inline(tt.doc); got != tt.want {
+				t.Errorf("Inline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
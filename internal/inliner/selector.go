@@ -0,0 +1,244 @@
+package inliner
+
+import "strings"
+
+// selector is a chain of compound selectors joined by combinators, stored
+// right to left: parts[0] is the subject and combs[i] joins parts[i] to
+// parts[i+1].
+type selector struct {
+	parts []compound
+	combs []byte // ' ', '>', '+', '~'
+	spec  [3]int // ids, classes/attributes/pseudo-classes, types
+}
+
+type compound struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrMatch
+	first   bool
+	last    bool
+}
+
+type attrMatch struct {
+	name, op, value string
+}
+
+// parseSelector parses a selector. ok is false for selectors that can't be
+// evaluated statically (:hover, ::before, ...) or aren't understood.
+func parseSelector(s string) (selector, bool) {
+	var sel selector
+	var parts []compound
+	var combs []byte
+	s = strings.TrimSpace(s)
+	for len(s) > 0 {
+		c, rest, ok := parseCompound(s, &sel.spec)
+		if !ok {
+			return selector{}, false
+		}
+		parts = append(parts, c)
+		rest = strings.TrimLeft(rest, " \t\n\r")
+		if rest == "" {
+			break
+		}
+		comb := byte(' ')
+		if strings.ContainsRune(">+~", rune(rest[0])) {
+			comb = rest[0]
+			rest = strings.TrimLeft(rest[1:], " \t\n\r")
+		}
+		if rest == "" {
+			return selector{}, false
+		}
+		combs = append(combs, comb)
+		s = rest
+	}
+	if len(parts) == 0 {
+		return selector{}, false
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	for i, j := 0, len(combs)-1; i < j; i, j = i+1, j-1 {
+		combs[i], combs[j] = combs[j], combs[i]
+	}
+	sel.parts, sel.combs = parts, combs
+	return sel, true
+}
+
+func parseCompound(s string, spec *[3]int) (compound, string, bool) {
+	var c compound
+	i := 0
+	if i < len(s) && s[i] == '*' {
+		i++
+	} else if n := identLen(s[i:]); n > 0 {
+		c.tag = strings.ToLower(s[i : i+n])
+		spec[2]++
+		i += n
+	}
+	for i < len(s) {
+		switch s[i] {
+		case '#':
+			n := identLen(s[i+1:])
+			if n == 0 {
+				return c, "", false
+			}
+			c.id = s[i+1 : i+1+n]
+			spec[0]++
+			i += 1 + n
+		case '.':
+			n := identLen(s[i+1:])
+			if n == 0 {
+				return c, "", false
+			}
+			c.classes = append(c.classes, s[i+1:i+1+n])
+			spec[1]++
+			i += 1 + n
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return c, "", false
+			}
+			a, ok := parseAttrMatch(s[i+1 : i+end])
+			if !ok {
+				return c, "", false
+			}
+			c.attrs = append(c.attrs, a)
+			spec[1]++
+			i += end + 1
+		case ':':
+			n := identLen(s[i+1:])
+			switch strings.ToLower(s[i+1 : i+1+n]) {
+			case "first-child":
+				c.first = true
+			case "last-child":
+				c.last = true
+			default:
+				return c, "", false
+			}
+			spec[1]++
+			i += 1 + n
+		default:
+			if i == 0 {
+				return c, "", false
+			}
+			return c, s[i:], true
+		}
+	}
+	return c, "", i > 0
+}
+
+func parseAttrMatch(s string) (attrMatch, bool) {
+	for _, op := range []string{"~=", "|=", "^=", "$=", "*=", "="} {
+		if name, value, ok := strings.Cut(s, op); ok {
+			value = strings.Trim(strings.TrimSpace(value), `"'`)
+			return attrMatch{name: strings.ToLower(strings.TrimSpace(name)), op: op, value: value}, true
+		}
+	}
+	name := strings.ToLower(strings.TrimSpace(s))
+	return attrMatch{name: name}, name != ""
+}
+
+func identLen(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= 0x80 {
+			n++
+			continue
+		}
+		break
+	}
+	return n
+}
+
+func (sel selector) matches(n *node) bool {
+	return sel.matchFrom(n, 0)
+}
+
+func (sel selector) matchFrom(n *node, i int) bool {
+	if !sel.parts[i].matches(n) {
+		return false
+	}
+	if i == len(sel.parts)-1 {
+		return true
+	}
+	switch sel.combs[i] {
+	case '>':
+		return n.parent != nil && sel.matchFrom(n.parent, i+1)
+	case '+':
+		prev := n.prevSibling()
+		return prev != nil && sel.matchFrom(prev, i+1)
+	case '~':
+		for p := n.prevSibling(); p != nil; p = p.prevSibling() {
+			if sel.matchFrom(p, i+1) {
+				return true
+			}
+		}
+	default:
+		for p := n.parent; p != nil; p = p.parent {
+			if sel.matchFrom(p, i+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c compound) matches(n *node) bool {
+	if n.name == "" {
+		return false
+	}
+	if c.tag != "" && c.tag != n.name {
+		return false
+	}
+	if c.id != "" && n.attr("id") != c.id {
+		return false
+	}
+	if len(c.classes) > 0 {
+		have := strings.Fields(n.attr("class"))
+		for _, want := range c.classes {
+			if !contains(have, want) {
+				return false
+			}
+		}
+	}
+	for _, a := range c.attrs {
+		v, ok := n.attrs[a.name]
+		if !ok {
+			return false
+		}
+		switch a.op {
+		case "=":
+			ok = v == a.value
+		case "~=":
+			ok = contains(strings.Fields(v), a.value)
+		case "|=":
+			ok = v == a.value || strings.HasPrefix(v, a.value+"-")
+		case "^=":
+			ok = a.value != "" && strings.HasPrefix(v, a.value)
+		case "$=":
+			ok = a.value != "" && strings.HasSuffix(v, a.value)
+		case "*=":
+			ok = a.value != "" && strings.Contains(v, a.value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if c.first && n.prevSibling() != nil {
+		return false
+	}
+	if c.last && n.nextSibling() != nil {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// captureDial connects to the embedded SMTP server in-process; see
+// SetCaptureServer.
+var captureDial func() net.Conn
+
+// SetCaptureServer makes the "capture" transport deliver to the embedded
+// SMTP server over connections from dial.
+func SetCaptureServer(dial func() net.Conn) {
+	captureDial = dial
+}
+
+// captureTransport delivers to the embedded SMTP server without a network
+// round trip. The conversation is the same as over TCP, so the server
+// records the full envelope and transcript. With SMTPD_AUTH set it logs in
+// with those credentials, as the server requires.
+type captureTransport struct {
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+func newCapture(cfg config.Config) (captureTransport, error) {
+	if captureDial == nil {
+		return captureTransport{}, fmt.Errorf("capture: the embedded SMTP server is not running")
+	}
+	t := captureTransport{timeout: cfg.UpstreamTimeout}
+	if cfg.SMTPDAuth != "" {
+		user, pass, _ := strings.Cut(cfg.SMTPDAuth, ":")
+		t.auth = smtp.PlainAuth("", user, pass, "localhost")
+	}
+	return t, nil
+}
+
+func (t captureTransport) Send(from string, rcpts []string, raw []byte) error {
+	nc := captureDial()
+	setDeadline(nc, t.timeout)
+	c, err := smtp.NewClient(nc, "localhost")
+	if err != nil {
+		_ = nc.Close()
+		return err
+	}
+	defer c.Close()
+	if t.auth != nil {
+		if err := c.Auth(t.auth); err != nil {
+			return err
+		}
+	}
+	err = transaction(c, from, rcpts, raw)
+	var stale staleError
+	if errors.As(err, &stale) {
+		return stale.err
+	}
+	_ = c.Quit()
+	return err
+}
@@ -0,0 +1,148 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The file transports write one copy of each message. Its envelope
+// recipients, which include Bcc addresses, go in an X-Envelope-To header.
+
+// maildir delivers into a Maildir: written to tmp/, then moved to new/.
+type maildir struct {
+	dir  string
+	host string
+	seq  atomic.Int64
+}
+
+func newMaildir(dir string) (*maildir, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("maildir: %w", err)
+		}
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	if host == "" {
+		host = "localhost"
+	}
+	return &maildir{dir: dir, host: host}, nil
+}
+
+func (m *maildir) Send(from string, rcpts []string, raw []byte) error {
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), m.seq.Add(1), m.host)
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := os.WriteFile(tmp, withEnvelopeTo(raw, rcpts), 0o644); err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("maildir: %w", err)
+	}
+	return nil
+}
+
+// mbox appends to an mboxrd file: each message starts with a "From "
+// line and body lines starting with ">*From " gain another '>'.
+type mbox struct {
+	mu   sync.Mutex
+	path string
+}
+
+var mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+func newMbox(path string) (*mbox, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("mbox: %w", err)
+		}
+	}
+	return &mbox{path: path}, nil
+}
+
+func (m *mbox) Send(from string, rcpts []string, raw []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, time.Now().UTC().Format("Mon Jan _2 15:04:05 2006"))
+	msg := bytes.ReplaceAll(withEnvelopeTo(raw, rcpts), []byte("\r\n"), []byte("\n"))
+	buf.Write(mboxFromRe.ReplaceAll(msg, []byte(">$1")))
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("mbox: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("mbox: %w", err)
+	}
+	return f.Close()
+}
+
+// emlDir writes each message to <dir>/<message id>.eml, so tests can open
+// the file for the _id a send returned.
+type emlDir struct {
+	dir string
+	seq atomic.Int64
+}
+
+func newEMLDir(dir string) (*emlDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("eml: %w", err)
+	}
+	return &emlDir{dir: dir}, nil
+}
+
+var unsafeNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (e *emlDir) Send(from string, rcpts []string, raw []byte) error {
+	name := MessageID(raw)
+	if name == "" {
+		name = fmt.Sprintf("%d-%d", time.Now().UnixNano(), e.seq.Add(1))
+	}
+	path := filepath.Join(e.dir, name+".eml")
+	if err := os.WriteFile(path, withEnvelopeTo(raw, rcpts), 0o644); err != nil {
+		return fmt.Errorf("eml: %w", err)
+	}
+	return nil
+}
+
+// MessageID returns the local part of raw's Message-ID, the message's _id
+// for mail this server built, made safe for a file name.
+func MessageID(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	id := strings.Trim(strings.TrimSpace(msg.Header.Get("Message-ID")), "<>")
+	id, _, _ = strings.Cut(id, "@")
+	return strings.Trim(unsafeNameRe.ReplaceAllString(id, "_"), "._")
+}
+
+func withEnvelopeTo(raw []byte, rcpts []string) []byte {
+	if len(rcpts) == 0 {
+		return raw
+	}
+	eol := "\n"
+	if bytes.Contains(raw, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	hdr := "X-Envelope-To: " + strings.Join(rcpts, ", ") + eol
+	return append([]byte(hdr), raw...)
+}
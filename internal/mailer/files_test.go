@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMessage = "Message-ID: <abc123@mandrill.dev>\r\nSubject: hi\r\n\r\nFrom the start\r\nbody\r\n"
+
+func TestMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := newMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Send("s@example.com", []string{"a@x.test", "b@x.test"}, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []string{"tmp", "cur"} {
+		if files, _ := os.ReadDir(filepath.Join(dir, sub)); len(files) != 0 {
+			t.Errorf("%s/ has %d files, want none", sub, len(files))
+		}
+	}
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("new/ has %d files (%v), want 2", len(files), err)
+	}
+	if files[0].Name() == files[1].Name() {
+		t.Errorf("both messages are named %s", files[0].Name())
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if want := "X-Envelope-To: a@x.test, b@x.test\r\n" + testMessage; string(got) != want {
+		t.Errorf("message =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "mail.mbox")
+	m, err := newMbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send("s@example.com", []string{"a@x.test"}, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send("", nil, []byte("Subject: two\n\n>From quoted\nno newline")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	msgs := strings.Split(got, "\n\nFrom ")
+	if len(msgs) != 2 {
+		t.Fatalf("mbox has %d messages, want 2:\n%s", len(msgs), got)
+	}
+	if !strings.HasPrefix(msgs[0], "From s@example.com ") || !strings.HasPrefix(msgs[1], "MAILER-DAEMON ") {
+		t.Errorf("From lines wrong:\n%s", got)
+	}
+	for _, want := range []string{
+		"X-Envelope-To: a@x.test\nMessage-ID: <abc123@mandrill.dev>\nSubject: hi\n\n>From the start\nbody\n",
+		"Subject: two\n\n>>From quoted\nno newline\n\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("mbox lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "\r") {
+		t.Errorf("mbox has CRLF line endings:\n%q", got)
+	}
+}
+
+func TestEMLDir(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newEMLDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Send("s@example.com", []string{"a@x.test"}, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Send("s@example.com", nil, []byte("Subject: no id\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "abc123.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "X-Envelope-To: a@x.test\r\n" + testMessage; string(got) != want {
+		t.Errorf("abc123.eml =\n%q\nwant\n%q", got, want)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 || !strings.HasSuffix(files[0].Name(), ".eml") || !strings.HasSuffix(files[1].Name(), ".eml") {
+		t.Errorf("files = %v, want two .eml files", files)
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{"Message-ID: <abc123@mandrill.dev>\r\n\r\n", "abc123"},
+		{"Message-Id:  <../x/y z@host>\r\n\r\n", "x_y_z"},
+		{"Subject: none\r\n\r\n", ""},
+	}
+	for _, tt := range tests {
+		if got := MessageID([]byte(tt.raw)); got != tt.want {
+			t.Errorf("MessageID(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// lmtpClient delivers over LMTP (RFC 2033), as to Dovecot. After DATA the
+// server replies once per accepted recipient, so each recipient succeeds
+// or fails on its own and failures come back as RecipientErrors.
+type lmtpClient struct {
+	network, addr string
+	// timeout bounds a whole session.
+	timeout time.Duration
+}
+
+// newLMTP reads addr as "unix:/path", an absolute socket path or
+// "host:port".
+func newLMTP(addr string, timeout time.Duration) (*lmtpClient, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return &lmtpClient{network: "unix", addr: strings.TrimPrefix(addr, "unix:"), timeout: timeout}, nil
+	case strings.HasPrefix(addr, "/"):
+		return &lmtpClient{network: "unix", addr: addr, timeout: timeout}, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("lmtp: %w", err)
+	}
+	return &lmtpClient{network: "tcp", addr: addr, timeout: timeout}, nil
+}
+
+func (l *lmtpClient) Send(from string, rcpts []string, raw []byte) error {
+	nc, err := net.DialTimeout(l.network, l.addr, l.timeout)
+	if err != nil {
+		return err
+	}
+	_ = nc.SetDeadline(time.Now().Add(l.timeout))
+	c := textproto.NewConn(nc)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	if err := lmtpCmd(c, 250, "LHLO %s", host); err != nil {
+		return err
+	}
+	if err := lmtpCmd(c, 250, "MAIL FROM:<%s>", from); err != nil {
+		return err
+	}
+	refused := RecipientErrors{}
+	var accepted []string
+	for _, r := range rcpts {
+		err := lmtpCmd(c, 25, "RCPT TO:<%s>", r)
+		var reply *textproto.Error
+		switch {
+		case err == nil:
+			accepted = append(accepted, r)
+		case errors.As(err, &reply):
+			refused[r] = reply
+		default:
+			return err
+		}
+	}
+	if len(accepted) == 0 {
+		_ = lmtpCmd(c, 221, "QUIT")
+		return refused
+	}
+	if err := lmtpCmd(c, 354, "DATA"); err != nil {
+		return err
+	}
+	w := c.DotWriter()
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	for _, r := range accepted {
+		_, _, err := c.ReadResponse(250)
+		var reply *textproto.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &reply):
+			refused[r] = reply
+		default:
+			return err
+		}
+	}
+	_ = lmtpCmd(c, 221, "QUIT")
+	if len(refused) > 0 {
+		return refused
+	}
+	return nil
+}
+
+// lmtpCmd sends a command and reads its reply, which must start with
+// expectCode.
+func lmtpCmd(c *textproto.Conn, expectCode int, format string, args ...any) error {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, _, err = c.ReadResponse(expectCode)
+	return err
+}
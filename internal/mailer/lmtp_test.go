@@ -0,0 +1,162 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// fakeLMTP accepts one session and answers RCPT TO and the per-recipient
+// replies after DATA from the given maps, defaulting to 250. It returns
+// the address to dial and a channel receiving the commands it saw.
+func fakeLMTP(t *testing.T, rcptReply, dataReply map[string]string) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	seen := make(chan []string, 1)
+	go func() {
+		var cmds []string
+		defer func() { seen <- cmds }()
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		reply := func(s string) { fmt.Fprintf(c, "%s\r\n", s) }
+		reply("220 lmtp.test LMTP ready")
+		var accepted []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmds = append(cmds, line)
+			switch {
+			case strings.HasPrefix(line, "LHLO"):
+				reply("250-lmtp.test\r\n250 PIPELINING")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				rcpt := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+				if s, ok := rcptReply[rcpt]; ok {
+					reply(s)
+					continue
+				}
+				accepted = append(accepted, rcpt)
+				reply("250 2.1.5 OK")
+			case line == "DATA":
+				reply("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+				}
+				for _, rcpt := range accepted {
+					if s, ok := dataReply[rcpt]; ok {
+						reply(s)
+					} else {
+						reply("250 2.0.0 <" + rcpt + "> saved")
+					}
+				}
+			case line == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().String(), seen
+}
+
+func TestLMTP(t *testing.T) {
+	cfg := config.Config{UpstreamTimeout: 10 * time.Second}
+	rcpts := []string{"a@example.com", "b@example.com", "c@example.com"}
+	tests := []struct {
+		name      string
+		rcptReply map[string]string
+		dataReply map[string]string
+		refused   map[string]int
+		data      bool
+	}{
+		{
+			name: "all delivered",
+			data: true,
+		},
+		{
+			name:      "mixed replies",
+			rcptReply: map[string]string{"c@example.com": "550 5.1.1 <c@example.com>: no such user"},
+			dataReply: map[string]string{"b@example.com": "552 5.2.2 <b@example.com>: mailbox full"},
+			refused:   map[string]int{"b@example.com": 552, "c@example.com": 550},
+			data:      true,
+		},
+		{
+			name:      "temporary failure after DATA",
+			dataReply: map[string]string{"a@example.com": "451 4.2.0 <a@example.com>: try later"},
+			refused:   map[string]int{"a@example.com": 451},
+			data:      true,
+		},
+		{
+			name: "every recipient refused",
+			rcptReply: map[string]string{
+				"a@example.com": "550 5.1.1 no such user",
+				"b@example.com": "550 5.1.1 no such user",
+				"c@example.com": "450 4.2.1 busy",
+			},
+			refused: map[string]int{"a@example.com": 550, "b@example.com": 550, "c@example.com": 450},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, seen := fakeLMTP(t, tt.rcptReply, tt.dataReply)
+			tr, err := NewTransport(cfg, "lmtp:"+addr)
+			if err != nil {
+				t.Fatalf("NewTransport: %v", err)
+			}
+			err = tr.Send("s@example.com", rcpts, []byte("Subject: hi\r\n\r\nbody\r\n"))
+			var refused RecipientErrors
+			if len(tt.refused) == 0 {
+				if err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+			} else if !errors.As(err, &refused) {
+				t.Fatalf("Send = %v, want RecipientErrors", err)
+			}
+			got := map[string]int{}
+			for rcpt, reply := range refused {
+				got[rcpt] = reply.Code
+			}
+			want := tt.refused
+			if want == nil {
+				want = map[string]int{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("refused = %v, want %v", got, tt.refused)
+			}
+			cmds := <-seen
+			if !strings.HasPrefix(cmds[0], "LHLO ") || cmds[1] != "MAIL FROM:<s@example.com>" {
+				t.Errorf("session started with %q", cmds[:2])
+			}
+			if data := strings.Contains(strings.Join(cmds, "\n"), "\nDATA\n"); data != tt.data {
+				t.Errorf("DATA sent = %v, want %v", data, tt.data)
+			}
+			if cmds[len(cmds)-1] != "QUIT" {
+				t.Errorf("session ended with %q", cmds[len(cmds)-1])
+			}
+		})
+	}
+}
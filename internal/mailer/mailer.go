@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"fmt"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Mailer builds messages, signs them with keys when cfg.DKIMSign is set
+// and hands them to transports. The default transport (cfg.Transport) and
+// any others it is given are opened once, by New.
+type Mailer struct {
+	cfg        config.Config
+	keys       *dkim.Keyring
+	transports map[string]Transport
+}
+
+// New opens cfg.Transport and the transports named by specs, such as the
+// routing upstreams, see NewTransport. keys may be nil when nothing is
+// signed.
+func New(cfg config.Config, keys *dkim.Keyring, specs ...string) (*Mailer, error) {
+	m := &Mailer{cfg: cfg, keys: keys, transports: map[string]Transport{}}
+	for _, spec := range append([]string{cfg.Transport}, specs...) {
+		if _, ok := m.transports[spec]; ok {
+			continue
+		}
+		t, err := NewTransport(cfg, spec)
+		if err != nil {
+			return nil, err
+		}
+		m.transports[spec] = t
+	}
+	return m, nil
+}
+
+// SendMessage builds mm and sends it through the default transport. The
+// built message is stored in outRaw when it isn't nil.
+func (m *Mailer) SendMessage(mm types.MandrillMessage, id string, outRaw *[]byte) error {
+	sender, rcpts, raw := m.Build(mm, id)
+	if outRaw != nil {
+		*outRaw = raw
+	}
+	return m.SendRaw(sender, rcpts, raw)
+}
+
+// SendRaw sends a built message through the default transport.
+func (m *Mailer) SendRaw(from string, to []string, raw []byte) error {
+	return m.Relay(m.cfg.Transport, from, to, raw)
+}
+
+// Relay sends a built message through the transport opened for spec.
+// Recipients refused one by one are reported as RecipientErrors.
+func (m *Mailer) Relay(spec, from string, rcpts []string, raw []byte) error {
+	t, ok := m.transports[spec]
+	if !ok {
+		return fmt.Errorf("transport %q is not open", spec)
+	}
+	return t.Send(from, rcpts, raw)
+}
+
+// Build renders mm as a signed RFC 822 message with its Return-Path and
+// returns it with the envelope sender and recipients.
+func (m *Mailer) Build(mm types.MandrillMessage, id string) (sender string, rcpts []string, raw []byte) {
+	from, toHdr, ccHdr, rcpts := extractRecipients(mm)
+	sender = envelopeSender(m.cfg, mm.ReturnPathDomain, id, from)
+	raw = buildRFC822(m.cfg, mm, id, from, toHdr, ccHdr)
+	raw = withReturnPath(raw, sender)
+	domain := mm.SigningDomain
+	if domain == "" {
+		domain = domainOf(from)
+	}
+	return sender, rcpts, m.sign(raw, domain)
+}
+
+// PrepareRaw readies a pre-built message for sending. id and
+// returnPathDomain select the VERP envelope sender the same way Build does.
+func (m *Mailer) PrepareRaw(from string, raw []byte, id, returnPathDomain string) (sender string, out []byte) {
+	sender = envelopeSender(m.cfg, returnPathDomain, id, from)
+	raw = withReturnPath(raw, sender)
+	return sender, m.sign(raw, domainOf(from))
+}
@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestMailerSend(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{Transport: "eml:" + filepath.Join(dir, "default")}
+	m, err := New(cfg, nil, "maildir:"+filepath.Join(dir, "other"), "null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []byte
+	mm := types.MandrillMessage{FromEmail: "shop@example.com", Subject: "hi", Text: "body", To: []types.MandrillRecipient{{Email: "a@x.test"}}}
+	if err := m.SendMessage(mm, "msg1", &raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "default", "msg1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "X-Envelope-To: a@x.test\r\n") || !strings.HasSuffix(string(got), string(raw)) {
+		t.Errorf("msg1.eml =\n%s\nwant the built message\n%s", got, raw)
+	}
+
+	if err := m.Relay("maildir:"+filepath.Join(dir, "other"), "s@example.com", []string{"b@x.test"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "other", "new")); len(files) != 1 {
+		t.Errorf("maildir got %d messages, want 1", len(files))
+	}
+	if err := m.Relay("mbox:/nope", "s@example.com", []string{"b@x.test"}, raw); err == nil {
+		t.Error("Relay through a transport that wasn't opened succeeded")
+	}
+	if _, err := New(config.Config{Transport: "bogus:x"}, nil); err == nil {
+		t.Error("New with an unknown transport succeeded")
+	}
+}
+
+// TestMailerSign checks that each Mailer signs with its own keyring, so
+// two configurations in one process don't share keys.
+func TestMailerSign(t *testing.T) {
+	mm := types.MandrillMessage{FromEmail: "shop@example.com", Subject: "hi", Text: "body", To: []types.MandrillRecipient{{Email: "a@x.test"}}}
+	for _, sel := range []string{"one", "two"} {
+		m, err := New(config.Config{Transport: "null", DKIMSign: true}, dkim.NewKeyring("", sel, dkim.Ed25519SHA256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, raw := m.Build(mm, "msg1")
+		if !strings.HasPrefix(string(raw), "DKIM-Signature:") || !strings.Contains(string(raw), "s="+sel+";") {
+			t.Errorf("selector %s: message not signed with it:\n%s", sel, raw)
+		}
+	}
+	m, _ := New(config.Config{Transport: "null"}, dkim.NewKeyring("", "one", dkim.Ed25519SHA256))
+	if _, _, raw := m.Build(mm, "msg1"); strings.Contains(string(raw), "DKIM-Signature:") {
+		t.Errorf("signed with DKIMSign off:\n%s", raw)
+	}
+}
@@ -0,0 +1,285 @@
+package mailer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// healthCheckAfter is how long a connection may sit idle before it is
+// checked with NOOP on its way out of the pool.
+var healthCheckAfter = time.Second
+
+// PoolStats describes the pooled connections to one upstream.
+type PoolStats struct {
+	Upstream string `json:"upstream"`
+	MaxConns int    `json:"max_conns"`
+	Active   int    `json:"active"`
+	Idle     int    `json:"idle"`
+	// Dials counts new connections, Reuses messages sent on an idle one.
+	Dials    int64 `json:"dials"`
+	Reuses   int64 `json:"reuses"`
+	Messages int64 `json:"messages"`
+	// Waits counts messages that waited for a free connection.
+	Waits int64 `json:"waits"`
+	// HealthCheckFailures counts idle connections that failed NOOP;
+	// Discarded counts connections dropped after an error.
+	HealthCheckFailures int64 `json:"health_check_failures"`
+	Discarded           int64 `json:"discarded"`
+}
+
+type idleConn struct {
+	c     *smtp.Client
+	nc    net.Conn
+	since time.Time
+}
+
+// upstreamPool holds the connections to one upstream. slots caps how many
+// are in use at once.
+type upstreamPool struct {
+	slots chan struct{}
+	idle  []idleConn
+	stats PoolStats
+}
+
+// conn is a connection checked out of the pool.
+type conn struct {
+	*smtp.Client
+	nc net.Conn
+	up *upstreamPool
+	// timeout bounds each exchange on the connection.
+	timeout time.Duration
+	// reused is set for a connection that carried an earlier message.
+	reused bool
+}
+
+type connPool struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamPool
+	// connect opens the network connection to cfg's server.
+	connect func(cfg config.Config) (net.Conn, error)
+}
+
+var pool = &connPool{upstreams: map[string]*upstreamPool{}, connect: connectTCP}
+
+// Stats reports the connection pool for every upstream used so far.
+func Stats() []PoolStats {
+	return pool.stats()
+}
+
+func (p *connPool) stats() []PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]PoolStats, 0, len(p.upstreams))
+	for _, up := range p.upstreams {
+		s := up.stats
+		s.Idle = len(up.idle)
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Upstream < out[j].Upstream })
+	return out
+}
+
+// upstreamKey names the server and user cfg sends through.
+func upstreamKey(cfg config.Config) string {
+	scheme := "smtp"
+	switch cfg.SMTPMode {
+	case config.TLSTLS:
+		scheme = "smtps"
+	case config.TLSStartTLS:
+		scheme = "smtp+starttls"
+	}
+	user := ""
+	if cfg.SMTPUsername != "" {
+		user = cfg.SMTPUsername + "@"
+	}
+	return fmt.Sprintf("%s://%s%s:%d", scheme, user, cfg.SMTPHost, cfg.SMTPPort)
+}
+
+// poolKey identifies the server and credentials cfg sends through, so a
+// connection authenticated with other credentials is never reused. The
+// password is hashed to keep it out of the key.
+func poolKey(cfg config.Config) string {
+	sum := sha256.Sum256([]byte(cfg.SMTPPassword))
+	return upstreamKey(cfg) + " " + hex.EncodeToString(sum[:8])
+}
+
+func (p *connPool) upstream(cfg config.Config) *upstreamPool {
+	key := poolKey(cfg)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up, ok := p.upstreams[key]
+	if !ok {
+		up = &upstreamPool{stats: PoolStats{Upstream: upstreamKey(cfg), MaxConns: cfg.SMTPPoolSize}}
+		if cfg.SMTPPoolSize > 0 {
+			up.slots = make(chan struct{}, cfg.SMTPPoolSize)
+		}
+		p.upstreams[key] = up
+	}
+	return up
+}
+
+// get returns a ready connection to cfg's upstream, waiting while the
+// upstream is at its connection limit. Idle connections are reused when
+// they are still healthy; otherwise a new one is dialed. The connection
+// must be handed back with put.
+func (p *connPool) get(cfg config.Config) (*conn, error) {
+	up := p.upstream(cfg)
+	if up.slots != nil {
+		select {
+		case up.slots <- struct{}{}:
+		default:
+			p.count(&up.stats.Waits)
+			up.slots <- struct{}{}
+		}
+	}
+	for {
+		p.mu.Lock()
+		n := len(up.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		ic := up.idle[n-1]
+		up.idle = up.idle[:n-1]
+		p.mu.Unlock()
+
+		idle := time.Since(ic.since)
+		setDeadline(ic.nc, cfg.UpstreamTimeout)
+		if idle >= cfg.SMTPPoolIdleTimeout {
+			_ = ic.c.Quit()
+			continue
+		}
+		if idle >= healthCheckAfter {
+			if err := ic.c.Noop(); err != nil {
+				p.count(&up.stats.HealthCheckFailures)
+				_ = ic.c.Close()
+				continue
+			}
+		}
+		p.mu.Lock()
+		up.stats.Reuses++
+		up.stats.Active++
+		p.mu.Unlock()
+		return &conn{Client: ic.c, nc: ic.nc, up: up, timeout: cfg.UpstreamTimeout, reused: true}, nil
+	}
+
+	c, nc, err := p.dial(cfg)
+	if err != nil {
+		p.release(up)
+		return nil, err
+	}
+	p.mu.Lock()
+	up.stats.Dials++
+	up.stats.Active++
+	p.mu.Unlock()
+	return &conn{Client: c, nc: nc, up: up, timeout: cfg.UpstreamTimeout}, nil
+}
+
+// put hands cn back after a transaction. A connection that is still in a
+// known state (reusable) is reset with RSET and kept for the next message;
+// one that failed mid-transaction is closed.
+func (p *connPool) put(cn *conn, reusable bool) {
+	up, c := cn.up, cn.Client
+	p.mu.Lock()
+	up.stats.Active--
+	p.mu.Unlock()
+	setDeadline(cn.nc, cn.timeout)
+	switch {
+	case !reusable:
+		_ = c.Close()
+		p.count(&up.stats.Discarded)
+	case up.slots == nil:
+		_ = c.Quit()
+	case c.Reset() != nil:
+		_ = c.Close()
+		p.count(&up.stats.Discarded)
+	default:
+		p.mu.Lock()
+		if len(up.idle) < cap(up.slots) {
+			up.idle = append(up.idle, idleConn{c: c, nc: cn.nc, since: time.Now()})
+			c = nil
+		}
+		p.mu.Unlock()
+		if c != nil {
+			_ = c.Quit()
+		}
+	}
+	p.release(up)
+}
+
+func (p *connPool) release(up *upstreamPool) {
+	if up.slots != nil {
+		<-up.slots
+	}
+}
+
+func (p *connPool) count(n *int64) {
+	p.mu.Lock()
+	*n++
+	p.mu.Unlock()
+}
+
+// setDeadline bounds the next exchange on nc to timeout; 0 means none.
+func setDeadline(nc net.Conn, timeout time.Duration) {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	_ = nc.SetDeadline(t)
+}
+
+// connectTCP dials the configured SMTP server, over TLS in TLSTLS mode,
+// within cfg.UpstreamTimeout.
+func connectTCP(cfg config.Config) (net.Conn, error) {
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	dialer := &net.Dialer{Timeout: cfg.UpstreamTimeout}
+	if cfg.SMTPMode == config.TLSTLS {
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.SMTPHost, InsecureSkipVerify: cfg.InsecureTLS})
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// dial connects to the configured SMTP server, negotiating TLS and
+// authenticating as configured, within cfg.UpstreamTimeout.
+func (p *connPool) dial(cfg config.Config) (*smtp.Client, net.Conn, error) {
+	nc, err := p.connect(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	setDeadline(nc, cfg.UpstreamTimeout)
+	c, err := smtp.NewClient(nc, cfg.SMTPHost)
+	if err != nil {
+		_ = nc.Close()
+		return nil, nil, err
+	}
+	// STARTTLS if requested
+	if cfg.SMTPMode == config.TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: cfg.SMTPHost, InsecureSkipVerify: cfg.InsecureTLS}); err != nil {
+				_ = c.Close()
+				return nil, nil, err
+			}
+		}
+	}
+
+	if cfg.SMTPUsername != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			auth := smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+			if err := c.Auth(auth); err != nil {
+				_ = c.Close()
+				return nil, nil, err
+			}
+		}
+	}
+	return c, nc, nil
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/smtpd"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// testServer is the embedded SMTP server over in-memory pipes, recording
+// what clients send and what it receives.
+type testServer struct {
+	t     *testing.T
+	srv   *smtpd.Server
+	mu    sync.Mutex
+	sent  bytes.Buffer // everything clients wrote
+	conns []net.Conn
+	msgs  []*types.CapturedMessage
+}
+
+func newTestServer(t *testing.T, auth string) *testServer {
+	t.Helper()
+	ts := &testServer{t: t}
+	srv, err := smtpd.NewServer(config.Config{SMTPDHostname: "mx.test", SMTPDAuth: auth}, func(m *types.CapturedMessage) {
+		ts.mu.Lock()
+		ts.msgs = append(ts.msgs, m)
+		ts.mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.srv = srv
+	return ts
+}
+
+// pool returns a connection pool that dials ts.
+func (ts *testServer) pool() *connPool {
+	return &connPool{upstreams: map[string]*upstreamPool{}, connect: func(config.Config) (net.Conn, error) {
+		nc := recordConn{Conn: ts.srv.Pipe(), ts: ts}
+		ts.mu.Lock()
+		ts.conns = append(ts.conns, nc)
+		ts.mu.Unlock()
+		return nc, nil
+	}}
+}
+
+func (ts *testServer) commands() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.sent.String()
+}
+
+type recordConn struct {
+	net.Conn
+	ts *testServer
+}
+
+func (c recordConn) Write(b []byte) (int, error) {
+	c.ts.mu.Lock()
+	c.ts.sent.Write(b)
+	c.ts.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func poolConfig() config.Config {
+	return config.Config{
+		SMTPHost:            "localhost",
+		SMTPPort:            25,
+		SMTPUsername:        "user",
+		SMTPPassword:        "secret",
+		SMTPPoolSize:        2,
+		SMTPPoolIdleTimeout: time.Minute,
+		UpstreamTimeout:     5 * time.Second,
+	}
+}
+
+func stats(t *testing.T, p *connPool) PoolStats {
+	t.Helper()
+	all := p.stats()
+	if len(all) != 1 {
+		t.Fatalf("pool has %d upstreams, want 1: %+v", len(all), all)
+	}
+	return all[0]
+}
+
+// TestPoolReuse sends two messages over one connection: it is reset with
+// RSET in between, so the second transaction carries only its own
+// recipients.
+func TestPoolReuse(t *testing.T) {
+	ts := newTestServer(t, "user:secret")
+	p, cfg := ts.pool(), poolConfig()
+	if err := p.send(cfg, "s@example.com", []string{"a@x.test"}, []byte("Subject: one\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send(cfg, "s@example.com", []string{"b@x.test"}, []byte("Subject: two\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Count(ts.commands(), "EHLO"); got != 1 {
+		t.Errorf("%d EHLOs, want 1:\n%s", got, ts.commands())
+	}
+	if got := strings.Count(ts.commands(), "RSET\r\n"); got != 2 {
+		t.Errorf("%d RSETs, want one after each message:\n%s", got, ts.commands())
+	}
+	ts.mu.Lock()
+	if len(ts.msgs) != 2 || strings.Join(ts.msgs[1].RcptTo, ",") != "b@x.test" {
+		t.Errorf("captured %d messages, want 2 with the second to b@x.test only", len(ts.msgs))
+	}
+	ts.mu.Unlock()
+	s := stats(t, p)
+	if s.Upstream != "smtp://user@localhost:25" || s.Dials != 1 || s.Reuses != 1 || s.Messages != 2 || s.Active != 0 || s.Idle != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+// TestPoolHealthCheck checks connections idle past healthCheckAfter with
+// NOOP, and replaces one that fails it.
+func TestPoolHealthCheck(t *testing.T) {
+	defer func(d time.Duration) { healthCheckAfter = d }(healthCheckAfter)
+	healthCheckAfter = 20 * time.Millisecond
+
+	ts := newTestServer(t, "user:secret")
+	p, cfg := ts.pool(), poolConfig()
+	send := func() {
+		t.Helper()
+		if err := p.send(cfg, "s@example.com", []string{"a@x.test"}, []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	send()
+	if strings.Contains(ts.commands(), "NOOP") {
+		t.Errorf("a connection that was just used was checked:\n%s", ts.commands())
+	}
+	time.Sleep(2 * healthCheckAfter)
+	send()
+	if !strings.Contains(ts.commands(), "NOOP\r\n") {
+		t.Errorf("no NOOP after sitting idle:\n%s", ts.commands())
+	}
+
+	time.Sleep(2 * healthCheckAfter)
+	ts.mu.Lock()
+	_ = ts.conns[0].Close()
+	ts.mu.Unlock()
+	send()
+	s := stats(t, p)
+	if s.HealthCheckFailures != 1 || s.Dials != 2 || s.Messages != 4 {
+		t.Errorf("stats = %+v, want 1 health check failure and 2 dials", s)
+	}
+}
+
+// TestPoolLimit holds the only connection SMTPPoolSize allows: the next
+// get waits for it and then reuses it.
+func TestPoolLimit(t *testing.T) {
+	ts := newTestServer(t, "user:secret")
+	p, cfg := ts.pool(), poolConfig()
+	cfg.SMTPPoolSize = 1
+
+	c1, err := p.get(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *conn)
+	go func() {
+		c2, err := p.get(cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c2
+	}()
+	select {
+	case <-got:
+		t.Fatal("second connection opened past SMTPPoolSize")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := stats(t, p); s.Active != 1 || s.Waits != 1 {
+		t.Errorf("while waiting: stats = %+v, want 1 active and 1 wait", s)
+	}
+	p.put(c1, true)
+	var c2 *conn
+	select {
+	case c2 = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting get was not handed the free connection")
+	}
+	if !c2.reused {
+		t.Error("waiting get dialed instead of reusing the free connection")
+	}
+	p.put(c2, true)
+	if s := stats(t, p); s.Dials != 1 || s.Reuses != 1 || s.Active != 0 || s.Idle != 1 || s.MaxConns != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+// TestPoolCredentials keeps connections for different passwords apart: a
+// connection authenticated with one is not reused for another.
+func TestPoolCredentials(t *testing.T) {
+	ts := newTestServer(t, "user:secret")
+	p, cfg := ts.pool(), poolConfig()
+	if err := p.send(cfg, "s@example.com", []string{"a@x.test"}, []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SMTPPassword = "changed"
+	if err := p.send(cfg, "s@example.com", []string{"a@x.test"}, []byte("Subject: hi\r\n\r\nbody\r\n")); err == nil {
+		t.Error("sent with a wrong password over the connection authenticated with the right one")
+	}
+	if poolKey(cfg) == poolKey(poolConfig()) {
+		t.Error("poolKey ignores the password")
+	}
+	if strings.Contains(poolKey(cfg), "changed") {
+		t.Errorf("poolKey %q contains the password", poolKey(cfg))
+	}
+}
@@ -0,0 +1,120 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultSendmail is the command used by a bare "sendmail" transport.
+const defaultSendmail = "/usr/sbin/sendmail -i"
+
+// sendmailCmd pipes each message to a sendmail-compatible command. The
+// envelope is passed as "-f from -- rcpt...", or, when the command reads
+// recipients from the headers (-t), recipients missing from To and Cc are
+// added as Bcc, which sendmail removes before delivery.
+type sendmailCmd struct {
+	args    []string
+	t       bool
+	timeout time.Duration
+}
+
+func newSendmail(command string, timeout time.Duration) (*sendmailCmd, error) {
+	if command == "" {
+		command = defaultSendmail
+	}
+	args := strings.Fields(command)
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("sendmail: %w", err)
+	}
+	s := &sendmailCmd{args: args, timeout: timeout}
+	for _, a := range args[1:] {
+		if a == "-t" {
+			s.t = true
+		}
+	}
+	return s, nil
+}
+
+func (s *sendmailCmd) Send(from string, rcpts []string, raw []byte) error {
+	args := append([]string(nil), s.args[1:]...)
+	if from != "" {
+		args = append(args, "-f", from)
+	}
+	if s.t {
+		raw = withBcc(raw, rcpts)
+	} else {
+		args = append(append(args, "--"), rcpts...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.args[0], args...)
+	cmd.Stdin = bytes.NewReader(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("sendmail: %w", ctx.Err())
+	}
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return err
+	}
+	msg := strings.Join(strings.Fields(out.String()), " ")
+	if msg == "" {
+		msg = exit.Error()
+	}
+	return sendmailError(exit.ExitCode(), msg)
+}
+
+// sendmailError maps sendmail's sysexits codes to the SMTP reply a server
+// would have given; other failures are treated like a failed connection.
+func sendmailError(code int, msg string) error {
+	var reply *textproto.Error
+	switch code {
+	case 65: // EX_DATAERR
+		reply = &textproto.Error{Code: 554, Msg: "5.6.0 " + msg}
+	case 67: // EX_NOUSER
+		reply = &textproto.Error{Code: 550, Msg: "5.1.1 " + msg}
+	case 68: // EX_NOHOST
+		reply = &textproto.Error{Code: 550, Msg: "5.1.2 " + msg}
+	case 75: // EX_TEMPFAIL
+		reply = &textproto.Error{Code: 451, Msg: "4.3.0 " + msg}
+	case 77: // EX_NOPERM
+		reply = &textproto.Error{Code: 550, Msg: "5.7.1 " + msg}
+	default:
+		return fmt.Errorf("sendmail: exit status %d: %s", code, msg)
+	}
+	return reply
+}
+
+// withBcc adds a Bcc header for the rcpts raw's To and Cc don't name.
+func withBcc(raw []byte, rcpts []string) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return raw
+	}
+	named := map[string]bool{}
+	for _, k := range []string{"To", "Cc", "Bcc"} {
+		list, _ := msg.Header.AddressList(k)
+		for _, a := range list {
+			named[strings.ToLower(a.Address)] = true
+		}
+	}
+	var bcc []string
+	for _, r := range rcpts {
+		if !named[strings.ToLower(r)] {
+			bcc = append(bcc, r)
+		}
+	}
+	if len(bcc) == 0 {
+		return raw
+	}
+	return append([]byte("Bcc: "+strings.Join(bcc, ", ")+"\r\n"), raw...)
+}
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+func TestSendmailError(t *testing.T) {
+	tests := []struct {
+		code   int
+		reply  int // 0 when the failure isn't an SMTP reply
+		bounce bool
+	}{
+		{65, 554, true},
+		{67, 550, true},
+		{68, 550, true},
+		{75, 451, false},
+		{77, 550, true},
+		{1, 0, false},
+		{71, 0, false},
+	}
+	for _, tt := range tests {
+		err := sendmailError(tt.code, "oops")
+		var reply *textproto.Error
+		got := 0
+		if errors.As(err, &reply) {
+			got = reply.Code
+		}
+		if got != tt.reply {
+			t.Errorf("exit %d: reply %d (%v), want %d", tt.code, got, err, tt.reply)
+		}
+		// Delivery bounces 5xx replies and defers everything else.
+		if bounce := got >= 500; bounce != tt.bounce {
+			t.Errorf("exit %d: bounce = %v, want %v", tt.code, bounce, tt.bounce)
+		}
+		if !strings.Contains(err.Error(), "oops") {
+			t.Errorf("exit %d: %q lost the command output", tt.code, err)
+		}
+	}
+}
+
+// fakeSendmail writes a script that records its arguments and input in
+// dir and exits with the status held in dir/exit.
+func fakeSendmail(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" > " + dir + "/args\n" +
+		"cat > " + dir + "/stdin\n" +
+		"echo 'user unknown' >&2\n" +
+		"exit $(cat " + dir + "/exit)\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendmail(t *testing.T) {
+	cfg := config.Config{UpstreamTimeout: 10 * time.Second}
+	raw := "To: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	tests := []struct {
+		name  string
+		flags string
+		exit  string
+		args  string
+		stdin string
+		reply int
+	}{
+		{
+			name:  "envelope on the command line",
+			flags: " -i",
+			exit:  "0",
+			args:  "-i -f s@example.com -- a@example.com b@example.org",
+			stdin: "To: a@example.com\nSubject: hi\n\nbody\n",
+		},
+		{
+			name:  "recipients from headers",
+			flags: " -i -t",
+			exit:  "0",
+			args:  "-i -t -f s@example.com",
+			stdin: "Bcc: b@example.org\nTo: a@example.com\nSubject: hi\n\nbody\n",
+		},
+		{
+			name:  "unknown user",
+			exit:  "67",
+			args:  "-f s@example.com -- a@example.com b@example.org",
+			stdin: "To: a@example.com\nSubject: hi\n\nbody\n",
+			reply: 550,
+		},
+		{
+			name:  "temporary failure",
+			exit:  "75",
+			args:  "-f s@example.com -- a@example.com b@example.org",
+			stdin: "To: a@example.com\nSubject: hi\n\nbody\n",
+			reply: 451,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "exit"), []byte(tt.exit), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			tr, err := NewTransport(cfg, "sendmail:"+fakeSendmail(t, dir)+tt.flags)
+			if err != nil {
+				t.Fatalf("NewTransport: %v", err)
+			}
+			err = tr.Send("s@example.com", []string{"a@example.com", "b@example.org"}, []byte(raw))
+			var reply *textproto.Error
+			switch {
+			case tt.reply == 0 && err != nil:
+				t.Fatalf("Send: %v", err)
+			case tt.reply != 0 && (!errors.As(err, &reply) || reply.Code != tt.reply || !strings.Contains(reply.Msg, "user unknown")):
+				t.Fatalf("Send = %v, want a %d reply with the command output", err, tt.reply)
+			}
+			args, _ := os.ReadFile(filepath.Join(dir, "args"))
+			if got := strings.TrimSpace(string(args)); got != tt.args {
+				t.Errorf("args = %q, want %q", got, tt.args)
+			}
+			if stdin, _ := os.ReadFile(filepath.Join(dir, "stdin")); string(stdin) != tt.stdin {
+				t.Errorf("stdin = %q, want %q", stdin, tt.stdin)
+			}
+		})
+	}
+	if _, err := NewTransport(cfg, "sendmail:/nonexistent/sendmail -i"); err == nil {
+		t.Error("NewTransport accepted a missing sendmail command")
+	}
+}
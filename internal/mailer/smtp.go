@@ -2,80 +2,118 @@ package mailer
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/dkim"
+	"github.com/jerson/mandrillfordev/internal/htmlconv"
+	"github.com/jerson/mandrillfordev/internal/inliner"
+	"github.com/jerson/mandrillfordev/internal/tracking"
 	"github.com/jerson/mandrillfordev/internal/types"
 )
 
-func SendMessage(cfg config.Config, mm types.MandrillMessage, id string, outRaw *[]byte) error {
-	from, toHdr, ccHdr, rcpts := extractRecipients(mm)
-	raw := buildRFC822(mm, id, from, toHdr, ccHdr)
-	if outRaw != nil {
-		*outRaw = raw
+// Preview builds mm as Mailer.Build does, without the Return-Path and
+// signature, to show a message that hasn't been delivered.
+func Preview(cfg config.Config, mm types.MandrillMessage, id string) []byte {
+	from, toHdr, ccHdr, _ := extractRecipients(mm)
+	return buildRFC822(cfg, mm, id, from, toHdr, ccHdr)
+}
+
+// sign adds a DKIM signature for domain when signing is enabled. Failures
+// are logged and the message goes out unsigned.
+func (m *Mailer) sign(raw []byte, domain string) []byte {
+	if !m.cfg.DKIMSign || m.keys == nil || domain == "" {
+		return raw
+	}
+	key, err := m.keys.Key(domain)
+	if err == nil {
+		var signed []byte
+		if signed, err = dkim.Sign(raw, key); err == nil {
+			return signed
+		}
 	}
-	return smtpSend(cfg, from, rcpts, raw)
+	log.Printf("dkim: %s: %v", domain, err)
+	return raw
 }
 
-func SendRaw(cfg config.Config, from string, to []string, raw []byte) error {
-	return smtpSend(cfg, from, to, raw)
+func domainOf(addr string) string {
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		return strings.ToLower(addr[at+1:])
+	}
+	return ""
 }
 
+// smtpSend relays raw over a pooled connection to the configured server.
 func smtpSend(cfg config.Config, from string, rcpts []string, raw []byte) error {
-	addr := fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
+	return pool.send(cfg, from, rcpts, raw)
+}
 
-	var c *smtp.Client
-	var err error
-	switch cfg.SMTPMode {
-	case config.TLSTLS:
-		tlsConn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: cfg.SMTPHost, InsecureSkipVerify: cfg.InsecureTLS})
+// send relays raw over a connection from p. A reused connection the server
+// has since dropped is replaced once.
+func (p *connPool) send(cfg config.Config, from string, rcpts []string, raw []byte) error {
+	for {
+		c, err := p.get(cfg)
 		if err != nil {
 			return err
 		}
-		c, err = smtp.NewClient(tlsConn, cfg.SMTPHost)
-		if err != nil {
-			return err
-		}
-	default:
-		c, err = smtp.Dial(addr)
-		if err != nil {
-			return err
+		setDeadline(c.nc, c.timeout)
+		err = transaction(c.Client, from, rcpts, raw)
+		var refused RecipientErrors
+		var reply *textproto.Error
+		replied := errors.As(err, &refused) || errors.As(err, &reply)
+		p.put(c, err == nil || replied)
+		if err == nil || (refused != nil && len(refused) < len(rcpts)) {
+			p.count(&c.up.stats.Messages)
 		}
-		// STARTTLS if requested
-		if cfg.SMTPMode == config.TLSStartTLS {
-			if ok, _ := c.Extension("STARTTLS"); ok {
-				if err := c.StartTLS(&tls.Config{ServerName: cfg.SMTPHost, InsecureSkipVerify: cfg.InsecureTLS}); err != nil {
-					_ = c.Close()
-					return err
-				}
+		var stale staleError
+		if errors.As(err, &stale) {
+			if c.reused {
+				continue
 			}
+			return stale.err
 		}
+		return err
 	}
-	defer c.Close()
+}
 
-	if cfg.SMTPUsername != "" {
-		if ok, _ := c.Extension("AUTH"); ok {
-			auth := smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
-			if err := c.Auth(auth); err != nil {
-				return err
-			}
-		}
-	}
+// staleError is a MAIL FROM that failed without a reply, which is how a
+// connection the server closed while it sat idle shows up.
+type staleError struct{ err error }
+
+func (e staleError) Error() string { return e.err.Error() }
+func (e staleError) Unwrap() error { return e.err }
+
+// transaction sends one message on c, leaving the connection open.
+func transaction(c *smtp.Client, from string, rcpts []string, raw []byte) error {
 	if err := c.Mail(from); err != nil {
+		var reply *textproto.Error
+		if !errors.As(err, &reply) {
+			return staleError{err}
+		}
 		return err
 	}
+	refused := RecipientErrors{}
 	for _, r := range rcpts {
 		if err := c.Rcpt(r); err != nil {
-			return err
+			var reply *textproto.Error
+			if !errors.As(err, &reply) {
+				return err
+			}
+			refused[r] = reply
 		}
 	}
+	if len(refused) == len(rcpts) {
+		return refused
+	}
 	w, err := c.Data()
 	if err != nil {
 		return err
@@ -87,7 +125,27 @@ func smtpSend(cfg config.Config, from string, rcpts []string, raw []byte) error
 	if err := w.Close(); err != nil {
 		return err
 	}
-	return c.Quit()
+	if len(refused) > 0 {
+		return refused
+	}
+	return nil
+}
+
+// RecipientErrors lists recipients the server refused at RCPT TO. The
+// message went to every other recipient.
+type RecipientErrors map[string]*textproto.Error
+
+func (e RecipientErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for r := range e {
+		rcpts = append(rcpts, r)
+	}
+	sort.Strings(rcpts)
+	parts := make([]string, 0, len(rcpts))
+	for _, r := range rcpts {
+		parts = append(parts, fmt.Sprintf("%s: %d %s", r, e[r].Code, e[r].Msg))
+	}
+	return "recipients refused: " + strings.Join(parts, "; ")
 }
 
 func extractRecipients(mm types.MandrillMessage) (from string, toHdr []string, ccHdr []string, rcpts []string) {
@@ -117,6 +175,12 @@ func extractRecipients(mm types.MandrillMessage) (from string, toHdr []string, c
 	return from, to, cc, rcpts
 }
 
+// isDevHeader reports whether name is one of this server's X-MandrillDev-*
+// directives, which never leave the server.
+func isDevHeader(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "x-mandrilldev-")
+}
+
 func formatAddress(email, name string) string {
 	if name == "" {
 		return (&mail.Address{Address: email}).String()
@@ -124,8 +188,27 @@ func formatAddress(email, name string) string {
 	return (&mail.Address{Name: name, Address: email}).String()
 }
 
-func buildRFC822(mm types.MandrillMessage, id, from string, toHdr, ccHdr []string) []byte {
+func buildRFC822(cfg config.Config, mm types.MandrillMessage, id, from string, toHdr, ccHdr []string) []byte {
 	now := time.Now()
+	if mm.AutoHTML && strings.TrimSpace(mm.HTML) == "" && strings.TrimSpace(mm.Text) != "" {
+		mm.HTML = htmlconv.FromText(mm.Text)
+	}
+	if mm.InlineCSS && strings.TrimSpace(mm.HTML) != "" {
+		mm.HTML = inliner.Inline(mm.HTML)
+	}
+	if strings.TrimSpace(mm.HTML) != "" && len(mm.GoogleAnalyticsDomains) > 0 {
+		campaign := mm.GoogleAnalyticsCampaign
+		if campaign == "" {
+			campaign = from
+		}
+		mm.HTML = tracking.TagAnalytics(mm.HTML, mm.GoogleAnalyticsDomains, campaign)
+	}
+	if mm.AutoText && strings.TrimSpace(mm.Text) == "" && strings.TrimSpace(mm.HTML) != "" {
+		mm.Text = htmlconv.ToText(mm.HTML)
+	}
+	if strings.TrimSpace(mm.HTML) != "" && (mm.TrackOpens || mm.TrackClicks) {
+		mm.HTML = tracking.Apply(mm.HTML, trackingBase(cfg, mm), id, mm.TrackClicks, mm.TrackOpens)
+	}
 	var buf bytes.Buffer
 
 	// Standard headers
@@ -154,9 +237,9 @@ func buildRFC822(mm types.MandrillMessage, id, from string, toHdr, ccHdr []strin
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
-		if strings.EqualFold(k, "Bcc") {
+		if strings.EqualFold(k, "Bcc") || isDevHeader(k) {
 			continue
-		} // don't add bcc header
+		} // don't add bcc header or our own directives
 		v := mm.Headers[k]
 		if v != "" {
 			fmt.Fprintf(&buf, "%s: %s\r\n", k, sanitizeHeader(v))
@@ -217,6 +300,17 @@ func buildRFC822(mm types.MandrillMessage, id, from string, toHdr, ccHdr []strin
 	return buf.Bytes()
 }
 
+// trackingBase prefers the message's tracking_domain over the server URL.
+func trackingBase(cfg config.Config, mm types.MandrillMessage) string {
+	if d := strings.TrimSpace(mm.TrackingDomain); d != "" {
+		if strings.Contains(d, "://") {
+			return d
+		}
+		return "http://" + d
+	}
+	return cfg.TrackingURL
+}
+
 func sanitizeHeader(v string) string {
 	v = strings.ReplaceAll(v, "\r", " ")
 	v = strings.ReplaceAll(v, "\n", " ")
@@ -270,9 +364,9 @@ func writeAttachment(buf *bytes.Buffer, mixedBoundary string, a types.MandrillAt
 		fmt.Fprintf(buf, "Content-ID: <%s>\r\n", name)
 	}
 	fmt.Fprintf(buf, "Content-Transfer-Encoding: base64\r\n\r\n")
-	// content is base64-encoded string already; ensure canonical wrap at 76 chars
-	// decode and re-encode to enforce wrapping
-	raw, err := base64.StdEncoding.DecodeString(a.Content)
+	// content is base64-encoded string already, possibly line-wrapped; ensure
+	// canonical wrap at 76 chars: decode and re-encode to enforce wrapping
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(a.Content), ""))
 	if err != nil {
 		// fallback: write as-is
 		writeBase64Wrapped(buf, []byte(a.Content))
@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestAttachmentContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"canonical", "aGVsbG8gd29ybGQ=", "aGVsbG8gd29ybGQ="},
+		{"line-wrapped", "aGVsbG8g\r\nd29ybGQ=\r\n", "aGVsbG8gd29ybGQ="},
+		{"spaces", " aGVsbG8g d29y\tbGQ= ", "aGVsbG8gd29ybGQ="},
+	}
+	for _, tt := range tests {
+		mm := types.MandrillMessage{
+			FromEmail:   "a@example.com",
+			To:          []types.MandrillRecipient{{Email: "b@example.org"}},
+			Text:        "hi",
+			Attachments: []types.MandrillAttachment{{Name: "a.txt", Type: "text/plain", Content: tt.content}},
+		}
+		raw := string(Preview(config.Config{}, mm, "id"))
+		_, part, _ := strings.Cut(raw, `filename="a.txt"`)
+		_, body, _ := strings.Cut(part, "\r\n\r\n")
+		if got, _, _ := strings.Cut(body, "\r\n"); got != tt.want {
+			t.Errorf("%s: attachment encoded as %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyticsCampaign(t *testing.T) {
+	tests := []struct {
+		name     string
+		campaign string
+		want     string
+	}{
+		{"sender by default", "", "utm_campaign=news%40example.com"},
+		{"explicit campaign", "spring", "utm_campaign=spring"},
+	}
+	for _, tt := range tests {
+		mm := types.MandrillMessage{
+			HTML:                    `<a href="https://example.com/p">x</a>`,
+			GoogleAnalyticsDomains:  []string{"example.com"},
+			GoogleAnalyticsCampaign: tt.campaign,
+		}
+		raw := string(buildRFC822(config.Config{}, mm, "id", "news@example.com", []string{"b@example.org"}, nil))
+		if !strings.Contains(raw, "utm_source=mandrill&amp;utm_medium=email&amp;"+tt.want+`"`) {
+			t.Errorf("%s: links not tagged with %s:\n%s", tt.name, tt.want, raw)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+)
+
+// stdoutTransport prints each message's envelope, main headers and text,
+// with attachments listed by name.
+type stdoutTransport struct{}
+
+var stdoutMu sync.Mutex
+
+func (stdoutTransport) Send(from string, rcpts []string, raw []byte) error {
+	var buf bytes.Buffer
+	printMessage(&buf, from, rcpts, raw)
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	_, err := os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func printMessage(w io.Writer, from string, rcpts []string, raw []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		fmt.Fprintf(w, "==== message (unparsable: %v) ====\n%s\n", err, raw)
+		return
+	}
+	dec := new(mime.WordDecoder)
+	header := func(k string) string {
+		v := msg.Header.Get(k)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		return v
+	}
+	fmt.Fprintf(w, "==== message %s ====\n", MessageID(raw))
+	fmt.Fprintf(w, "Envelope: %s -> %s\n", from, strings.Join(rcpts, ", "))
+	for _, k := range []string{"Date", "From", "To", "Cc", "Reply-To", "Subject"} {
+		if v := header(k); v != "" {
+			fmt.Fprintf(w, "%s: %s\n", k, v)
+		}
+	}
+	printParts(w, textproto.MIMEHeader(msg.Header), msg.Body)
+	fmt.Fprintln(w)
+}
+
+// printParts writes text parts out and lists the others.
+func printParts(w io.Writer, h textproto.MIMEHeader, body io.Reader) {
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype = "text/plain"
+	}
+	if strings.HasPrefix(ctype, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			printParts(w, p.Header, p)
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &crlfStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, _ := io.ReadAll(body)
+	_, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if name := dparams["filename"]; name != "" || !strings.HasPrefix(ctype, "text/") {
+		if name == "" {
+			name = params["name"]
+		}
+		fmt.Fprintf(w, "---- attachment %q (%s, %d bytes)\n", name, ctype, len(b))
+		return
+	}
+	fmt.Fprintf(w, "---- %s\n%s", ctype, bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")))
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		fmt.Fprintln(w)
+	}
+}
+
+// crlfStripper drops line breaks from base64 bodies.
+type crlfStripper struct{ r io.Reader }
+
+func (s *crlfStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[j] = c
+			j++
+		}
+	}
+	return j, err
+}
@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintMessage(t *testing.T) {
+	raw := "Message-ID: <abc123@mandrill.dev>\r\n" +
+		"From: Shop <shop@example.com>\r\n" +
+		"To: a@x.test\r\n" +
+		"Subject: =?UTF-8?Q?Caf=C3=A9?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"a.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVs\r\nbG8=\r\n" +
+		"--b1--\r\n"
+	var buf bytes.Buffer
+	printMessage(&buf, "bounce@example.com", []string{"a@x.test", "bcc@x.test"}, []byte(raw))
+	want := "==== message abc123 ====\n" +
+		"Envelope: bounce@example.com -> a@x.test, bcc@x.test\n" +
+		"From: Shop <shop@example.com>\n" +
+		"To: a@x.test\n" +
+		"Subject: Café\n" +
+		"---- text/plain\ncafé\n" +
+		"---- attachment \"a.pdf\" (application/pdf, 5 bytes)\n" +
+		"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printMessage =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestNullTransport(t *testing.T) {
+	if err := (nullTransport{}).Send("s@example.com", []string{"a@x.test"}, []byte(testMessage)); err != nil {
+		t.Errorf("Send() = %v", err)
+	}
+}
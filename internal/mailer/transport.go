@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// Transport delivers built messages. Recipients refused one by one are
+// reported as RecipientErrors; any other error fails every recipient.
+type Transport interface {
+	Send(from string, rcpts []string, raw []byte) error
+}
+
+// NewTransport opens the transport named by spec, written as kind or
+// kind:arg:
+//
+//	smtp            the SMTP server configured by SMTP_*
+//	smtp://HOST     another SMTP server, see smtpURL
+//	maildir:DIR     one file per message in DIR/new
+//	mbox:FILE       appended to an mbox file
+//	eml:DIR         DIR/<message id>.eml
+//	sendmail[:CMD]  piped to a sendmail-compatible command
+//	lmtp:ADDR       LMTP to "host:port" or a Unix socket path
+//	capture         the embedded SMTP server, in-process
+//	stdout          a readable summary on standard output
+//	null            discarded
+func NewTransport(cfg config.Config, spec string) (Transport, error) {
+	if strings.Contains(spec, "://") {
+		return smtpURL(cfg, spec)
+	}
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	arg = strings.TrimSpace(arg)
+	needArg := func() error {
+		if arg == "" {
+			return fmt.Errorf("transport %q: want %s:ARG", spec, kind)
+		}
+		return nil
+	}
+	switch kind {
+	case "", "smtp":
+		return smtpTransport{cfg: cfg}, nil
+	case "maildir":
+		if err := needArg(); err != nil {
+			return nil, err
+		}
+		return newMaildir(arg)
+	case "mbox":
+		if err := needArg(); err != nil {
+			return nil, err
+		}
+		return newMbox(arg)
+	case "eml":
+		if err := needArg(); err != nil {
+			return nil, err
+		}
+		return newEMLDir(arg)
+	case "sendmail":
+		s, err := newSendmail(arg, cfg.UpstreamTimeout)
+		if err != nil {
+			return nil, err
+		}
+		// -t reads recipients from the To, Cc and Bcc headers, which
+		// redirect mode keeps as they are.
+		if s.t && cfg.RedirectTo != "" {
+			return nil, fmt.Errorf("transport %q: -t would mail the original recipients; drop it or REDIRECT_TO", spec)
+		}
+		return s, nil
+	case "lmtp":
+		if err := needArg(); err != nil {
+			return nil, err
+		}
+		return newLMTP(arg, cfg.UpstreamTimeout)
+	case "capture":
+		return newCapture(cfg)
+	case "stdout":
+		return stdoutTransport{}, nil
+	case "null":
+		return nullTransport{}, nil
+	}
+	return nil, fmt.Errorf("transport %q: unknown kind %q", spec, kind)
+}
+
+// smtpTransport relays through the configured SMTP server over pooled
+// connections.
+type smtpTransport struct{ cfg config.Config }
+
+func (t smtpTransport) Send(from string, rcpts []string, raw []byte) error {
+	return smtpSend(t.cfg, from, rcpts, raw)
+}
+
+// smtpURL reads an SMTP server given as
+// scheme://[user[:password]@]host[:port][?insecure=true], where scheme is
+// smtp, smtp+starttls or smtps. The port defaults to 25, 587 and 465.
+func smtpURL(cfg config.Config, spec string) (Transport, error) {
+	u, err := url.Parse(strings.TrimSpace(spec))
+	if err != nil {
+		return nil, fmt.Errorf("transport %q: %w", spec, err)
+	}
+	port := 0
+	switch strings.ToLower(u.Scheme) {
+	case "smtp":
+		cfg.SMTPMode, port = config.TLSNone, 25
+	case "smtp+starttls":
+		cfg.SMTPMode, port = config.TLSStartTLS, 587
+	case "smtps":
+		cfg.SMTPMode, port = config.TLSTLS, 465
+	default:
+		return nil, fmt.Errorf("transport %q: unknown scheme %q", spec, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("transport %q: missing host", spec)
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("transport %q: bad port %q", spec, p)
+		}
+	}
+	cfg.SMTPHost, cfg.SMTPPort = u.Hostname(), port
+	cfg.SMTPUsername, cfg.SMTPPassword = u.User.Username(), ""
+	if pw, ok := u.User.Password(); ok {
+		cfg.SMTPPassword = pw
+	}
+	cfg.InsecureTLS = u.Query().Get("insecure") == "true"
+	return smtpTransport{cfg: cfg}, nil
+}
+
+// nullTransport accepts and discards everything.
+type nullTransport struct{}
+
+func (nullTransport) Send(string, []string, []byte) error { return nil }
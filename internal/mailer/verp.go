@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// verpPrefix starts the local part of bounce addresses, as on Mandrill.
+const verpPrefix = "bounce-md_"
+
+// VERPAddress returns the bounce address for message id on domain.
+func VERPAddress(id, domain string) string {
+	return verpPrefix + id + "@" + strings.ToLower(domain)
+}
+
+// ParseVERP returns the message id encoded in a bounce address, accepting
+// angle brackets and a mailto-style display form.
+func ParseVERP(addr string) (string, bool) {
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return "", false
+	}
+	local := addr[:at]
+	if len(local) <= len(verpPrefix) || !strings.EqualFold(local[:len(verpPrefix)], verpPrefix) {
+		return "", false
+	}
+	return local[len(verpPrefix):], true
+}
+
+// envelopeSender is the MAIL FROM for a message: a VERP address on the
+// return-path domain (per message, else server-wide) or the sender itself.
+func envelopeSender(cfg config.Config, returnPathDomain, id, from string) string {
+	domain := strings.TrimSpace(returnPathDomain)
+	if domain == "" {
+		domain = cfg.ReturnPathDomain
+	}
+	if domain == "" || id == "" {
+		return from
+	}
+	return VERPAddress(id, domain)
+}
+
+// withReturnPath replaces any Return-Path header of a raw message.
+func withReturnPath(raw []byte, sender string) []byte {
+	// end is past the last header line's line break, at the blank line.
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end >= 0 {
+		end += 2
+	} else if end = bytes.Index(raw, []byte("\n\n")); end >= 0 {
+		end++
+	} else {
+		end = len(raw)
+	}
+	var out bytes.Buffer
+	out.WriteString("Return-Path: <" + sender + ">\r\n")
+	lines := bytes.SplitAfter(raw[:end], []byte("\n"))
+	skipping := false
+	for _, l := range lines {
+		if skipping && len(l) > 0 && (l[0] == ' ' || l[0] == '\t') {
+			continue
+		}
+		skipping = bytes.HasPrefix(bytes.ToLower(l), []byte("return-path:"))
+		if !skipping {
+			out.Write(l)
+		}
+	}
+	out.Write(raw[end:])
+	return out.Bytes()
+}
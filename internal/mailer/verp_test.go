@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+func TestVERP(t *testing.T) {
+	addr := VERPAddress("abc123", "Bounces.Example.com")
+	if addr != "bounce-md_abc123@bounces.example.com" {
+		t.Fatalf("VERPAddress = %q", addr)
+	}
+	tests := []struct {
+		addr string
+		id   string
+		ok   bool
+	}{
+		{addr, "abc123", true},
+		{"<" + addr + ">", "abc123", true},
+		{" BOUNCE-MD_abc123@bounces.example.com ", "abc123", true},
+		{"Bounce-Md_x.y@example.com", "x.y", true},
+		{"bounce-md_@example.com", "", false},
+		{"bounce-abc123@example.com", "", false},
+		{"bounce-md_abc123", "", false},
+		{"ann@example.com", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := ParseVERP(tt.addr)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("ParseVERP(%q) = %q, %v; want %q, %v", tt.addr, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	cfg := config.Config{ReturnPathDomain: "bounces.example.com"}
+	tests := []struct {
+		name   string
+		cfg    config.Config
+		domain string
+		id     string
+		want   string
+	}{
+		{"sender without a domain", config.Config{}, "", "abc", "ann@example.com"},
+		{"server-wide domain", cfg, "", "abc", "bounce-md_abc@bounces.example.com"},
+		{"per-message domain wins", cfg, " rp.example.org ", "abc", "bounce-md_abc@rp.example.org"},
+		{"no id", cfg, "", "", "ann@example.com"},
+	}
+	for _, tt := range tests {
+		if got := envelopeSender(tt.cfg, tt.domain, tt.id, "ann@example.com"); got != tt.want {
+			t.Errorf("%s: envelopeSender() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWithReturnPath(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "added",
+			raw:  "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+			want: "Return-Path: <s@example.com>\r\nFrom: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "folded header replaced",
+			raw:  "return-path:\r\n <old@example.com>\r\nFrom: a@example.com\r\n\r\nReturn-Path: in the body\r\n",
+			want: "Return-Path: <s@example.com>\r\nFrom: a@example.com\r\n\r\nReturn-Path: in the body\r\n",
+		},
+		{
+			name: "LF line endings",
+			raw:  "From: a@example.com\nReturn-Path: <old@example.com>\n\tfolded\nSubject: hi\n\nbody\n",
+			want: "Return-Path: <s@example.com>\r\nFrom: a@example.com\nSubject: hi\n\nbody\n",
+		},
+		{
+			name: "last header replaced",
+			raw:  "From: a@example.com\r\nReturn-Path: <old@example.com>\r\n\r\nbody\r\n",
+			want: "Return-Path: <s@example.com>\r\nFrom: a@example.com\r\n\r\nbody\r\n",
+		},
+		{
+			name: "only header replaced",
+			raw:  "Return-Path: <old@example.com>\n\nbody\n",
+			want: "Return-Path: <s@example.com>\r\n\nbody\n",
+		},
+		{
+			name: "no body",
+			raw:  "Return-Path: <old@example.com>\r\nSubject: hi\r\n",
+			want: "Return-Path: <s@example.com>\r\nSubject: hi\r\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(withReturnPath([]byte(tt.raw), "s@example.com")); got != tt.want {
+			t.Errorf("%s: withReturnPath() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
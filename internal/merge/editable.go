@@ -0,0 +1,109 @@
+package merge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// editRe matches an opening tag carrying an mc:edit attribute.
+var editRe = regexp.MustCompile(`(?i)<([a-z][a-z0-9]*)\b[^>]*?\smc:edit\s*=\s*["']([^"']*)["'][^>]*>`)
+
+// EditableRegions returns the names of mc:edit regions in document order.
+func EditableRegions(html string) []string {
+	var out []string
+	for _, m := range editRe.FindAllStringSubmatch(html, -1) {
+		out = append(out, m[2])
+	}
+	return out
+}
+
+// FillEditable replaces the inner HTML of every mc:edit region whose name
+// appears in content, the way Mandrill applies template_content. Regions
+// without a matching entry keep their default content.
+func FillEditable(html string, content map[string]string) string {
+	if len(content) == 0 || !strings.Contains(html, "mc:edit") {
+		return html
+	}
+	var b strings.Builder
+	pos := 0
+	for {
+		loc := editRe.FindStringSubmatchIndex(html[pos:])
+		if loc == nil {
+			break
+		}
+		openEnd := pos + loc[1]
+		tag := html[pos+loc[2] : pos+loc[3]]
+		name := html[pos+loc[4] : pos+loc[5]]
+		val, ok := lookup(content, name)
+		closeStart, closeEnd := matchingClose(html, openEnd, tag)
+		if !ok || closeStart < 0 {
+			b.WriteString(html[pos:openEnd])
+			pos = openEnd
+			continue
+		}
+		b.WriteString(html[pos:openEnd])
+		b.WriteString(val)
+		b.WriteString(html[closeStart:closeEnd])
+		pos = closeEnd
+	}
+	b.WriteString(html[pos:])
+	return b.String()
+}
+
+func lookup(content map[string]string, name string) (string, bool) {
+	if v, ok := content[name]; ok {
+		return v, true
+	}
+	for k, v := range content {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// matchingClose finds the closing tag for an element opened just before
+// from, accounting for nested elements of the same name.
+func matchingClose(html string, from int, tag string) (int, int) {
+	lower := strings.ToLower(html)
+	tag = strings.ToLower(tag)
+	open, closing := "<"+tag, "</"+tag
+	depth := 1
+	i := from
+	for i < len(lower) {
+		next := strings.IndexByte(lower[i:], '<')
+		if next < 0 {
+			return -1, -1
+		}
+		i += next
+		switch {
+		case strings.HasPrefix(lower[i:], closing) && tagBoundary(lower, i+len(closing)):
+			depth--
+			end := strings.IndexByte(lower[i:], '>')
+			if end < 0 {
+				return -1, -1
+			}
+			if depth == 0 {
+				return i, i + end + 1
+			}
+			i += end + 1
+		case strings.HasPrefix(lower[i:], open) && tagBoundary(lower, i+len(open)):
+			depth++
+			i += len(open)
+		default:
+			i++
+		}
+	}
+	return -1, -1
+}
+
+func tagBoundary(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	switch s[i] {
+	case '>', ' ', '\t', '\r', '\n', '/':
+		return true
+	}
+	return false
+}
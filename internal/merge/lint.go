@@ -0,0 +1,302 @@
+package merge
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+var (
+	mcTagRe = regexp.MustCompile(`\*\|([^|*]+?)\|\*`)
+	hbTagRe = regexp.MustCompile(`\{\{\{?\s*(.*?)\s*\}?\}\}`)
+)
+
+// builtinTags are merge tags Mandrill fills on its own, so they never count
+// as missing.
+var builtinTags = map[string]bool{
+	"MC:SUBJECT":      true,
+	"MC:DATE":         true,
+	"CURRENT_YEAR":    true,
+	"UNSUB":           true,
+	"ARCHIVE":         true,
+	"MC_PREVIEW_TEXT": true,
+	"EMAIL":           true,
+}
+
+// builtinPrefixes cover parameterised built-ins such as *|DATE:Y-m-d|*.
+var builtinPrefixes = []string{"DATE:", "UNSUB:", "LIST:"}
+
+// handlebarsHelpers are Mandrill's inline helpers; their arguments are the
+// variables being referenced.
+var handlebarsHelpers = map[string]bool{
+	"upper": true, "lower": true, "title": true, "url": true, "date": true,
+	"striptags": true, "html": true, "base64": true,
+}
+
+// LintInput describes one render or send to be checked.
+type LintInput struct {
+	Language        string              // mailchimp (default) or handlebars
+	Sources         []string            // subject, html and text as authored
+	Vars            []string            // global merge vars
+	RcptVars        map[string][]string // per-recipient merge vars keyed by address
+	Recipients      []string
+	TemplateContent []string // template_content names
+	Shared          bool     // one message for all recipients (preserve_recipients)
+}
+
+// Lint reports merge tags referenced but not supplied, supplied vars that
+// are never used, unbalanced conditional blocks, mc:edit regions that
+// template_content does not fill and per-recipient vars that can't apply
+// because several recipients share one message.
+func Lint(in LintInput) *types.LintReport {
+	rep := &types.LintReport{MissingVars: []string{}, UnusedVars: []string{}, UnbalancedBlocks: []string{}, UnfilledRegions: []string{}, IgnoredRcptVars: []string{}}
+	if in.Shared && len(in.Recipients) > 1 {
+		for rcpt, vs := range in.RcptVars {
+			if len(vs) > 0 {
+				rep.IgnoredRcptVars = append(rep.IgnoredRcptVars, rcpt)
+			}
+		}
+		sort.Strings(rep.IgnoredRcptVars)
+		in.RcptVars = nil
+	}
+
+	refs := map[string]bool{}
+	regions := map[string]bool{}
+	for _, src := range in.Sources {
+		var unbalanced []string
+		if isHandlebars(in.Language) {
+			unbalanced = scanHandlebars(src, refs)
+		} else {
+			unbalanced = scanMailchimp(src, refs)
+		}
+		rep.UnbalancedBlocks = append(rep.UnbalancedBlocks, unbalanced...)
+		for _, r := range EditableRegions(src) {
+			regions[r] = true
+		}
+	}
+
+	global := upperSet(in.Vars)
+	content := upperSet(in.TemplateContent)
+
+	// a tag counts as supplied for a recipient when it is a global var,
+	// a template_content entry or one of that recipient's merge vars
+	missing := map[string]bool{}
+	check := func(extra map[string]bool) {
+		for ref := range refs {
+			if !global[ref] && !content[ref] && !extra[ref] {
+				missing[ref] = true
+			}
+		}
+	}
+	if len(in.Recipients) == 0 {
+		check(nil)
+	}
+	for _, rcpt := range in.Recipients {
+		check(upperSet(rcptVars(in.RcptVars, rcpt)))
+	}
+	rep.MissingVars = sortedKeys(missing)
+
+	used := map[string]bool{}
+	for r := range regions {
+		used[strings.ToUpper(r)] = true
+		if !content[strings.ToUpper(r)] {
+			rep.UnfilledRegions = append(rep.UnfilledRegions, r)
+		}
+	}
+	sort.Strings(rep.UnfilledRegions)
+	for r := range refs {
+		used[r] = true
+	}
+	unused := map[string]bool{}
+	supplied := append(append([]string{}, in.Vars...), in.TemplateContent...)
+	for _, vs := range in.RcptVars {
+		supplied = append(supplied, vs...)
+	}
+	for _, v := range supplied {
+		if !used[strings.ToUpper(v)] {
+			unused[v] = true
+		}
+	}
+	rep.UnusedVars = sortedKeys(unused)
+	rep.OK = len(rep.MissingVars) == 0 && len(rep.UnbalancedBlocks) == 0 && len(rep.UnfilledRegions) == 0 && len(rep.IgnoredRcptVars) == 0
+	return rep
+}
+
+func isHandlebars(lang string) bool {
+	return strings.EqualFold(strings.TrimSpace(lang), "handlebars")
+}
+
+// scanMailchimp records the variables referenced by *|TAG|* merge tags and
+// returns a description of every unbalanced *|IF:|* block.
+func scanMailchimp(src string, refs map[string]bool) []string {
+	var out []string
+	depth := 0
+	for _, m := range mcTagRe.FindAllStringSubmatch(src, -1) {
+		tag := strings.ToUpper(strings.TrimSpace(m[1]))
+		switch {
+		case strings.HasPrefix(tag, "IF:"), strings.HasPrefix(tag, "IFNOT:"):
+			depth++
+			refs[conditionVar(tag[strings.Index(tag, ":")+1:])] = true
+		case strings.HasPrefix(tag, "ELSEIF:"):
+			if depth == 0 {
+				out = append(out, fmt.Sprintf("%s without *|IF:|*", m[0]))
+			}
+			refs[conditionVar(tag[len("ELSEIF:"):])] = true
+		case tag == "ELSE:" || tag == "ELSE":
+			if depth == 0 {
+				out = append(out, fmt.Sprintf("%s without *|IF:|*", m[0]))
+			}
+		case tag == "END:IF":
+			if depth == 0 {
+				out = append(out, fmt.Sprintf("%s without *|IF:|*", m[0]))
+				continue
+			}
+			depth--
+		case strings.HasPrefix(tag, "HTML:"):
+			refs[tag[len("HTML:"):]] = true
+		case isBuiltin(tag):
+		default:
+			refs[tag] = true
+		}
+	}
+	if depth > 0 {
+		out = append(out, fmt.Sprintf("%d *|IF:|* block(s) missing *|END:IF|*", depth))
+	}
+	return out
+}
+
+// conditionVar extracts the variable from conditions like NAME, NAME=x or
+// NAME != x.
+func conditionVar(cond string) string {
+	if i := strings.IndexAny(cond, "=!<>"); i >= 0 {
+		cond = cond[:i]
+	}
+	return strings.TrimSpace(cond)
+}
+
+func isBuiltin(tag string) bool {
+	if builtinTags[tag] {
+		return true
+	}
+	for _, p := range builtinPrefixes {
+		if strings.HasPrefix(tag, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanHandlebars records the root variables referenced by {{expressions}}
+// and returns a description of every unbalanced block.
+func scanHandlebars(src string, refs map[string]bool) []string {
+	var out []string
+	var stack []string
+	eachDepth := 0
+	for _, m := range hbTagRe.FindAllStringSubmatch(src, -1) {
+		expr := strings.TrimSpace(m[1])
+		if expr == "" || strings.HasPrefix(expr, "!") || strings.HasPrefix(expr, ">") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(expr, "#"):
+			fields := strings.Fields(expr[1:])
+			if len(fields) == 0 {
+				continue
+			}
+			stack = append(stack, fields[0])
+			if eachDepth == 0 {
+				addHandlebarsRefs(fields[1:], refs)
+			}
+			if fields[0] == "each" || fields[0] == "with" {
+				eachDepth++
+			}
+		case strings.HasPrefix(expr, "/"):
+			name := strings.TrimSpace(expr[1:])
+			if len(stack) == 0 {
+				out = append(out, fmt.Sprintf("{{/%s}} without {{#%s}}", name, name))
+				continue
+			}
+			top := stack[len(stack)-1]
+			if top != name {
+				out = append(out, fmt.Sprintf("{{/%s}} closes {{#%s}}", name, top))
+			}
+			stack = stack[:len(stack)-1]
+			if top == "each" || top == "with" {
+				eachDepth--
+			}
+		case expr == "else" || strings.HasPrefix(expr, "else "):
+			if len(stack) == 0 {
+				out = append(out, "{{else}} outside a block")
+			}
+			// {{else if x}} references x
+			if fields := strings.Fields(expr); len(fields) > 2 && eachDepth == 0 {
+				addHandlebarsRefs(fields[2:], refs)
+			}
+		default:
+			if eachDepth > 0 {
+				// inside #each the item fields can't be checked
+				continue
+			}
+			fields := strings.Fields(expr)
+			if len(fields) > 1 && handlebarsHelpers[fields[0]] {
+				fields = fields[1:]
+			} else {
+				fields = fields[:1]
+			}
+			addHandlebarsRefs(fields, refs)
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		out = append(out, fmt.Sprintf("{{#%s}} missing {{/%s}}", stack[i], stack[i]))
+	}
+	return out
+}
+
+func addHandlebarsRefs(args []string, refs map[string]bool) {
+	for _, a := range args {
+		if a == "" || a == "this" || a == "else" || strings.HasPrefix(a, "@") ||
+			strings.HasPrefix(a, "\"") || strings.HasPrefix(a, "'") || strings.Contains(a, "=") {
+			continue
+		}
+		if a[0] >= '0' && a[0] <= '9' || a == "true" || a == "false" {
+			continue
+		}
+		a = strings.TrimPrefix(a, "this.")
+		if i := strings.IndexAny(a, ".["); i > 0 {
+			a = a[:i]
+		}
+		refs[strings.ToUpper(a)] = true
+	}
+}
+
+func rcptVars(m map[string][]string, rcpt string) []string {
+	if vs, ok := m[rcpt]; ok {
+		return vs
+	}
+	for k, vs := range m {
+		if strings.EqualFold(k, rcpt) {
+			return vs
+		}
+	}
+	return nil
+}
+
+func upperSet(names []string) map[string]bool {
+	out := make(map[string]bool, len(names))
+	for _, n := range names {
+		out[strings.ToUpper(strings.TrimSpace(n))] = true
+	}
+	return out
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
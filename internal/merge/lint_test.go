@@ -0,0 +1,119 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name string
+		in   LintInput
+		want types.LintReport
+	}{
+		{
+			name: "all supplied",
+			in: LintInput{
+				Sources: []string{"Hi *|NAME|*", "<p>*|IF:VIP|*VIP*|END:IF|* *|DATE:Y|* *|UNSUB|*</p>"},
+				Vars:    []string{"name", "VIP"},
+			},
+			want: types.LintReport{OK: true},
+		},
+		{
+			name: "missing and unused",
+			in: LintInput{
+				Sources: []string{"Hi *|FNAME|* *|HTML:BODY|*"},
+				Vars:    []string{"BODY", "LNAME"},
+			},
+			want: types.LintReport{MissingVars: []string{"FNAME"}, UnusedVars: []string{"LNAME"}},
+		},
+		{
+			name: "recipient without its var",
+			in: LintInput{
+				Sources:    []string{"Hi *|NAME|*"},
+				Recipients: []string{"a@example.com", "b@example.com"},
+				RcptVars:   map[string][]string{"A@example.com": {"NAME"}},
+			},
+			want: types.LintReport{MissingVars: []string{"NAME"}},
+		},
+		{
+			name: "every recipient has its var",
+			in: LintInput{
+				Sources:    []string{"Hi *|NAME|*"},
+				Recipients: []string{"a@example.com", "b@example.com"},
+				RcptVars:   map[string][]string{"a@example.com": {"NAME"}, "b@example.com": {"NAME"}},
+			},
+			want: types.LintReport{OK: true},
+		},
+		{
+			name: "shared message ignores recipient vars",
+			in: LintInput{
+				Sources:    []string{"Hi *|NAME|*"},
+				Recipients: []string{"a@example.com", "b@example.com"},
+				RcptVars:   map[string][]string{"b@example.com": {"NAME"}, "a@example.com": {"NAME"}},
+				Shared:     true,
+			},
+			want: types.LintReport{MissingVars: []string{"NAME"}, IgnoredRcptVars: []string{"a@example.com", "b@example.com"}},
+		},
+		{
+			name: "shared message with one recipient",
+			in: LintInput{
+				Sources:    []string{"Hi *|NAME|*"},
+				Recipients: []string{"a@example.com"},
+				RcptVars:   map[string][]string{"a@example.com": {"NAME"}},
+				Shared:     true,
+			},
+			want: types.LintReport{OK: true},
+		},
+		{
+			name: "mailchimp unbalanced",
+			in: LintInput{
+				Sources: []string{"*|END:IF|* *|IF:A|* *|IF:B|* *|END:IF|*"},
+				Vars:    []string{"A", "B"},
+			},
+			want: types.LintReport{UnbalancedBlocks: []string{"*|END:IF|* without *|IF:|*", "1 *|IF:|* block(s) missing *|END:IF|*"}},
+		},
+		{
+			name: "handlebars",
+			in: LintInput{
+				Language: "handlebars",
+				Sources:  []string{"{{upper name}} {{#each items}}{{sku}}{{/each}} {{#if vip}}x{{else if gold}}y{{/if}} {{user.city}}"},
+				Vars:     []string{"name", "items", "vip", "user", "extra"},
+			},
+			want: types.LintReport{MissingVars: []string{"GOLD"}, UnusedVars: []string{"extra"}},
+		},
+		{
+			name: "handlebars unbalanced",
+			in: LintInput{
+				Language: "handlebars",
+				Sources:  []string{"{{#if a}}{{#each b}}{{/if}} {{/with}} {{#unless c}}"},
+				Vars:     []string{"a", "b", "c"},
+			},
+			want: types.LintReport{UnbalancedBlocks: []string{"{{/if}} closes {{#each}}", "{{/with}} closes {{#if}}", "{{#unless}} missing {{/unless}}"}},
+		},
+		{
+			name: "editable regions",
+			in: LintInput{
+				Sources:         []string{`<div mc:edit="header">H</div><div mc:edit="main">M</div>`},
+				TemplateContent: []string{"MAIN"},
+			},
+			want: types.LintReport{UnfilledRegions: []string{"header"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lint(tt.in)
+			want := tt.want
+			for _, s := range []*[]string{&want.MissingVars, &want.UnusedVars, &want.UnbalancedBlocks, &want.UnfilledRegions, &want.IgnoredRcptVars} {
+				if *s == nil {
+					*s = []string{}
+				}
+			}
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("Lint() = %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
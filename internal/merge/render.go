@@ -0,0 +1,591 @@
+package merge
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Vars flattens global and per-recipient merge vars into a lookup map;
+// recipient vars win over globals with the same name.
+func Vars(global, rcpt []types.MandrillMergeVar) map[string]any {
+	out := make(map[string]any, len(global)+len(rcpt))
+	for _, v := range global {
+		out[v.Name] = v.Content
+	}
+	for _, v := range rcpt {
+		out[v.Name] = v.Content
+	}
+	return out
+}
+
+// RcptVars returns the merge vars given for one recipient address.
+func RcptVars(all []types.MandrillRcptMergeVars, rcpt string) []types.MandrillMergeVar {
+	for _, rv := range all {
+		if strings.EqualFold(strings.TrimSpace(rv.Rcpt), strings.TrimSpace(rcpt)) {
+			return rv.Vars
+		}
+	}
+	return nil
+}
+
+// Render evaluates src with the given merge language (mailchimp by default,
+// or handlebars). Unknown mailchimp tags are left in place; unknown
+// handlebars expressions render empty, as they do in Mandrill.
+func Render(src, language string, vars map[string]any) string {
+	if src == "" {
+		return src
+	}
+	if isHandlebars(language) {
+		return renderHandlebars(src, vars)
+	}
+	return renderMailchimp(src, vars)
+}
+
+// Mailchimp merge language
+
+type mcBranch struct {
+	cond string // empty for *|ELSE:|*
+	neg  bool
+	body []mcNode
+}
+
+type mcNode struct {
+	text     string
+	tag      string // raw tag including *| |*
+	name     string
+	branches []mcBranch // set for conditional blocks
+}
+
+// token is either literal text or a merge tag with its trimmed inner part.
+type token struct {
+	text  string
+	inner string
+	isTag bool
+	raw   bool // handlebars {{{triple-stash}}}
+}
+
+func tokenize(src string, re *regexp.Regexp, inner int) []token {
+	var out []token
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(src, -1) {
+		if m[0] > last {
+			out = append(out, token{text: src[last:m[0]]})
+		}
+		out = append(out, token{text: src[m[0]:m[1]], inner: strings.TrimSpace(src[m[2*inner]:m[2*inner+1]]), isTag: true, raw: m[2] >= 0 && inner > 1})
+		last = m[1]
+	}
+	if last < len(src) {
+		out = append(out, token{text: src[last:]})
+	}
+	return out
+}
+
+type mcParser struct {
+	toks []token
+	pos  int
+}
+
+func renderMailchimp(src string, vars map[string]any) string {
+	p := &mcParser{toks: tokenize(src, mcTagRe, 1)}
+	var b strings.Builder
+	writeMailchimp(&b, p.parse(false), vars)
+	return b.String()
+}
+
+// parse builds nodes until the end of input or, when nested, until the
+// ELSE/ELSEIF/END tag of the enclosing block (which is left unconsumed).
+func (p *mcParser) parse(nested bool) []mcNode {
+	var out []mcNode
+	for p.pos < len(p.toks) {
+		t := p.toks[p.pos]
+		if !t.isTag {
+			out = append(out, mcNode{text: t.text})
+			p.pos++
+			continue
+		}
+		upper := strings.ToUpper(t.inner)
+		switch {
+		case strings.HasPrefix(upper, "IF:"), strings.HasPrefix(upper, "IFNOT:"):
+			p.pos++
+			node := mcNode{tag: t.text}
+			br := mcBranch{cond: t.inner[strings.Index(t.inner, ":")+1:], neg: strings.HasPrefix(upper, "IFNOT:")}
+			for {
+				br.body = p.parse(true)
+				node.branches = append(node.branches, br)
+				if p.pos >= len(p.toks) {
+					break // unterminated block
+				}
+				end := p.toks[p.pos]
+				p.pos++
+				endUpper := strings.ToUpper(end.inner)
+				if endUpper == "END:IF" {
+					break
+				}
+				br = mcBranch{}
+				if strings.HasPrefix(endUpper, "ELSEIF:") {
+					br.cond = end.inner[len("ELSEIF:"):]
+				}
+			}
+			out = append(out, node)
+		case nested && (upper == "END:IF" || upper == "ELSE:" || upper == "ELSE" || strings.HasPrefix(upper, "ELSEIF:")):
+			return out
+		default:
+			out = append(out, mcNode{tag: t.text, name: t.inner})
+			p.pos++
+		}
+	}
+	return out
+}
+
+func writeMailchimp(b *strings.Builder, nodes []mcNode, vars map[string]any) {
+	for _, n := range nodes {
+		switch {
+		case n.branches != nil:
+			for _, br := range n.branches {
+				if br.cond == "" || evalCondition(br.cond, vars) != br.neg {
+					writeMailchimp(b, br.body, vars)
+					break
+				}
+			}
+		case n.tag != "":
+			if v, ok := mailchimpValue(n.name, vars); ok {
+				b.WriteString(v)
+			} else {
+				b.WriteString(n.tag)
+			}
+		default:
+			b.WriteString(n.text)
+		}
+	}
+}
+
+func mailchimpValue(name string, vars map[string]any) (string, bool) {
+	upper := strings.ToUpper(name)
+	switch {
+	case upper == "CURRENT_YEAR":
+		return strconv.Itoa(time.Now().Year()), true
+	case upper == "MC:DATE":
+		return time.Now().Format("01/02/2006"), true
+	case strings.HasPrefix(upper, "DATE:"):
+		return formatDate(time.Now(), name[len("DATE:"):]), true
+	case strings.HasPrefix(upper, "HTML:"):
+		name = name[len("HTML:"):]
+	}
+	v, ok := lookupFold(vars, name)
+	if !ok {
+		return "", false
+	}
+	return stringify(v), true
+}
+
+var condRe = regexp.MustCompile(`^\s*([^=!<>]+?)\s*(==|=|!=|>=|<=|>|<)\s*(.*?)\s*$`)
+
+// evalCondition evaluates NAME, NAME=value, NAME!=value and numeric
+// comparisons against vars.
+func evalCondition(cond string, vars map[string]any) bool {
+	m := condRe.FindStringSubmatch(cond)
+	if m == nil {
+		v, ok := lookupFold(vars, strings.TrimSpace(cond))
+		return ok && truthy(v)
+	}
+	v, _ := lookupFold(vars, m[1])
+	left := stringify(v)
+	right := strings.Trim(m[3], `"'`)
+	switch m[2] {
+	case "=", "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+	lf, err1 := strconv.ParseFloat(left, 64)
+	rf, err2 := strconv.ParseFloat(right, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	switch m[2] {
+	case ">":
+		return lf > rf
+	case "<":
+		return lf < rf
+	case ">=":
+		return lf >= rf
+	default:
+		return lf <= rf
+	}
+}
+
+// formatDate supports the common PHP date() letters used in *|DATE:|* tags.
+func formatDate(t time.Time, format string) string {
+	repl := map[byte]string{
+		'Y': "2006", 'y': "06", 'm': "01", 'n': "1", 'd': "02", 'j': "2",
+		'H': "15", 'G': "15", 'i': "04", 's': "05", 'M': "Jan", 'F': "January",
+		'D': "Mon", 'l': "Monday", 'A': "PM", 'a': "pm",
+	}
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if r, ok := repl[format[i]]; ok {
+			layout.WriteString(r)
+		} else {
+			layout.WriteByte(format[i])
+		}
+	}
+	return t.Format(layout.String())
+}
+
+// Handlebars merge language
+
+var hbTokenRe = regexp.MustCompile(`(?s)\{\{(\{)?\s*(.*?)\s*\}?\}\}`)
+
+type hbNode struct {
+	text    string
+	expr    string
+	raw     bool
+	block   string // if, unless, each, with
+	arg     string
+	body    []hbNode
+	inverse []hbNode
+}
+
+type hbParser struct {
+	toks []token
+	pos  int
+}
+
+func renderHandlebars(src string, vars map[string]any) string {
+	p := &hbParser{toks: tokenize(src, hbTokenRe, 2)}
+	var b strings.Builder
+	writeHandlebars(&b, p.parse(false), &hbScope{data: vars})
+	return b.String()
+}
+
+// parse builds nodes until the end of input or, inside a block, until its
+// {{else}} or closing tag (which is left unconsumed).
+func (p *hbParser) parse(inBlock bool) []hbNode {
+	var out []hbNode
+	for p.pos < len(p.toks) {
+		t := p.toks[p.pos]
+		if !t.isTag {
+			out = append(out, hbNode{text: t.text})
+			p.pos++
+			continue
+		}
+		expr := t.inner
+		switch {
+		case strings.HasPrefix(expr, "!"):
+			p.pos++
+		case strings.HasPrefix(expr, "#"):
+			p.pos++
+			fields := strings.Fields(expr[1:])
+			if len(fields) == 0 {
+				continue
+			}
+			node := hbNode{block: fields[0], arg: strings.TrimSpace(strings.TrimPrefix(expr[1:], fields[0]))}
+			node.body = p.parse(true)
+			node.inverse = p.parseInverse()
+			out = append(out, node)
+		case strings.HasPrefix(expr, "/"), expr == "else" || strings.HasPrefix(expr, "else "):
+			if inBlock {
+				return out
+			}
+			p.pos++ // stray closing tag
+		default:
+			out = append(out, hbNode{expr: expr, raw: t.raw})
+			p.pos++
+		}
+	}
+	return out
+}
+
+// parseInverse consumes what follows a block body: the closing tag, or an
+// {{else}} section. "{{else if x}}" chains become a nested block that
+// shares the outer closing tag.
+func (p *hbParser) parseInverse() []hbNode {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	if strings.HasPrefix(t.inner, "/") {
+		return nil
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(t.inner, "else"))
+	if rest == "" {
+		body := p.parse(true)
+		p.parseInverse()
+		return body
+	}
+	fields := strings.Fields(rest)
+	node := hbNode{block: fields[0], arg: strings.TrimSpace(strings.TrimPrefix(rest, fields[0]))}
+	node.body = p.parse(true)
+	node.inverse = p.parseInverse()
+	return []hbNode{node}
+}
+
+type hbScope struct {
+	data   any
+	parent *hbScope
+	index  int
+	first  bool
+	last   bool
+	inEach bool
+}
+
+func writeHandlebars(b *strings.Builder, nodes []hbNode, sc *hbScope) {
+	for _, n := range nodes {
+		switch {
+		case n.block != "":
+			writeBlock(b, n, sc)
+		case n.expr != "":
+			v := evalExpr(n.expr, sc)
+			if n.raw {
+				b.WriteString(v)
+			} else {
+				b.WriteString(html.EscapeString(v))
+			}
+		default:
+			b.WriteString(n.text)
+		}
+	}
+}
+
+func writeBlock(b *strings.Builder, n hbNode, sc *hbScope) {
+	v, _ := resolve(n.arg, sc)
+	switch n.block {
+	case "if":
+		if truthy(v) {
+			writeHandlebars(b, n.body, sc)
+		} else {
+			writeHandlebars(b, n.inverse, sc)
+		}
+	case "unless":
+		if !truthy(v) {
+			writeHandlebars(b, n.body, sc)
+		} else {
+			writeHandlebars(b, n.inverse, sc)
+		}
+	case "with":
+		if truthy(v) {
+			writeHandlebars(b, n.body, &hbScope{data: v, parent: sc})
+		} else {
+			writeHandlebars(b, n.inverse, sc)
+		}
+	case "each":
+		items, _ := v.([]any)
+		if len(items) == 0 {
+			writeHandlebars(b, n.inverse, sc)
+			return
+		}
+		for i, it := range items {
+			writeHandlebars(b, n.body, &hbScope{data: it, parent: sc, index: i, first: i == 0, last: i == len(items)-1, inEach: true})
+		}
+	}
+}
+
+// evalExpr renders a plain {{expression}}, which is either a path or one of
+// Mandrill's inline helpers followed by its arguments.
+func evalExpr(expr string, sc *hbScope) string {
+	fields := splitArgs(expr)
+	if len(fields) == 0 {
+		return ""
+	}
+	if len(fields) == 1 && fields[0] != "date" {
+		v, _ := resolve(fields[0], sc)
+		return stringify(v)
+	}
+	arg := func(i int) string {
+		if i >= len(fields) {
+			return ""
+		}
+		v, _ := resolve(fields[i], sc)
+		return stringify(v)
+	}
+	switch fields[0] {
+	case "upper":
+		return strings.ToUpper(arg(1))
+	case "lower":
+		return strings.ToLower(arg(1))
+	case "title":
+		return titleCase(arg(1))
+	case "url":
+		return url.QueryEscape(arg(1))
+	case "html":
+		return arg(1)
+	case "striptags":
+		return stripTags(arg(1))
+	case "date":
+		format := "d/m/Y"
+		if len(fields) > 1 {
+			format = arg(1)
+		}
+		return formatDate(time.Now(), format)
+	}
+	v, _ := resolve(fields[0], sc)
+	return stringify(v)
+}
+
+// resolve looks up a path (a.b, this, this.x, ../x, @index or a quoted
+// literal) in the current scope chain.
+func resolve(path string, sc *hbScope) (any, bool) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, false
+	}
+	if n := len(path); n >= 2 && (path[0] == '"' && path[n-1] == '"' || path[0] == '\'' && path[n-1] == '\'') {
+		return path[1 : n-1], true
+	}
+	if f, err := strconv.ParseFloat(path, 64); err == nil {
+		return f, true
+	}
+	switch path {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "@index":
+		return float64(sc.index), sc.inEach
+	case "@first":
+		return sc.first, sc.inEach
+	case "@last":
+		return sc.last, sc.inEach
+	}
+	for strings.HasPrefix(path, "../") && sc.parent != nil {
+		sc = sc.parent
+		path = path[3:]
+	}
+	if path == "this" || path == "." {
+		return sc.data, true
+	}
+	path = strings.TrimPrefix(path, "this.")
+	parts := strings.Split(path, ".")
+	for s := sc; s != nil; s = s.parent {
+		if v, ok := walk(s.data, parts); ok {
+			return v, true
+		}
+		if strings.HasPrefix(path, "this") {
+			break
+		}
+	}
+	return nil, false
+}
+
+func walk(data any, parts []string) (any, bool) {
+	cur := data
+	for _, p := range parts {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func splitArgs(expr string) []string {
+	var out []string
+	var cur strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			cur.WriteByte(c)
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			cur.WriteByte(c)
+		case c == ' ' || c == '\t' || c == '\n':
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// Shared helpers
+
+func lookupFold(vars map[string]any, name string) (any, bool) {
+	name = strings.TrimSpace(name)
+	if v, ok := vars[name]; ok {
+		return v, true
+	}
+	for k, v := range vars {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func truthy(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case float64:
+		return t != 0
+	case int:
+		return t != 0
+	case []any:
+		return len(t) > 0
+	case map[string]any:
+		return len(t) > 0
+	}
+	return true
+}
+
+func stringify(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(t)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		_, n := utf8.DecodeRuneInString(w)
+		words[i] = strings.ToUpper(w[:n]) + strings.ToLower(w[n:])
+	}
+	return strings.Join(words, " ")
+}
+
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+
+func stripTags(s string) string {
+	return tagRe.ReplaceAllString(s, "")
+}
@@ -0,0 +1,96 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+func TestRenderMailchimp(t *testing.T) {
+	vars := map[string]any{"NAME": "Ann", "plan": "pro", "COUNT": "3", "EMPTY": "", "LINK": "<b>x</b>"}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"var", "Hi *|NAME|*!", "Hi Ann!"},
+		{"case-insensitive name", "*|name|* on *|PLAN|*", "Ann on pro"},
+		{"unknown tag kept", "Hi *|MISSING|*", "Hi *|MISSING|*"},
+		{"html prefix", "*|HTML:LINK|*", "<b>x</b>"},
+		{"if", "*|IF:NAME|*yes*|END:IF|*", "yes"},
+		{"if empty", "*|IF:EMPTY|*yes*|ELSE:|*no*|END:IF|*", "no"},
+		{"if not", "*|IFNOT:EMPTY|*none*|END:IF|*", "none"},
+		{"equals", "*|IF:PLAN=pro|*P*|ELSEIF:PLAN=free|*F*|END:IF|*", "P"},
+		{"elseif", "*|IF:PLAN=free|*F*|ELSEIF:PLAN=pro|*P*|END:IF|*", "P"},
+		{"numeric", "*|IF:COUNT>2|*many*|ELSE:|*few*|END:IF|*", "many"},
+		{"nested", "*|IF:NAME|*[*|IF:EMPTY|*a*|ELSE:|*b*|END:IF|*]*|END:IF|*", "[b]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src, "mailchimp", vars); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderHandlebars(t *testing.T) {
+	vars := map[string]any{
+		"name":  "ann lee",
+		"html":  "<b>x</b>",
+		"vip":   true,
+		"items": []any{map[string]any{"sku": "a"}, map[string]any{"sku": "b"}},
+		"user":  map[string]any{"city": "Lima"},
+		"title": "élan vital",
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"var", "Hi {{name}}", "Hi ann lee"},
+		{"escaped", "{{html}}", "&lt;b&gt;x&lt;/b&gt;"},
+		{"raw", "{{{html}}}", "<b>x</b>"},
+		{"unknown renders empty", "[{{missing}}]", "[]"},
+		{"path", "{{user.city}}", "Lima"},
+		{"if else", "{{#if vip}}VIP{{else}}regular{{/if}}", "VIP"},
+		{"unless", "{{#unless vip}}regular{{/unless}}", ""},
+		{"each", "{{#each items}}{{sku}}{{@index}},{{/each}}", "a0,b1,"},
+		{"each parent", "{{#each items}}{{../user.city}}{{/each}}", "LimaLima"},
+		{"with", "{{#with user}}{{city}}{{/with}}", "Lima"},
+		{"upper", "{{upper name}}", "ANN LEE"},
+		{"title", "{{title name}}", "Ann Lee"},
+		{"title multibyte", "{{title title}}", "Élan Vital"},
+		{"url", "{{url name}}", "ann+lee"},
+		{"striptags", "{{striptags html}}", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src, "handlebars", vars); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	global := []types.MandrillMergeVar{{Name: "NAME", Content: "everyone"}, {Name: "PLAN", Content: "free"}}
+	all := []types.MandrillRcptMergeVars{
+		{Rcpt: "a@example.com", Vars: []types.MandrillMergeVar{{Name: "NAME", Content: "Ann"}}},
+		{Rcpt: "b@example.com", Vars: []types.MandrillMergeVar{{Name: "NAME", Content: "Bob"}}},
+	}
+	tests := []struct {
+		rcpt string
+		want string
+	}{
+		{"a@example.com", "Ann/free"},
+		{" B@Example.com ", "Bob/free"},
+		{"c@example.com", "everyone/free"},
+	}
+	for _, tt := range tests {
+		vars := Vars(global, RcptVars(all, tt.rcpt))
+		if got := Render("*|NAME|*/*|PLAN|*", "", vars); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.rcpt, got, tt.want)
+		}
+	}
+}
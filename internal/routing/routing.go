@@ -0,0 +1,174 @@
+package routing
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+// Default is the upstream named by TRANSPORT, used when no rule matches.
+const Default = "default"
+
+// Fields a rule can match on.
+const (
+	Domain     = "domain"
+	Subaccount = "subaccount"
+	Tag        = "tag"
+	IPPool     = "ip_pool"
+	Key        = "key"
+	Any        = "*"
+)
+
+// Message is what rules match on besides the recipient.
+type Message struct {
+	Subaccount string
+	Tags       []string
+	IPPool     string
+	Key        string
+}
+
+// Rule sends matching recipients to Upstreams: the first one, then the
+// rest in order when it fails.
+type Rule struct {
+	Field     string
+	Pattern   string
+	Upstreams []string
+}
+
+// ParseUpstream reads an upstream written as name=transport, e.g.
+// "internal=smtp://relay.internal:25" or "capture=maildir:/tmp/mail".
+func ParseUpstream(spec string) (name, transport string, err error) {
+	name, transport, ok := strings.Cut(spec, "=")
+	name, transport = strings.TrimSpace(name), strings.TrimSpace(transport)
+	if !ok || name == "" || transport == "" {
+		return "", "", fmt.Errorf("upstream %q: want name=transport", spec)
+	}
+	return name, transport, nil
+}
+
+// Parse reads a rule written as field:pattern=upstream[|failover...] or
+// *=upstream[|failover...], e.g. "domain:*.internal.test=internal|backup".
+// Patterns may use * and ? wildcards.
+func Parse(spec string) (Rule, error) {
+	sel, ups, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	if !ok {
+		return Rule{}, fmt.Errorf("route %q: want field:pattern=upstream", spec)
+	}
+	var r Rule
+	if sel = strings.TrimSpace(sel); sel == Any {
+		r.Field = Any
+	} else {
+		field, pattern, _ := strings.Cut(sel, ":")
+		r.Field = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(field)), "-", "_")
+		r.Pattern = strings.TrimSpace(pattern)
+		switch r.Field {
+		case Domain, Subaccount, Tag, IPPool, Key:
+		default:
+			return Rule{}, fmt.Errorf("route %q: unknown field %q", spec, r.Field)
+		}
+		if r.Pattern == "" {
+			return Rule{}, fmt.Errorf("route %q: missing pattern", spec)
+		}
+		if r.Field == Domain {
+			r.Pattern = strings.ToLower(r.Pattern)
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return Rule{}, fmt.Errorf("route %q: %w", spec, err)
+		}
+	}
+	for _, u := range strings.Split(ups, "|") {
+		if u = strings.TrimSpace(u); u != "" {
+			r.Upstreams = append(r.Upstreams, u)
+		}
+	}
+	if len(r.Upstreams) == 0 {
+		return Rule{}, fmt.Errorf("route %q: no upstream", spec)
+	}
+	return r, nil
+}
+
+// Router picks the upstreams for each recipient.
+type Router struct {
+	upstreams map[string]string
+	rules     []Rule
+}
+
+// New reads cfg.Upstreams and cfg.Routes. Every upstream a route names
+// must be defined.
+func New(cfg config.Config) (*Router, error) {
+	rt := &Router{upstreams: map[string]string{Default: cfg.Transport}}
+	for _, s := range cfg.Upstreams {
+		name, transport, err := ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		rt.upstreams[name] = transport
+	}
+	for _, s := range cfg.Routes {
+		r, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range r.Upstreams {
+			if _, ok := rt.upstreams[u]; !ok {
+				return nil, fmt.Errorf("route %q: unknown upstream %q", s, u)
+			}
+		}
+		rt.rules = append(rt.rules, r)
+	}
+	return rt, nil
+}
+
+// Transports returns every upstream's transport spec by name.
+func (rt *Router) Transports() map[string]string {
+	out := make(map[string]string, len(rt.upstreams))
+	for k, v := range rt.upstreams {
+		out[k] = v
+	}
+	return out
+}
+
+// Transport returns the transport spec of the named upstream.
+func (rt *Router) Transport(name string) string {
+	return rt.upstreams[name]
+}
+
+// Route returns the upstreams for rcpt of m in the order to try them. The
+// first matching rule wins; with none, it is the default upstream.
+func (rt *Router) Route(m Message, rcpt string) []string {
+	for _, r := range rt.rules {
+		if r.matches(m, rcpt) {
+			return r.Upstreams
+		}
+	}
+	return []string{Default}
+}
+
+func (r Rule) matches(m Message, rcpt string) bool {
+	match := func(v string) bool {
+		ok, _ := path.Match(r.Pattern, v)
+		return ok
+	}
+	switch r.Field {
+	case Any:
+		return true
+	case Domain:
+		_, domain, _ := strings.Cut(strings.ToLower(strings.TrimSpace(rcpt)), "@")
+		return match(domain)
+	case Subaccount:
+		return match(m.Subaccount)
+	case IPPool:
+		return match(m.IPPool)
+	case Key:
+		return match(m.Key)
+	case Tag:
+		for _, t := range m.Tags {
+			if match(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
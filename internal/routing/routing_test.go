@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Rule
+		wantErr bool
+	}{
+		{spec: "domain:*.Internal.test=internal|backup", want: Rule{Field: Domain, Pattern: "*.internal.test", Upstreams: []string{"internal", "backup"}}},
+		{spec: " * = capture ", want: Rule{Field: Any, Upstreams: []string{"capture"}}},
+		{spec: "ip-pool:Main=internal", want: Rule{Field: IPPool, Pattern: "Main", Upstreams: []string{"internal"}}},
+		{spec: "tag:password-*=a||b|", want: Rule{Field: Tag, Pattern: "password-*", Upstreams: []string{"a", "b"}}},
+		{spec: "subaccount:acme=a", want: Rule{Field: Subaccount, Pattern: "acme", Upstreams: []string{"a"}}},
+		{spec: "key:test-?=a", want: Rule{Field: Key, Pattern: "test-?", Upstreams: []string{"a"}}},
+		{spec: "domain:x.test", wantErr: true},
+		{spec: "domain:x.test=", wantErr: true},
+		{spec: "domain:=a", wantErr: true},
+		{spec: "sender:x=a", wantErr: true},
+		{spec: "domain:[x=a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %+v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "defined upstreams", cfg: config.Config{Upstreams: []string{"a=null", "b=stdout"}, Routes: []string{"*=a|b|default"}}},
+		{name: "unknown upstream", cfg: config.Config{Upstreams: []string{"a=null"}, Routes: []string{"*=a|b"}}, wantErr: true},
+		{name: "bad upstream", cfg: config.Config{Upstreams: []string{"a"}}, wantErr: true},
+		{name: "bad route", cfg: config.Config{Routes: []string{"*"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("%s: New() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	rt, err := New(config.Config{
+		Transport: "smtp",
+		Upstreams: []string{"internal=smtp://relay.internal:25", "backup=maildir:/tmp/mail", "capture=capture"},
+		Routes: []string{
+			"domain:*.internal.test=internal|backup",
+			"tag:receipt=backup",
+			"ip_pool:bulk=capture|internal|backup",
+			"key:test-*=capture",
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	tests := []struct {
+		name string
+		msg  Message
+		rcpt string
+		want []string
+	}{
+		{"domain with failover", Message{}, "A@Mail.Internal.test", []string{"internal", "backup"}},
+		{"domain is not a suffix match", Message{}, "a@internal.test", []string{Default}},
+		{"tag", Message{Tags: []string{"welcome", "receipt"}}, "a@example.com", []string{"backup"}},
+		{"first matching rule wins", Message{Tags: []string{"receipt"}}, "a@x.internal.test", []string{"internal", "backup"}},
+		{"ip pool", Message{IPPool: "bulk"}, "a@example.com", []string{"capture", "internal", "backup"}},
+		{"key", Message{Key: "test-123"}, "a@example.com", []string{"capture"}},
+		{"no match", Message{Key: "live"}, "a@example.com", []string{Default}},
+	}
+	for _, tt := range tests {
+		if got := rt.Route(tt.msg, tt.rcpt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Route() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := rt.Transport("backup"); got != "maildir:/tmp/mail" {
+		t.Errorf("Transport(backup) = %q", got)
+	}
+	if got := rt.Transport(Default); got != "smtp" {
+		t.Errorf("Transport(default) = %q", got)
+	}
+}
@@ -1,12 +1,11 @@
 package scheduler
 
 import (
-	"log"
 	"sync/atomic"
 	"time"
 
 	"github.com/jerson/mandrillfordev/internal/config"
-	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/delivery"
 	"github.com/jerson/mandrillfordev/internal/store"
 	"github.com/jerson/mandrillfordev/internal/types"
 )
@@ -14,12 +13,13 @@ import (
 type Scheduler struct {
 	cfg   config.Config
 	store *store.Store
+	queue *delivery.Queue
 	stop  chan struct{}
 	alive atomic.Bool
 }
 
-func NewScheduler(cfg config.Config, st *store.Store) *Scheduler {
-	return &Scheduler{cfg: cfg, store: st, stop: make(chan struct{})}
+func NewScheduler(cfg config.Config, st *store.Store, q *delivery.Queue) *Scheduler {
+	return &Scheduler{cfg: cfg, store: st, queue: q, stop: make(chan struct{})}
 }
 
 func (s *Scheduler) Start() {
@@ -53,23 +53,20 @@ func (s *Scheduler) tick() {
 	now := time.Now()
 	for _, m := range items {
 		if m.ScheduledAt != nil && !m.ScheduledAt.After(now) {
-			// due: attempt send
-			go func(mr *types.MessageRecord) {
-				if _, ok := s.store.RemoveScheduled(mr.ID); !ok {
-					return
-				}
-				// Send
-				if err := mailer.SendMessage(s.cfg, mr.Message, mr.ID, &mr.Raw); err != nil {
-					mr.Status = "rejected"
-					mr.RejectReason = err.Error()
-					log.Printf("scheduled send failed id=%s: %v", mr.ID, err)
-				} else {
-					now := time.Now()
-					mr.SentAt = &now
-					mr.Status = "sent"
-				}
-				s.store.SaveMessage(mr)
-			}(m)
+			// due: hand over to the delivery queue
+			if _, ok := s.store.RemoveScheduled(m.ID); !ok {
+				continue
+			}
+			// The job is built from a copy: the stored record is shared
+			// with readers and may only change under the store lock.
+			var rec types.MessageRecord
+			s.store.UpdateMessage(m.ID, func(m *types.MessageRecord) {
+				m.Status = "queued"
+				rec = *m
+			})
+			job := s.queue.NewJob(&rec)
+			s.store.UpdateMessage(m.ID, func(m *types.MessageRecord) { m.Raw, m.Redirect = rec.Raw, rec.Redirect })
+			s.queue.Enqueue(job)
 		}
 	}
 }
@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/delivery"
+	"github.com/jerson/mandrillfordev/internal/mailer"
+	"github.com/jerson/mandrillfordev/internal/routing"
+	"github.com/jerson/mandrillfordev/internal/store"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// TestTick hands a due message to the queue while another goroutine reads
+// it under the store lock; with -race, any write to the stored record
+// outside that lock is reported.
+func TestTick(t *testing.T) {
+	cfg := config.Config{Transport: "null", QueueSize: 4}
+	m, err := mailer.New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := routing.New(cfg)
+	st := store.NewStore()
+	q := delivery.NewQueue(cfg, st, m, rt, nil)
+	s := NewScheduler(cfg, st, q)
+
+	due := time.Now().Add(-time.Second)
+	later := time.Now().Add(time.Hour)
+	st.AddScheduled(&types.MessageRecord{ID: "due", Status: "scheduled", ScheduledAt: &due, To: []string{"a@x.test"},
+		Message: types.MandrillMessage{FromEmail: "s@example.com", Subject: "hi", Text: "body", To: []types.MandrillRecipient{{Email: "a@x.test"}}}})
+	st.AddScheduled(&types.MessageRecord{ID: "later", Status: "scheduled", ScheduledAt: &later})
+
+	var wg sync.WaitGroup
+	started, done := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			st.UpdateMessage("due", func(m *types.MessageRecord) { _, _ = len(m.Raw), m.Redirect })
+		}
+	}()
+	<-started
+	s.tick()
+	close(done)
+	wg.Wait()
+
+	if q.Len() != 1 {
+		t.Fatalf("queue has %d jobs, want 1", q.Len())
+	}
+	rec, _ := st.GetMessage("due")
+	if rec.Status != "queued" || len(rec.Raw) == 0 {
+		t.Errorf("due: status %q, %d bytes of raw, want queued with the built message", rec.Status, len(rec.Raw))
+	}
+	if _, ok := st.GetScheduled("due"); ok {
+		t.Error("due is still scheduled")
+	}
+	if _, ok := st.GetScheduled("later"); !ok {
+		t.Error("later was taken off the schedule")
+	}
+}
@@ -0,0 +1,275 @@
+package simulate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/bounce"
+)
+
+// Actions a rule can take for a matching recipient.
+const (
+	Deliver    = "deliver"
+	HardBounce = "hard_bounce"
+	SoftBounce = "soft_bounce"
+	Defer      = "defer"
+	Reject     = "reject"
+	Spam       = "spam"
+	Open       = "open"
+)
+
+// Rule gives recipients matching Pattern a fixed outcome.
+type Rule struct {
+	Pattern string
+	Action  string
+	// Count is the number of deferrals before a deferred recipient is
+	// delivered.
+	Count int
+	// Delay is the time between delivery and a bounce, complaint or open,
+	// or between deferral attempts.
+	Delay time.Duration
+	// Detail is the bounce_description of a bounce or the reject_reason of
+	// a reject.
+	Detail string
+}
+
+// defaults are the built-in test addresses, checked after configured rules.
+var defaults = []string{
+	"hard-bounce+*@=hard_bounce",
+	"soft-bounce+*@=soft_bounce",
+	"soft+*@=defer",
+	"defer+*@=defer",
+	"spam+*@=spam",
+	"reject+*@=reject",
+	"open+*@=open",
+}
+
+// Parse reads a rule written as pattern=action[:arg...]. Arguments may be
+// given in any order: a number is a count, a duration (5s, 1m) a delay and
+// anything else a detail, e.g. "soft+*@example.com=defer:3:10s" or
+// "*@bad.test=hard_bounce:invalid_domain".
+func Parse(spec string) (Rule, error) {
+	pattern, action, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if !ok || pattern == "" {
+		return Rule{}, fmt.Errorf("simulate: %q: want pattern=action", spec)
+	}
+	args := strings.Split(action, ":")
+	r := Rule{Pattern: pattern, Action: strings.ReplaceAll(strings.ToLower(strings.TrimSpace(args[0])), "-", "_")}
+	switch r.Action {
+	case Defer:
+		r.Count, r.Delay = 3, 5*time.Second
+	case Spam:
+		r.Delay = 5 * time.Second
+	case Open:
+		r.Delay = time.Second
+	case HardBounce:
+		r.Detail = "bad_mailbox"
+	case SoftBounce:
+		r.Detail = "mailbox_full"
+	case Reject:
+		r.Detail = "rule"
+	case Deliver:
+	default:
+		return Rule{}, fmt.Errorf("simulate: %q: unknown action %q", spec, r.Action)
+	}
+	for _, a := range args[1:] {
+		a = strings.TrimSpace(a)
+		if n, err := strconv.Atoi(a); err == nil && n >= 0 {
+			r.Count = n
+		} else if d, err := time.ParseDuration(a); err == nil && d >= 0 {
+			r.Delay = d
+		} else if a != "" {
+			r.Detail = a
+		}
+	}
+	return r, nil
+}
+
+// ParseAll parses configured rules followed, when withDefaults is set, by
+// the built-in test addresses.
+func ParseAll(specs []string, withDefaults bool) (Rules, error) {
+	if withDefaults {
+		specs = append(append([]string(nil), specs...), defaults...)
+	}
+	out := make(Rules, 0, len(specs))
+	for _, s := range specs {
+		r, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Rules is an ordered rule list; the first matching rule wins.
+type Rules []Rule
+
+// Match returns the rule for addr, if any.
+func (rs Rules) Match(addr string) (Rule, bool) {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	for _, r := range rs {
+		if matchAddress(r.Pattern, addr) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Bounce describes the bounce a bounce rule produces for rcpt.
+func (r Rule) Bounce(rcpt string) bounce.Recipient {
+	b := bounce.Recipient{Email: rcpt, Action: "failed", Description: r.Detail, Hard: r.Action == HardBounce}
+	code, status, text := 550, "5.0.0", "Delivery failed"
+	switch r.Detail {
+	case "bad_mailbox":
+		status, text = "5.1.1", "Recipient address rejected: User unknown"
+	case "invalid_domain":
+		status, text = "5.1.2", "Host or domain name not found"
+	case "mailbox_full":
+		code, status, text = 552, "5.2.2", "Mailbox full"
+	case "message_too_large":
+		code, status, text = 552, "5.3.4", "Message size exceeds fixed limit"
+	case "spam_related":
+		status, text = "5.7.1", "Message rejected as spam"
+	case "policy_related":
+		status, text = "5.7.1", "Message rejected by policy"
+	}
+	if !b.Hard {
+		code, status = code-100, "4"+status[1:]
+	}
+	b.Status = status
+	b.Diagnostic = fmt.Sprintf("%d %s <%s>: %s", code, status, rcpt, text)
+	return b
+}
+
+// matchAddress matches addr against a pattern where * is a wildcard. A
+// pattern ending in "@" matches any domain, one without "@" is a local
+// part, and a local part ending in "+*" also matches the address without
+// a tag.
+func matchAddress(pattern, addr string) bool {
+	if !strings.Contains(pattern, "@") {
+		pattern += "@"
+	}
+	if strings.HasSuffix(pattern, "@") {
+		pattern += "*"
+	}
+	if glob(pattern, addr) {
+		return true
+	}
+	local, domain, _ := strings.Cut(pattern, "@")
+	if base, ok := strings.CutSuffix(local, "+*"); ok {
+		return glob(base+"@"+domain, addr)
+	}
+	return false
+}
+
+func glob(pattern, s string) bool {
+	star, next := -1, 0
+	p := 0
+	for i := 0; i < len(s); {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Header carries per-message directives in message.headers, e.g.
+// "X-MandrillDev-Simulate: reject=spam" or "open-after=2s; delay=5s".
+const Header = "X-MandrillDev-Simulate"
+
+// Directives force an outcome for one message.
+type Directives struct {
+	// Rule applies to every recipient, ahead of the address rules.
+	Rule *Rule
+	// Delay holds delivery, like a slow upstream.
+	Delay time.Duration
+	// SMTPError fails the SMTP transaction with this reply ("451", "550
+	// 5.7.1 Blocked").
+	SMTPError string
+}
+
+// FromHeaders reads the directives in a message's headers, if any.
+func FromHeaders(headers map[string]string) (Directives, error) {
+	for k, v := range headers {
+		if strings.EqualFold(strings.TrimSpace(k), Header) {
+			return ParseDirectives(v)
+		}
+	}
+	return Directives{}, nil
+}
+
+// ParseDirectives reads a ';' or ','-separated directive list.
+func ParseDirectives(v string) (Directives, error) {
+	var d Directives
+	for _, part := range strings.FieldsFunc(v, func(r rune) bool { return r == ';' || r == ',' }) {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name, arg = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(arg)
+		var rule string
+		switch name {
+		case "":
+			continue
+		case "delay":
+			dur, err := time.ParseDuration(arg)
+			if err != nil || dur < 0 {
+				return d, fmt.Errorf("%s: delay: invalid duration %q", Header, arg)
+			}
+			d.Delay = dur
+			continue
+		case "smtp-error":
+			if code, err := strconv.Atoi(strings.Fields(arg + " ")[0]); err != nil || code < 400 || code > 599 {
+				return d, fmt.Errorf("%s: smtp-error: want a 4xx or 5xx reply, got %q", Header, arg)
+			}
+			d.SMTPError = arg
+			continue
+		case "open-after", "spam-after":
+			if dur, err := time.ParseDuration(arg); err != nil || dur < 0 {
+				return d, fmt.Errorf("%s: %s: invalid duration %q", Header, name, arg)
+			}
+			rule = strings.TrimSuffix(name, "-after") + ":" + arg
+		case "defer":
+			if n, err := strconv.Atoi(arg); arg != "" && (err != nil || n < 0) {
+				return d, fmt.Errorf("%s: defer: invalid count %q", Header, arg)
+			}
+			rule = Defer + ":" + arg
+		case "reject", "hard-bounce", "soft-bounce", "deliver":
+			rule = name + ":" + arg
+		default:
+			return d, fmt.Errorf("%s: unknown directive %q", Header, name)
+		}
+		if d.Rule != nil {
+			return d, fmt.Errorf("%s: more than one outcome", Header)
+		}
+		r, err := Parse("*=" + rule)
+		if err != nil {
+			return d, err
+		}
+		d.Rule = &r
+	}
+	return d, nil
+}
+
+// Rules returns base with the directive's rule, if any, in front.
+func (d Directives) Rules(base Rules) Rules {
+	if d.Rule == nil {
+		return base
+	}
+	return append(Rules{*d.Rule}, base...)
+}
@@ -0,0 +1,157 @@
+package simulate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Rule
+		wantErr bool
+	}{
+		{spec: "*@bad.test=hard_bounce", want: Rule{Pattern: "*@bad.test", Action: HardBounce, Detail: "bad_mailbox"}},
+		{spec: " *@Bad.test = hard-bounce:invalid_domain", want: Rule{Pattern: "*@bad.test", Action: HardBounce, Detail: "invalid_domain"}},
+		{spec: "soft+*@example.com=defer", want: Rule{Pattern: "soft+*@example.com", Action: Defer, Count: 3, Delay: 5 * time.Second}},
+		{spec: "soft+*@example.com=defer:10s:1", want: Rule{Pattern: "soft+*@example.com", Action: Defer, Count: 1, Delay: 10 * time.Second}},
+		{spec: "soft+*@example.com=defer:0", want: Rule{Pattern: "soft+*@example.com", Action: Defer, Count: 0, Delay: 5 * time.Second}},
+		{spec: "spam+*@=spam:1m", want: Rule{Pattern: "spam+*@", Action: Spam, Delay: time.Minute}},
+		{spec: "open=open", want: Rule{Pattern: "open", Action: Open, Delay: time.Second}},
+		{spec: "*@blocked.test=reject", want: Rule{Pattern: "*@blocked.test", Action: Reject, Detail: "rule"}},
+		{spec: "*@blocked.test=reject:unsub", want: Rule{Pattern: "*@blocked.test", Action: Reject, Detail: "unsub"}},
+		{spec: "vip@example.com=deliver", want: Rule{Pattern: "vip@example.com", Action: Deliver}},
+		{spec: "*@x.test=bounce", wantErr: true},
+		{spec: "hard_bounce", wantErr: true},
+		{spec: "=reject", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %+v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules, err := ParseAll([]string{"*@bad.test=hard_bounce", "vip+*@=deliver", "ops=reject"}, true)
+	if err != nil {
+		t.Fatalf("ParseAll: %v", err)
+	}
+	tests := []struct {
+		addr   string
+		action string
+	}{
+		{"anyone@bad.test", HardBounce},
+		{"Anyone@BAD.test ", HardBounce},
+		{"anyone@sub.bad.test", ""},
+		{"vip@example.com", Deliver},
+		{"vip+tag@example.com", Deliver},
+		{"ops@example.com", Reject},
+		{"ops+x@example.com", ""},
+		{"hard-bounce+1@example.com", HardBounce},
+		{"hard-bounce@example.com", HardBounce},
+		{"soft+2@example.com", Defer},
+		{"open+a@example.com", Open},
+		{"hard-bounce+1@bad.test", HardBounce},
+		{"someone@example.com", ""},
+	}
+	for _, tt := range tests {
+		r, ok := rules.Match(tt.addr)
+		if r.Action != tt.action || ok != (tt.action != "") {
+			t.Errorf("Match(%q) = %q, %v; want %q", tt.addr, r.Action, ok, tt.action)
+		}
+	}
+
+	plain, _ := ParseAll(nil, false)
+	if _, ok := plain.Match("hard-bounce+1@example.com"); ok {
+		t.Error("built-in addresses matched without defaults")
+	}
+}
+
+func TestBounce(t *testing.T) {
+	tests := []struct {
+		spec       string
+		status     string
+		hard       bool
+		diagnostic string
+	}{
+		{"*=hard_bounce", "5.1.1", true, "550 5.1.1 <a@x.test>: Recipient address rejected: User unknown"},
+		{"*=hard_bounce:invalid_domain", "5.1.2", true, "550 5.1.2 <a@x.test>: Host or domain name not found"},
+		{"*=soft_bounce", "4.2.2", false, "452 4.2.2 <a@x.test>: Mailbox full"},
+		{"*=soft_bounce:general", "4.0.0", false, "450 4.0.0 <a@x.test>: Delivery failed"},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		b := r.Bounce("a@x.test")
+		if b.Status != tt.status || b.Hard != tt.hard || b.Diagnostic != tt.diagnostic || b.Description != r.Detail {
+			t.Errorf("%s: Bounce = %+v", tt.spec, b)
+		}
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    Directives
+		wantErr bool
+	}{
+		{header: "", want: Directives{}},
+		{header: "reject=spam", want: Directives{Rule: &Rule{Pattern: "*", Action: Reject, Detail: "spam"}}},
+		{header: "hard-bounce", want: Directives{Rule: &Rule{Pattern: "*", Action: HardBounce, Detail: "bad_mailbox"}}},
+		{header: "open-after=2s; delay=5s", want: Directives{Rule: &Rule{Pattern: "*", Action: Open, Delay: 2 * time.Second}, Delay: 5 * time.Second}},
+		{header: "Spam-After=1m", want: Directives{Rule: &Rule{Pattern: "*", Action: Spam, Delay: time.Minute}}},
+		{header: "defer=2, delay=1s", want: Directives{Rule: &Rule{Pattern: "*", Action: Defer, Count: 2, Delay: 5 * time.Second}, Delay: time.Second}},
+		{header: "smtp-error=550 5.7.1 Blocked", want: Directives{SMTPError: "550 5.7.1 Blocked"}},
+		{header: "smtp-error=250 OK", wantErr: true},
+		{header: "delay=soon", wantErr: true},
+		{header: "defer=-1", wantErr: true},
+		{header: "reject; hard-bounce", wantErr: true},
+		{header: "explode", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDirectives(tt.header)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseDirectives(%q) = %+v, want error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDirectives(%q): %v", tt.header, err)
+			continue
+		}
+		if got.Delay != tt.want.Delay || got.SMTPError != tt.want.SMTPError || (got.Rule == nil) != (tt.want.Rule == nil) ||
+			got.Rule != nil && *got.Rule != *tt.want.Rule {
+			t.Errorf("ParseDirectives(%q) = %+v (rule %+v), want %+v (rule %+v)", tt.header, got, got.Rule, tt.want, tt.want.Rule)
+		}
+	}
+}
+
+func TestDirectivesRules(t *testing.T) {
+	base, _ := ParseAll([]string{"a@x.test=deliver"}, false)
+	d, err := FromHeaders(map[string]string{"x-mandrilldev-simulate": "reject"})
+	if err != nil {
+		t.Fatalf("FromHeaders: %v", err)
+	}
+	r, _ := d.Rules(base).Match("a@x.test")
+	if r.Action != Reject {
+		t.Errorf("header rule should come first, got %q", r.Action)
+	}
+	if rs := (Directives{}).Rules(base); len(rs) != 1 {
+		t.Errorf("Rules without a directive = %+v", rs)
+	}
+}
@@ -0,0 +1,391 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+const (
+	maxMessageSize = 32 << 20
+	maxRecipients  = 1000
+	commandTimeout = 5 * time.Minute
+)
+
+var (
+	mailFromRe = regexp.MustCompile(`(?i)^FROM:\s*<([^>]*)>`)
+	rcptToRe   = regexp.MustCompile(`(?i)^TO:\s*<([^>]+)>`)
+)
+
+// Server is an SMTP server that captures everything it receives. It speaks
+// plain SMTP and STARTTLS, with optional AUTH PLAIN and LOGIN, and hands
+// each message to a handler.
+type Server struct {
+	cfg     config.Config
+	tls     *tls.Config
+	handler func(m *types.CapturedMessage)
+}
+
+// NewServer prepares a server for cfg. handler is called with every
+// message received. Without SMTPD_TLS_CERT and SMTPD_TLS_KEY, STARTTLS
+// uses a self-signed certificate for SMTPD_HOSTNAME.
+func NewServer(cfg config.Config, handler func(m *types.CapturedMessage)) (*Server, error) {
+	s := &Server{cfg: cfg, handler: handler}
+	var cert tls.Certificate
+	var err error
+	if cfg.SMTPDTLSCert != "" || cfg.SMTPDTLSKey != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.SMTPDTLSCert, cfg.SMTPDTLSKey)
+	} else {
+		cert, err = selfSigned(cfg.SMTPDHostname)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: tls: %w", err)
+	}
+	s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return s, nil
+}
+
+// ListenAndServe accepts connections on cfg.SMTPDAddr until the listener
+// fails.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.cfg.SMTPDAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("SMTP capture server listening on %s", s.cfg.SMTPDAddr)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(c)
+	}
+}
+
+// Pipe returns the client end of an in-process connection to the server.
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client
+}
+
+func (s *Server) serve(c net.Conn) {
+	ss := &session{srv: s, conn: c, tp: textproto.NewConn(c)}
+	defer func() { _ = ss.conn.Close() }()
+	// A bug handling one client must not take the whole server down.
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("smtpd %s: panic: %v\n%s", c.RemoteAddr(), v, debug.Stack())
+		}
+	}()
+	if err := ss.run(); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("smtpd %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+// session is one client connection. Lines outside a mail transaction go
+// to prelude, which starts every message's transcript.
+type session struct {
+	srv  *Server
+	conn net.Conn
+	tp   *textproto.Conn
+
+	helo, user string
+	tls, authd bool
+	prelude    []string
+
+	inMail bool
+	from   string
+	rcpts  []string
+	txn    []string
+}
+
+func (ss *session) log(line string) {
+	if ss.inMail {
+		ss.txn = append(ss.txn, line)
+	} else {
+		ss.prelude = append(ss.prelude, line)
+	}
+}
+
+func (ss *session) reply(code int, text string) error {
+	ss.log(fmt.Sprintf("S: %d %s", code, text))
+	return ss.tp.PrintfLine("%d %s", code, text)
+}
+
+func (ss *session) replyLines(code int, lines []string) error {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		ss.log(fmt.Sprintf("S: %d%s%s", code, sep, l))
+		if err := ss.tp.PrintfLine("%d%s%s", code, sep, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *session) readLine() (string, error) {
+	_ = ss.conn.SetDeadline(time.Now().Add(commandTimeout))
+	return ss.tp.ReadLine()
+}
+
+func (ss *session) reset() {
+	ss.inMail, ss.from, ss.rcpts, ss.txn = false, "", nil, nil
+}
+
+func (ss *session) run() error {
+	if err := ss.reply(220, ss.srv.cfg.SMTPDHostname+" ESMTP mandrill-dev"); err != nil {
+		return err
+	}
+	for {
+		line, err := ss.readLine()
+		if err != nil {
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		if verb == "AUTH" {
+			mech, _, _ := strings.Cut(arg, " ")
+			ss.log("C: AUTH " + mech + " ***")
+		} else {
+			ss.log("C: " + line)
+		}
+		switch verb {
+		case "HELO":
+			ss.helo = strings.TrimSpace(arg)
+			ss.reset()
+			err = ss.reply(250, ss.srv.cfg.SMTPDHostname)
+		case "EHLO":
+			ss.helo = strings.TrimSpace(arg)
+			ss.reset()
+			lines := []string{ss.srv.cfg.SMTPDHostname, "PIPELINING", fmt.Sprintf("SIZE %d", maxMessageSize), "8BITMIME", "ENHANCEDSTATUSCODES"}
+			if !ss.tls {
+				lines = append(lines, "STARTTLS")
+			}
+			if !ss.authd {
+				lines = append(lines, "AUTH PLAIN LOGIN")
+			}
+			err = ss.replyLines(250, lines)
+		case "STARTTLS":
+			err = ss.startTLS()
+		case "AUTH":
+			err = ss.auth(arg)
+		case "MAIL":
+			err = ss.mail(arg)
+		case "RCPT":
+			err = ss.rcpt(arg)
+		case "DATA":
+			err = ss.data()
+		case "RSET":
+			ss.reset()
+			err = ss.reply(250, "2.0.0 Ok")
+		case "NOOP":
+			err = ss.reply(250, "2.0.0 Ok")
+		case "VRFY":
+			err = ss.reply(252, "2.5.0 Cannot VRFY user, but will accept message")
+		case "QUIT":
+			_ = ss.reply(221, "2.0.0 Bye")
+			return nil
+		default:
+			err = ss.reply(502, "5.5.2 Command not recognized")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ss *session) startTLS() error {
+	if ss.tls {
+		return ss.reply(503, "5.5.1 TLS already active")
+	}
+	if err := ss.reply(220, "2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+	tc := tls.Server(ss.conn, ss.srv.tls)
+	_ = tc.SetDeadline(time.Now().Add(commandTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	ss.conn, ss.tp = tc, textproto.NewConn(tc)
+	ss.tls, ss.helo = true, ""
+	ss.reset()
+	ss.log("-- TLS " + tls.VersionName(tc.ConnectionState().Version))
+	return nil
+}
+
+// auth checks credentials against SMTPD_AUTH. Without it any credentials
+// are accepted, so clients configured with a login still work.
+func (ss *session) auth(arg string) error {
+	if ss.authd {
+		return ss.reply(503, "5.5.1 Already authenticated")
+	}
+	mech, initial, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	var user, pass string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		resp := initial
+		if resp == "" {
+			var err error
+			if resp, err = ss.challenge(""); err != nil {
+				return err
+			}
+		}
+		b, err := base64.StdEncoding.DecodeString(resp)
+		parts := strings.Split(string(b), "\x00")
+		if err != nil || len(parts) != 3 {
+			return ss.reply(501, "5.5.2 Malformed AUTH PLAIN response")
+		}
+		user, pass = parts[1], parts[2]
+	case "LOGIN":
+		for _, prompt := range []string{"Username:", "Password:"} {
+			resp := initial
+			if prompt != "Username:" || resp == "" {
+				var err error
+				if resp, err = ss.challenge(prompt); err != nil {
+					return err
+				}
+			}
+			b, err := base64.StdEncoding.DecodeString(resp)
+			if err != nil {
+				return ss.reply(501, "5.5.2 Malformed AUTH LOGIN response")
+			}
+			if prompt == "Username:" {
+				user = string(b)
+			} else {
+				pass = string(b)
+			}
+		}
+	default:
+		return ss.reply(504, "5.5.4 Unrecognized authentication mechanism")
+	}
+	if want := ss.srv.cfg.SMTPDAuth; want != "" && subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(want)) != 1 {
+		return ss.reply(535, "5.7.8 Authentication credentials invalid")
+	}
+	ss.user, ss.authd = user, true
+	return ss.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge sends a 334 prompt and reads the base64 response.
+func (ss *session) challenge(prompt string) (string, error) {
+	if err := ss.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+		return "", err
+	}
+	line, err := ss.readLine()
+	if err != nil {
+		return "", err
+	}
+	ss.log("C: ***")
+	return strings.TrimSpace(line), nil
+}
+
+func (ss *session) mail(arg string) error {
+	if ss.srv.cfg.SMTPDAuth != "" && !ss.authd {
+		return ss.reply(530, "5.7.0 Authentication required")
+	}
+	if ss.inMail {
+		return ss.reply(503, "5.5.1 Nested MAIL command")
+	}
+	m := mailFromRe.FindStringSubmatch(arg)
+	if m == nil {
+		return ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	// Start the transaction's transcript with this command.
+	line := ss.prelude[len(ss.prelude)-1]
+	ss.prelude = ss.prelude[:len(ss.prelude)-1]
+	ss.inMail, ss.from = true, m[1]
+	ss.log(line)
+	return ss.reply(250, "2.1.0 Ok")
+}
+
+func (ss *session) rcpt(arg string) error {
+	if !ss.inMail {
+		return ss.reply(503, "5.5.1 Need MAIL command")
+	}
+	m := rcptToRe.FindStringSubmatch(arg)
+	if m == nil {
+		return ss.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	if len(ss.rcpts) >= maxRecipients {
+		return ss.reply(452, "4.5.3 Too many recipients")
+	}
+	ss.rcpts = append(ss.rcpts, m[1])
+	return ss.reply(250, "2.1.5 Ok")
+}
+
+func (ss *session) data() error {
+	if !ss.inMail || len(ss.rcpts) == 0 {
+		return ss.reply(503, "5.5.1 Need RCPT command")
+	}
+	if err := ss.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+	_ = ss.conn.SetDeadline(time.Now().Add(commandTimeout))
+	raw, err := io.ReadAll(io.LimitReader(ss.tp.DotReader(), maxMessageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(raw) > maxMessageSize {
+		// Drain the rest so the connection stays in sync.
+		_, _ = io.Copy(io.Discard, ss.tp.DotReader())
+		ss.log(fmt.Sprintf("C: <more than %d bytes>", maxMessageSize))
+		defer ss.reset()
+		return ss.reply(552, "5.3.4 Message size exceeds fixed limit")
+	}
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+	ss.log(fmt.Sprintf("C: <%d bytes>", len(raw)))
+	ss.log("C: .")
+
+	m := &types.CapturedMessage{
+		ID:         newID(),
+		ReceivedAt: time.Now().UTC(),
+		RemoteAddr: ss.conn.RemoteAddr().String(),
+		Helo:       ss.helo,
+		TLS:        ss.tls,
+		AuthUser:   ss.user,
+		MailFrom:   ss.from,
+		RcptTo:     ss.rcpts,
+		Size:       len(raw),
+		Raw:        raw,
+	}
+	if msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(raw))); err == nil {
+		m.Subject = msg.Header.Get("Subject")
+		if d, err := new(mime.WordDecoder).DecodeHeader(m.Subject); err == nil {
+			m.Subject = d
+		}
+	}
+	text := "2.0.0 Ok: queued as " + m.ID
+	m.Transcript = append(append(append([]string(nil), ss.prelude...), ss.txn...), fmt.Sprintf("S: 250 %s", text))
+	ss.reset()
+	ss.srv.handler(m)
+	// Already in the transcript; it isn't part of the next one.
+	return ss.tp.PrintfLine("250 %s", text)
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,217 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// step is one client line and the reply code expected for it. An empty
+// line with data sends data as a DATA body.
+type step struct {
+	line string
+	data string
+	code int
+	// reply, when set, must appear in the reply text.
+	reply string
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+const body = "From: a@example.com\r\nSubject: Hello\r\n\r\nhi\r\n.leading dot\r\n"
+
+func TestConversation(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  string
+		steps []step
+		want  *types.CapturedMessage // the last message captured, if any
+	}{
+		{
+			name: "plain delivery",
+			steps: []step{
+				{line: "EHLO client.test", code: 250, reply: "STARTTLS"},
+				{line: "MAIL FROM:<a@example.com> SIZE=100", code: 250},
+				{line: "RCPT TO:<b@example.org>", code: 250},
+				{line: "RCPT TO:<c@example.org>", code: 250},
+				{line: "DATA", code: 354},
+				{data: body, code: 250, reply: "queued as"},
+				{line: "QUIT", code: 221},
+			},
+			want: &types.CapturedMessage{Helo: "client.test", MailFrom: "a@example.com", RcptTo: []string{"b@example.org", "c@example.org"}, Subject: "Hello"},
+		},
+		{
+			name: "out of sequence",
+			steps: []step{
+				{line: "HELO client.test", code: 250},
+				{line: "RCPT TO:<b@example.org>", code: 503},
+				{line: "DATA", code: 503},
+				{line: "MAIL FROM:a@example.com", code: 501},
+				{line: "MAIL FROM:<>", code: 250},
+				{line: "MAIL FROM:<a@example.com>", code: 503},
+				{line: "DATA", code: 503},
+				{line: "RCPT TO:<>", code: 501},
+				{line: "RSET", code: 250},
+				{line: "RCPT TO:<b@example.org>", code: 503},
+				{line: "NOOP", code: 250},
+				{line: "VRFY b", code: 252},
+				{line: "TURN", code: 502},
+				{line: "STARTTLS", code: 220},
+				{line: "STARTTLS", code: 503},
+			},
+		},
+		{
+			name: "auth required",
+			auth: "user:secret",
+			steps: []step{
+				{line: "EHLO client.test", code: 250, reply: "AUTH PLAIN LOGIN"},
+				{line: "MAIL FROM:<a@example.com>", code: 530},
+				{line: "AUTH PLAIN " + b64("\x00user\x00wrong"), code: 535},
+				{line: "AUTH PLAIN !!!", code: 501},
+				{line: "AUTH CRAM-MD5", code: 504},
+				{line: "STARTTLS", code: 220},
+				{line: "EHLO client.test", code: 250},
+				{line: "AUTH PLAIN", code: 334},
+				{line: b64("\x00user\x00secret"), code: 235},
+				{line: "AUTH PLAIN " + b64("\x00user\x00secret"), code: 503},
+				{line: "MAIL FROM:<a@example.com>", code: 250},
+				{line: "RCPT TO:<b@example.org>", code: 250},
+				{line: "DATA", code: 354},
+				{data: body, code: 250},
+			},
+			want: &types.CapturedMessage{Helo: "client.test", TLS: true, AuthUser: "user", MailFrom: "a@example.com", RcptTo: []string{"b@example.org"}, Subject: "Hello"},
+		},
+		{
+			name: "auth login",
+			auth: "user:secret",
+			steps: []step{
+				{line: "EHLO client.test", code: 250},
+				{line: "AUTH LOGIN", code: 334, reply: b64("Username:")},
+				{line: b64("user"), code: 334, reply: b64("Password:")},
+				{line: b64("secret"), code: 235},
+				{line: "EHLO client.test", code: 250},
+				{line: "MAIL FROM:<a@example.com>", code: 250},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []*types.CapturedMessage
+			srv, err := NewServer(config.Config{SMTPDHostname: "mx.test", SMTPDAuth: tt.auth}, func(m *types.CapturedMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, m)
+			})
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			conn := srv.Pipe()
+			defer conn.Close()
+			tp := textproto.NewConn(conn)
+			if _, _, err := tp.ReadResponse(220); err != nil {
+				t.Fatalf("greeting: %v", err)
+			}
+			for _, s := range tt.steps {
+				if s.line == "" {
+					w := tp.DotWriter()
+					_, _ = w.Write([]byte(s.data))
+					if err := w.Close(); err != nil {
+						t.Fatalf("data: %v", err)
+					}
+				} else if err := tp.PrintfLine("%s", s.line); err != nil {
+					t.Fatalf("%s: %v", s.line, err)
+				}
+				code, msg, err := tp.ReadResponse(0)
+				if err != nil && code == 0 {
+					t.Fatalf("%s: %v", s.line, err)
+				}
+				if code != s.code || !strings.Contains(msg, s.reply) {
+					t.Fatalf("%q: got %d %s, want %d %s", s.line, code, msg, s.code, s.reply)
+				}
+				if strings.EqualFold(s.line, "STARTTLS") && code == 220 {
+					tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+					if err := tc.Handshake(); err != nil {
+						t.Fatalf("handshake: %v", err)
+					}
+					tp = textproto.NewConn(tc)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.want == nil {
+				if len(got) != 0 {
+					t.Fatalf("captured %d messages, want none", len(got))
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("captured %d messages, want 1", len(got))
+			}
+			m := got[0]
+			if m.Helo != tt.want.Helo || m.TLS != tt.want.TLS || m.AuthUser != tt.want.AuthUser || m.MailFrom != tt.want.MailFrom ||
+				strings.Join(m.RcptTo, ",") != strings.Join(tt.want.RcptTo, ",") || m.Subject != tt.want.Subject {
+				t.Errorf("captured %+v, want %+v", m, tt.want)
+			}
+			if raw := string(m.Raw); raw != body || m.Size != len(body) {
+				t.Errorf("raw = %q (size %d), want %q", raw, m.Size, body)
+			}
+			transcript := strings.Join(m.Transcript, "\n")
+			if strings.Contains(transcript, "secret") || strings.Contains(transcript, b64("\x00user\x00secret")) {
+				t.Errorf("transcript leaks credentials:\n%s", transcript)
+			}
+			if !strings.HasPrefix(m.Transcript[len(m.Transcript)-1], "S: 250 2.0.0 Ok: queued as ") {
+				t.Errorf("transcript ends with %q", m.Transcript[len(m.Transcript)-1])
+			}
+		})
+	}
+}
+
+// TestClient sends through net/smtp, which negotiates STARTTLS and AUTH
+// from the EHLO reply like a real client.
+func TestClient(t *testing.T) {
+	msgs := make(chan *types.CapturedMessage, 1)
+	srv, err := NewServer(config.Config{SMTPDHostname: "mx.test", SMTPDAuth: "user:secret"}, func(m *types.CapturedMessage) { msgs <- m })
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	c, err := smtp.NewClient(srv.Pipe(), "mx.test")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{ServerName: "mx.test", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user", "secret", "mx.test")); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.Mail("a@example.com"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("b@example.org"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	_, _ = w.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n")))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+	// No QUIT: over a synchronous pipe both ends would block sending
+	// their TLS close_notify at once.
+	m := <-msgs
+	if !m.TLS || m.AuthUser != "user" || string(m.Raw) != body {
+		t.Errorf("captured %+v", m)
+	}
+}
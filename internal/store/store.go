@@ -14,6 +14,12 @@ type Store struct {
 	messages  map[string]*types.MessageRecord
 	scheduled map[string]*types.MessageRecord
 	templates map[string]*types.Template
+	rejects   map[string]*types.Reject
+	captured  []*types.CapturedMessage
+
+	subscribers []func(m types.MessageRecord, ev types.MessageEvent)
+	watchers    map[int]func(id string)
+	nextWatcher int
 }
 
 func NewStore() *Store {
@@ -21,13 +27,16 @@ func NewStore() *Store {
 		messages:  make(map[string]*types.MessageRecord),
 		scheduled: make(map[string]*types.MessageRecord),
 		templates: make(map[string]*types.Template),
+		rejects:   make(map[string]*types.Reject),
+		watchers:  make(map[int]func(id string)),
 	}
 }
 
 func (s *Store) SaveMessage(m *types.MessageRecord) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.messages[m.ID] = m
+	s.mu.Unlock()
+	s.changed(m.ID)
 }
 
 func (s *Store) GetMessage(id string) (*types.MessageRecord, bool) {
@@ -37,11 +46,26 @@ func (s *Store) GetMessage(id string) (*types.MessageRecord, bool) {
 	return m, ok
 }
 
+// UpdateMessage applies fn to a stored message under the store lock.
+func (s *Store) UpdateMessage(id string, fn func(m *types.MessageRecord)) bool {
+	s.mu.Lock()
+	m, ok := s.messages[id]
+	if ok {
+		fn(m)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.changed(id)
+	}
+	return ok
+}
+
 func (s *Store) AddScheduled(m *types.MessageRecord) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.scheduled[m.ID] = m
 	s.messages[m.ID] = m
+	s.mu.Unlock()
+	s.changed(m.ID)
 }
 
 func (s *Store) RemoveScheduled(id string) (*types.MessageRecord, bool) {
@@ -203,3 +227,145 @@ func (s *Store) ListTemplates(label string) []*types.Template {
 	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
 	return out
 }
+
+// Subscribe registers fn to be called after an event is recorded on a message.
+func (s *Store) Subscribe(fn func(m types.MessageRecord, ev types.MessageEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// RecordEvent applies fn (if any) and appends ev to the message's event log,
+// then notifies subscribers with a snapshot of the updated message.
+func (s *Store) RecordEvent(id string, ev types.MessageEvent, fn func(m *types.MessageRecord)) bool {
+	s.mu.Lock()
+	m, ok := s.messages[id]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	if fn != nil {
+		fn(m)
+	}
+	m.Events = append(m.Events, ev)
+	snapshot := *m
+	subs := s.subscribers
+	s.mu.Unlock()
+	for _, sub := range subs {
+		sub(snapshot, ev)
+	}
+	s.changed(id)
+	return true
+}
+
+// Watch registers fn to be called with a message's id whenever it is
+// saved or changes. fn must not block. The returned func unregisters it.
+func (s *Store) Watch(fn func(id string)) (cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nextWatcher
+	s.nextWatcher++
+	s.watchers[n] = fn
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.watchers, n)
+	}
+}
+
+// changed notifies watchers about message id. It is called without the
+// lock held.
+func (s *Store) changed(id string) {
+	s.mu.RLock()
+	fns := make([]func(string), 0, len(s.watchers))
+	for _, fn := range s.watchers {
+		fns = append(fns, fn)
+	}
+	s.mu.RUnlock()
+	for _, fn := range fns {
+		fn(id)
+	}
+}
+
+// Rejects store ops; addresses are matched case-insensitively.
+func (s *Store) SaveReject(r *types.Reject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(r.Email))
+	if old, ok := s.rejects[key]; ok {
+		r.CreatedAt = old.CreatedAt
+	}
+	s.rejects[key] = r
+}
+
+func (s *Store) GetReject(email string) (*types.Reject, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.rejects[strings.ToLower(strings.TrimSpace(email))]
+	return r, ok
+}
+
+func (s *Store) DeleteReject(email string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(email))
+	_, ok := s.rejects[key]
+	delete(s.rejects, key)
+	return ok
+}
+
+func (s *Store) ListRejects(email string) []*types.Reject {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*types.Reject, 0, len(s.rejects))
+	for key, r := range s.rejects {
+		if email == "" || key == strings.ToLower(strings.TrimSpace(email)) {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Email < out[j].Email })
+	return out
+}
+
+// SaveCaptured adds a captured message, dropping the oldest ones beyond
+// max (0 keeps all). They are kept oldest first.
+func (s *Store) SaveCaptured(m *types.CapturedMessage, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captured = append(s.captured, m)
+	if max > 0 && len(s.captured) > max {
+		s.captured = append([]*types.CapturedMessage(nil), s.captured[len(s.captured)-max:]...)
+	}
+}
+
+func (s *Store) GetCaptured(id string) (*types.CapturedMessage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, m := range s.captured {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// ListCaptured returns captured messages, newest first.
+func (s *Store) ListCaptured() []*types.CapturedMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*types.CapturedMessage, 0, len(s.captured))
+	for i := len(s.captured) - 1; i >= 0; i-- {
+		out = append(out, s.captured[i])
+	}
+	return out
+}
+
+// ClearCaptured deletes every captured message and reports how many there
+// were.
+func (s *Store) ClearCaptured() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.captured)
+	s.captured = nil
+	return n
+}
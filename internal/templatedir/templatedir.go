@@ -0,0 +1,278 @@
+package templatedir
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Template files are grouped by base name: welcome.html and welcome.txt
+// together make up the "welcome" template. Either file may start with a
+// front-matter header delimited by "---" lines:
+//
+//	---
+//	subject: Welcome *|NAME|*
+//	from: Acme <hello@acme.test>
+//	labels: onboarding, transactional
+//	---
+//	<p>Hello *|NAME|*</p>
+var extensions = map[string]bool{".html": true, ".htm": true, ".txt": true}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watcher imports every template in a directory and republishes templates
+// whose files change on disk. Templates whose files disappear are passed to
+// the remove callback.
+type Watcher struct {
+	dir    string
+	add    func(types.TemplateAddRequest) error
+	remove func(name string)
+	seen   map[string]map[string]fileState // template name -> file path -> state
+	stop   chan struct{}
+	alive  atomic.Bool
+}
+
+func NewWatcher(dir string, add func(types.TemplateAddRequest) error, remove func(name string)) *Watcher {
+	return &Watcher{dir: dir, add: add, remove: remove, seen: map[string]map[string]fileState{}, stop: make(chan struct{})}
+}
+
+// Start performs a synchronous initial import and then polls the directory
+// for changes in the background.
+func (w *Watcher) Start() error {
+	if w.alive.Swap(true) {
+		return nil
+	}
+	if _, err := os.Stat(w.dir); err != nil {
+		w.alive.Store(false)
+		return err
+	}
+	n := w.scan()
+	log.Printf("loaded %d template(s) from %s", n, w.dir)
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.scan()
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *Watcher) Stop() {
+	if !w.alive.Swap(false) {
+		return
+	}
+	close(w.stop)
+}
+
+// scan compares the directory against the last seen state, (re)imports
+// templates whose files changed and returns how many were imported.
+func (w *Watcher) scan() int {
+	current, err := listFiles(w.dir)
+	if err != nil {
+		log.Printf("templates dir scan failed: %v", err)
+		return 0
+	}
+	imported := 0
+	for name, files := range current {
+		if sameFiles(w.seen[name], files) {
+			continue
+		}
+		req, err := Load(name, paths(files))
+		if err != nil {
+			// reported once; the files are read again when they change
+			log.Printf("template %q: %v", name, err)
+			w.seen[name] = files
+			continue
+		}
+		if err := w.add(req); err != nil {
+			log.Printf("template %q: %v", name, err)
+			continue
+		}
+		imported++
+		w.seen[name] = files
+	}
+	for name := range w.seen {
+		if _, ok := current[name]; !ok {
+			delete(w.seen, name)
+			if w.remove != nil {
+				w.remove(name)
+			}
+			log.Printf("template %q removed from %s", name, w.dir)
+		}
+	}
+	return imported
+}
+
+func listFiles(dir string) (map[string]map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]map[string]fileState{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if !extensions[ext] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if out[name] == nil {
+			out[name] = map[string]fileState{}
+		}
+		out[name][filepath.Join(dir, e.Name())] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return out, nil
+}
+
+func sameFiles(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, s := range b {
+		o, ok := a[p]
+		if !ok || !o.modTime.Equal(s.modTime) || o.size != s.size {
+			return false
+		}
+	}
+	return true
+}
+
+func paths(files map[string]fileState) []string {
+	out := make([]string, 0, len(files))
+	for p := range files {
+		out = append(out, p)
+	}
+	// .html sorts before .txt so HTML front-matter wins on conflicts
+	sort.Strings(out)
+	return out
+}
+
+// Load builds a publishing add request for the named template from its
+// .html (or .htm) and/or .txt files. Two files for the same body, such as
+// welcome.html and welcome.htm, are an error rather than one silently
+// replacing the other.
+func Load(name string, files []string) (types.TemplateAddRequest, error) {
+	req := types.TemplateAddRequest{Name: name, Publish: true}
+	seen := map[string]bool{}
+	var htmlFile, textFile string
+	for _, p := range files {
+		body, kind := &htmlFile, "HTML"
+		if strings.EqualFold(filepath.Ext(p), ".txt") {
+			body, kind = &textFile, "text"
+		}
+		if *body != "" {
+			return req, fmt.Errorf("%s and %s both hold the %s body; keep one", filepath.Base(*body), filepath.Base(p), kind)
+		}
+		*body = p
+	}
+	for _, p := range files {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return req, err
+		}
+		meta, body := splitFrontMatter(string(b))
+		if strings.EqualFold(filepath.Ext(p), ".txt") {
+			req.Text = body
+		} else {
+			req.Code = body
+		}
+		for k, v := range meta {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			if err := applyMeta(&req, k, v); err != nil {
+				return req, fmt.Errorf("%s: %w", filepath.Base(p), err)
+			}
+		}
+	}
+	return req, nil
+}
+
+func splitFrontMatter(s string) (map[string]string, string) {
+	s = strings.TrimPrefix(s, "\ufeff")
+	rest, ok := strings.CutPrefix(s, "---\n")
+	if !ok {
+		if rest, ok = strings.CutPrefix(s, "---\r\n"); !ok {
+			return nil, s
+		}
+	}
+	meta := map[string]string{}
+	for rest != "" {
+		line, next, _ := strings.Cut(rest, "\n")
+		rest = next
+		line = strings.TrimSpace(line)
+		if line == "---" {
+			return meta, rest
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			meta[strings.ToLower(strings.TrimSpace(k))] = unquote(strings.TrimSpace(v))
+		}
+	}
+	// no closing delimiter: treat the whole file as body
+	return nil, s
+}
+
+func applyMeta(req *types.TemplateAddRequest, key, value string) error {
+	switch key {
+	case "subject":
+		req.Subject = value
+	case "from_email":
+		req.FromEmail = value
+	case "from_name":
+		req.FromName = value
+	case "from":
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return fmt.Errorf("invalid from %q: %w", value, err)
+		}
+		req.FromEmail = addr.Address
+		if addr.Name != "" {
+			req.FromName = addr.Name
+		}
+	case "labels":
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		req.Labels = nil
+		for _, l := range strings.Split(value, ",") {
+			if l = unquote(strings.TrimSpace(l)); l != "" {
+				req.Labels = append(req.Labels, l)
+			}
+		}
+	case "publish":
+		req.Publish = value != "false" && value != "no"
+	}
+	return nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package templatedir
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		subject string
+		code    string
+		text    string
+		labels  []string
+		wantErr string
+	}{
+		{
+			name: "html and text",
+			files: map[string]string{
+				"welcome.html": "---\nsubject: Welcome *|NAME|*\nfrom: Acme <hello@acme.test>\nlabels: [a, 'b']\n---\n<p>Hi</p>",
+				"welcome.txt":  "---\nsubject: ignored\n---\nHi",
+			},
+			subject: "Welcome *|NAME|*", code: "<p>Hi</p>", text: "Hi", labels: []string{"a", "b"},
+		},
+		{
+			name:  "htm",
+			files: map[string]string{"welcome.htm": "<p>Hi</p>"},
+			code:  "<p>Hi</p>",
+		},
+		{
+			name:    "html and htm",
+			files:   map[string]string{"welcome.html": "<p>a</p>", "welcome.htm": "<p>b</p>"},
+			wantErr: "welcome.htm and welcome.html both hold the HTML body",
+		},
+		{
+			name:    "bad from",
+			files:   map[string]string{"welcome.html": "---\nfrom: nope\n---\n<p>Hi</p>"},
+			wantErr: "invalid from",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			files, err := listFiles(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := Load("welcome", paths(files["welcome"]))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if req.Subject != tt.subject || req.Code != tt.code || req.Text != tt.text || !reflect.DeepEqual(req.Labels, tt.labels) {
+				t.Errorf("Load() = %+v", req)
+			}
+		})
+	}
+}
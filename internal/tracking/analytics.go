@@ -0,0 +1,54 @@
+package tracking
+
+import (
+	"net/url"
+	"strings"
+)
+
+// TagAnalytics appends Google Analytics parameters to links pointing at any
+// of domains (or their subdomains). Parameters already on a link are kept.
+func TagAnalytics(doc string, domains []string, campaign string) string {
+	params := [][2]string{{"utm_source", "mandrill"}, {"utm_medium", "email"}, {"utm_campaign", campaign}}
+	return RewriteLinks(doc, func(href string) string {
+		if !Trackable(href) {
+			return href
+		}
+		u, err := url.Parse(href)
+		if err != nil || !matchDomain(u.Hostname(), domains) {
+			return href
+		}
+		q := u.Query()
+		raw := u.RawQuery
+		for _, p := range params {
+			if p[1] == "" || q.Has(p[0]) {
+				continue
+			}
+			if raw != "" {
+				raw += "&"
+			}
+			raw += p[0] + "=" + url.QueryEscape(p[1])
+		}
+		u.RawQuery = raw
+		return u.String()
+	})
+}
+
+func matchDomain(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "."))
+		if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripQuery drops the query string (and fragment) from a URL so clicks can
+// be aggregated per page, as url_strip_qs does.
+func StripQuery(raw string) string {
+	if i := strings.IndexAny(raw, "?#"); i >= 0 {
+		return raw[:i]
+	}
+	return raw
+}
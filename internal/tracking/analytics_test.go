@@ -0,0 +1,47 @@
+package tracking
+
+import (
+	"html"
+	"testing"
+)
+
+func TestTagAnalytics(t *testing.T) {
+	domains := []string{"example.com", ".shop.test"}
+	tests := []struct {
+		name string
+		href string
+		want string
+	}{
+		{"plain", "https://example.com/p", "https://example.com/p?utm_source=mandrill&utm_medium=email&utm_campaign=spring"},
+		{"subdomain", "http://www.Example.com/", "http://www.Example.com/?utm_source=mandrill&utm_medium=email&utm_campaign=spring"},
+		{"existing query", "https://example.com/p?a=1&b=x%20y", "https://example.com/p?a=1&b=x%20y&utm_source=mandrill&utm_medium=email&utm_campaign=spring"},
+		{"existing utm kept", "https://example.com/p?utm_source=news", "https://example.com/p?utm_source=news&utm_medium=email&utm_campaign=spring"},
+		{"fragment", "https://shop.test/p?a=1#top", "https://shop.test/p?a=1&utm_source=mandrill&utm_medium=email&utm_campaign=spring#top"},
+		{"other domain", "https://example.org/p", "https://example.org/p"},
+		{"suffix only", "https://notexample.com/p", "https://notexample.com/p"},
+		{"mailto", "mailto:a@example.com", "mailto:a@example.com"},
+		{"merge tag", "https://example.com/*|ID|*", "https://example.com/*|ID|*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TagAnalytics(`<a href="`+tt.href+`">x</a>`, domains, "spring")
+			if want := `<a href="` + html.EscapeString(tt.want) + `">x</a>`; got != want {
+				t.Errorf("TagAnalytics() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestStripQuery(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://example.com/p?a=1", "https://example.com/p"},
+		{"https://example.com/p#top", "https://example.com/p"},
+		{"https://example.com/p?a=1#top", "https://example.com/p"},
+		{"https://example.com/p", "https://example.com/p"},
+	}
+	for _, tt := range tests {
+		if got := StripQuery(tt.in); got != tt.want {
+			t.Errorf("StripQuery(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
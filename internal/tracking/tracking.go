@@ -0,0 +1,161 @@
+package tracking
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Paths served by the API for tracked opens and clicks.
+const (
+	OpenPath  = "/track/open/"
+	ClickPath = "/track/click/"
+)
+
+var (
+	anchorRe = regexp.MustCompile(`(?is)<a\b[^>]*>`)
+	hrefRe   = regexp.MustCompile(`(?is)(\shref\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+	bodyEnd  = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+// RewriteLinks calls fn for the href of every <a> tag in doc and replaces it
+// with the result. Values are passed unescaped and re-escaped on the way out.
+// Anchors carrying mc:disable-tracking are left alone.
+func RewriteLinks(doc string, fn func(href string) string) string {
+	return anchorRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		if strings.Contains(strings.ToLower(tag), "mc:disable-tracking") {
+			return tag
+		}
+		m := hrefRe.FindStringSubmatchIndex(tag)
+		if m == nil {
+			return tag
+		}
+		raw := tag[m[4]:m[5]]
+		quote := ""
+		if raw[0] == '"' || raw[0] == '\'' {
+			quote = raw[:1]
+			raw = raw[1 : len(raw)-1]
+		}
+		href := html.UnescapeString(strings.TrimSpace(raw))
+		out := fn(href)
+		if out == href {
+			return tag
+		}
+		if quote == "" {
+			quote = `"`
+		}
+		return tag[:m[4]] + quote + html.EscapeString(out) + quote + tag[m[5]:]
+	})
+}
+
+// Trackable reports whether a link points at a web page rather than a
+// mailto:, tel:, in-page anchor or unresolved merge tag.
+func Trackable(href string) bool {
+	l := strings.ToLower(strings.TrimSpace(href))
+	return (strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://")) && !strings.Contains(l, "*|")
+}
+
+// Apply wraps links in click redirects and/or appends an open pixel to an
+// HTML body for the given message id.
+func Apply(doc, base, id string, clicks, opens bool) string {
+	base = strings.TrimRight(base, "/")
+	if clicks {
+		doc = RewriteLinks(doc, func(href string) string {
+			if !Trackable(href) {
+				return href
+			}
+			return base + ClickPath + ClickToken(id, href)
+		})
+	}
+	if opens {
+		pixel := fmt.Sprintf(`<img src="%s%s%s.gif" width="1" height="1" alt="" style="display:block;width:1px;height:1px;border:0" />`, base, OpenPath, OpenToken(id))
+		if loc := bodyEnd.FindStringIndex(doc); loc != nil {
+			doc = doc[:loc[0]] + pixel + doc[loc[0]:]
+		} else {
+			doc += pixel
+		}
+	}
+	return doc
+}
+
+// secret signs tracking tokens so they can't be forged to record fake
+// events or to redirect anywhere. It is random per process unless set by
+// SetSecret.
+var secret = func() []byte {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return b
+}()
+
+// SetSecret replaces the per-process secret (TRACKING_SECRET), so links in
+// mail sent before a restart keep working. It must be called before
+// tokens are made or checked.
+func SetSecret(s string) {
+	if s != "" {
+		secret = []byte(s)
+	}
+}
+
+// sign returns payload and its truncated HMAC, base64url encoded and
+// joined by a dot. kind keeps open and click tokens apart.
+func sign(kind, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac(kind, payload))
+}
+
+// verify returns the payload of a token made by sign for kind.
+func verify(kind, token string) (string, bool) {
+	p, m, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(p)
+	sum, err2 := base64.RawURLEncoding.DecodeString(m)
+	if err1 != nil || err2 != nil || !hmac.Equal(sum, mac(kind, string(payload))) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+func mac(kind, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(kind + "\n" + payload))
+	return h.Sum(nil)[:16]
+}
+
+// OpenToken encodes a message id for the open pixel URL.
+func OpenToken(id string) string {
+	return sign("open", id)
+}
+
+// ClickToken encodes a message id and destination for a click redirect.
+func ClickToken(id, url string) string {
+	return sign("click", id+"\n"+url)
+}
+
+// ParseOpenToken returns the message id from an open token, with or without
+// the trailing .gif.
+func ParseOpenToken(token string) (string, error) {
+	id, ok := verify("open", strings.TrimSuffix(token, ".gif"))
+	if !ok || id == "" {
+		return "", fmt.Errorf("invalid open token")
+	}
+	return id, nil
+}
+
+// ParseClickToken returns the message id and destination from a click token.
+func ParseClickToken(token string) (string, string, error) {
+	payload, ok := verify("click", token)
+	if !ok {
+		return "", "", fmt.Errorf("invalid click token")
+	}
+	id, url, ok := strings.Cut(payload, "\n")
+	if !ok || id == "" || !Trackable(url) {
+		return "", "", fmt.Errorf("invalid click token")
+	}
+	return id, url, nil
+}
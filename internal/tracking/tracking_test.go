@@ -0,0 +1,45 @@
+package tracking
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClickToken(t *testing.T) {
+	token := ClickToken("abc123", "https://example.com/a?b=c")
+	id, url, err := ParseClickToken(token)
+	if err != nil || id != "abc123" || url != "https://example.com/a?b=c" {
+		t.Fatalf("ParseClickToken(ClickToken(...)) = %q, %q, %v", id, url, err)
+	}
+
+	payload, _, _ := strings.Cut(token, ".")
+	other := ClickToken("abc123", "https://evil.example/")
+	_, otherMAC, _ := strings.Cut(other, ".")
+	tests := []struct {
+		name, token string
+	}{
+		{"unsigned", payload},
+		{"payload of another token", strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1]},
+		{"signature of another token", payload + "." + otherMAC},
+		{"open token", OpenToken("abc123")},
+		{"garbage", "!!!.???"},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseClickToken(tt.token); err == nil {
+			t.Errorf("%s: ParseClickToken accepted %q", tt.name, tt.token)
+		}
+	}
+}
+
+func TestOpenToken(t *testing.T) {
+	id, err := ParseOpenToken(OpenToken("abc123") + ".gif")
+	if err != nil || id != "abc123" {
+		t.Fatalf("ParseOpenToken = %q, %v", id, err)
+	}
+	if _, err := ParseOpenToken("YWJjMTIz.gif"); err == nil {
+		t.Error("ParseOpenToken accepted an unsigned token")
+	}
+	if _, err := ParseOpenToken(ClickToken("abc123", "https://example.com/")); err == nil {
+		t.Error("ParseOpenToken accepted a click token")
+	}
+}
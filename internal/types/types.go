@@ -124,6 +124,15 @@ type SearchRequest struct {
 	Limit    int      `json:"limit,omitempty"`
 }
 
+type SearchTimeSeriesRequest struct {
+	Key      string   `json:"key"`
+	Query    string   `json:"query,omitempty"`
+	DateFrom string   `json:"date_from,omitempty"`
+	DateTo   string   `json:"date_to,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Senders  []string `json:"senders,omitempty"`
+}
+
 type ListScheduledRequest struct {
 	Key string `json:"key"`
 	To  string `json:"to,omitempty"`
@@ -163,22 +172,86 @@ type MessageRecord struct {
 	Tags         []string
 	Raw          []byte
 	TemplateName string
+	// Key and IPPool are the API key and ip_pool of the send, which routing
+	// rules may match on.
+	Key          string `json:"-"`
+	IPPool       string
+	Lint         *LintReport
+	Opens        int
+	OpensDetail  []Engagement
+	Clicks       int
+	ClicksDetail []Engagement
+	Events       []MessageEvent
+	SMTPEvents   []SMTPEvent
+	// BounceDescription and Diag describe the last bounce (bad_mailbox, ...)
+	// and the remote server's reply.
+	BounceDescription string
+	Diag              string
+	// Redirect is set when the staging catch-all rewrote the recipients.
+	Redirect *Redirect
+}
+
+// Redirect keeps a redirected message's original recipients.
+type Redirect struct {
+	To  []string `json:"to"`
+	Cc  []string `json:"cc"`
+	Bcc []string `json:"bcc"`
+	// Rcpts maps each original envelope recipient to the address it was
+	// delivered to; allowlisted recipients map to themselves.
+	Rcpts map[string]string `json:"rcpts"`
+}
+
+// Engagement is a single tracked open or click.
+type Engagement struct {
+	TS        int64  `json:"ts"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"ua"`
+	URL       string `json:"url,omitempty"`
+}
+
+// SMTPEvent is one delivery attempt for a message: sent, deferred, ...
+type SMTPEvent struct {
+	TS   int64  `json:"ts"`
+	Type string `json:"type"`
+	Diag string `json:"diag"`
+}
+
+// MessageEvent is an entry in a message's event log and the payload of a
+// webhook notification (send, open, click, ...).
+type MessageEvent struct {
+	Event     string `json:"event"`
+	TS        int64  `json:"ts"`
+	Email     string `json:"email,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// LintReport lists merge problems found while rendering a message or template.
+type LintReport struct {
+	OK               bool     `json:"ok"`
+	MissingVars      []string `json:"missing_vars"`      // referenced but not supplied
+	UnusedVars       []string `json:"unused_vars"`       // supplied but never referenced
+	UnbalancedBlocks []string `json:"unbalanced_blocks"` // conditional/each blocks not closed properly
+	UnfilledRegions  []string `json:"unfilled_regions"`  // mc:edit regions without template_content
+	IgnoredRcptVars  []string `json:"ignored_rcpt_vars"` // recipients whose merge_vars a shared message can't apply
 }
 
 // Template management
 type Template struct {
-	Name          string     `json:"name"`
-	FromEmail     string     `json:"from_email,omitempty"`
-	FromName      string     `json:"from_name,omitempty"`
-	Subject       string     `json:"subject,omitempty"`
-	Code          string     `json:"code,omitempty"`         // draft HTML
-	Text          string     `json:"text,omitempty"`         // draft text
-	PublishedCode string     `json:"publish_code,omitempty"` // published HTML
-	PublishedText string     `json:"publish_text,omitempty"` // published text
-	Labels        []string   `json:"labels,omitempty"`
-	CreatedAt     time.Time  `json:"created_at"`
-	UpdatedAt     time.Time  `json:"updated_at"`
-	PublishedAt   *time.Time `json:"published_at,omitempty"`
+	Name             string     `json:"name"`
+	FromEmail        string     `json:"from_email,omitempty"`
+	FromName         string     `json:"from_name,omitempty"`
+	Subject          string     `json:"subject,omitempty"`
+	Code             string     `json:"code,omitempty"`         // draft HTML
+	Text             string     `json:"text,omitempty"`         // draft text
+	PublishedCode    string     `json:"publish_code,omitempty"` // published HTML
+	PublishedText    string     `json:"publish_text,omitempty"` // published text
+	PublishedSubject string     `json:"publish_subject,omitempty"`
+	Labels           []string   `json:"labels,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	PublishedAt      *time.Time `json:"published_at,omitempty"`
 }
 
 type TemplateAddRequest struct {
@@ -232,7 +305,99 @@ type TemplateTimeSeriesRequest struct {
 }
 
 type TemplateRenderRequest struct {
-	Key             string            `json:"key"`
-	TemplateName    string            `json:"template_name"`
-	TemplateContent []TemplateContent `json:"template_content"`
+	Key             string             `json:"key"`
+	TemplateName    string             `json:"template_name"`
+	TemplateContent []TemplateContent  `json:"template_content"`
+	MergeVars       []MandrillMergeVar `json:"merge_vars,omitempty"`
+	MergeLanguage   string             `json:"merge_language,omitempty"` // mailchimp (default) or handlebars
+	Draft           bool               `json:"draft,omitempty"`          // render the draft instead of the published version
+}
+
+// Senders
+type SendersDomainsRequest struct {
+	Key string `json:"key"`
+}
+
+// SenderDomain mirrors Mandrill's senders/domains entry, plus the DKIM
+// record this server signs with.
+type SenderDomain struct {
+	Domain       string           `json:"domain"`
+	CreatedAt    string           `json:"created_at"`
+	LastTestedAt string           `json:"last_tested_at"`
+	SPF          DomainCheck      `json:"spf"`
+	DKIM         DomainCheck      `json:"dkim"`
+	VerifiedAt   string           `json:"verified_at"`
+	ValidSigning bool             `json:"valid_signing"`
+	DKIMRecord   *DomainDNSRecord `json:"dkim_record,omitempty"`
+}
+
+type DomainCheck struct {
+	Valid      bool   `json:"valid"`
+	ValidAfter string `json:"valid_after,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type DomainDNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Rejects
+type Reject struct {
+	Email       string `json:"email"`
+	Reason      string `json:"reason"`
+	Detail      string `json:"detail"`
+	CreatedAt   string `json:"created_at"`
+	LastEventAt string `json:"last_event_at"`
+	ExpiresAt   string `json:"expires_at"`
+	Expired     bool   `json:"expired"`
+	Sender      string `json:"sender,omitempty"`
+	Subaccount  string `json:"subaccount,omitempty"`
+}
+
+// CapturedMessage is a message received by the embedded SMTP server, with
+// its envelope and the SMTP conversation that delivered it.
+type CapturedMessage struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	RemoteAddr string    `json:"remote_addr"`
+	Helo       string    `json:"helo"`
+	TLS        bool      `json:"tls"`
+	AuthUser   string    `json:"auth_user,omitempty"`
+	MailFrom   string    `json:"mail_from"`
+	RcptTo     []string  `json:"rcpt_to"`
+	Subject    string    `json:"subject"`
+	Size       int       `json:"size"`
+	// MessageID is the _id of the sent message this is a copy of, if any.
+	MessageID  string   `json:"message_id,omitempty"`
+	Transcript []string `json:"transcript,omitempty"`
+	Raw        []byte   `json:"-"`
+}
+
+type RejectsAddRequest struct {
+	Key        string `json:"key"`
+	Email      string `json:"email"`
+	Comment    string `json:"comment,omitempty"`
+	Subaccount string `json:"subaccount,omitempty"`
+}
+
+type RejectsListRequest struct {
+	Key            string `json:"key"`
+	Email          string `json:"email,omitempty"`
+	IncludeExpired bool   `json:"include_expired,omitempty"`
+	Subaccount     string `json:"subaccount,omitempty"`
+}
+
+type RejectsDeleteRequest struct {
+	Key        string `json:"key"`
+	Email      string `json:"email"`
+	Subaccount string `json:"subaccount,omitempty"`
+}
+
+// BounceRequest feeds a raw bounce (DSN) to the dev bounce endpoint.
+type BounceRequest struct {
+	Key        string `json:"key"`
+	RawMessage string `json:"raw_message"`
+	RcptTo     string `json:"rcpt_to,omitempty"` // envelope recipient, e.g. a VERP address
 }
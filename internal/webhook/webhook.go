@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerson/mandrillfordev/internal/config"
+	"github.com/jerson/mandrillfordev/internal/types"
+)
+
+// Dispatcher posts message events to the configured webhook URLs using
+// Mandrill's form encoding (mandrill_events=<json array>).
+type Dispatcher struct {
+	urls   []string
+	key    string
+	client *http.Client
+}
+
+func NewDispatcher(cfg config.Config) *Dispatcher {
+	return &Dispatcher{urls: cfg.WebhookURLs, key: cfg.WebhookKey, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify delivers ev for message m to every webhook in the background.
+func (d *Dispatcher) Notify(m types.MessageRecord, ev types.MessageEvent) {
+	if len(d.urls) == 0 {
+		return
+	}
+	b, err := json.Marshal([]event{newEvent(m, ev)})
+	if err != nil {
+		log.Printf("webhook: encode %s event: %v", ev.Event, err)
+		return
+	}
+	for _, u := range d.urls {
+		go d.post(u, string(b))
+	}
+}
+
+func (d *Dispatcher) post(target, events string) {
+	form := url.Values{"mandrill_events": {events}}
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		log.Printf("webhook: %s: %v", target, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "Mandrill-Webhook/1.0")
+	if d.key != "" {
+		req.Header.Set("X-Mandrill-Signature", Sign(d.key, target, form))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		log.Printf("webhook: %s: %v", target, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("webhook: %s: unexpected status %s", target, resp.Status)
+	}
+}
+
+// Sign computes X-Mandrill-Signature: base64 HMAC-SHA1 over the webhook URL
+// followed by each POST key and value in key order.
+func Sign(key, target string, form url.Values) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(target))
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mac.Write([]byte(k))
+		mac.Write([]byte(form.Get(k)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// event is the Mandrill webhook event shape.
+type event struct {
+	types.MessageEvent
+	ID  string  `json:"_id"`
+	Msg message `json:"msg"`
+}
+
+type message struct {
+	TS       int64             `json:"ts"`
+	ID       string            `json:"_id"`
+	State    string            `json:"state"`
+	Subject  string            `json:"subject"`
+	Email    string            `json:"email"`
+	Sender   string            `json:"sender"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	Template *string           `json:"template"`
+	Opens    []engagement      `json:"opens"`
+	Clicks   []engagement      `json:"clicks"`
+
+	SMTPEvents        []types.SMTPEvent `json:"smtp_events"`
+	BounceDescription string            `json:"bounce_description,omitempty"`
+	Diag              string            `json:"diag,omitempty"`
+}
+
+type engagement struct {
+	TS  int64  `json:"ts"`
+	URL string `json:"url,omitempty"`
+}
+
+func newEvent(m types.MessageRecord, ev types.MessageEvent) event {
+	msg := message{
+		TS:       m.CreatedAt.Unix(),
+		ID:       m.ID,
+		State:    m.Status,
+		Subject:  m.Subject,
+		Sender:   m.From,
+		Tags:     m.Tags,
+		Metadata: m.Message.Metadata,
+		Opens:    []engagement{},
+		Clicks:   []engagement{},
+
+		SMTPEvents: append([]types.SMTPEvent{}, m.SMTPEvents...),
+	}
+	if ev.Email != "" {
+		msg.Email = ev.Email
+	} else if len(m.To) > 0 {
+		msg.Email = m.To[0]
+	}
+	if strings.HasSuffix(ev.Event, "bounce") {
+		msg.BounceDescription, msg.Diag = m.BounceDescription, m.Diag
+	}
+	if msg.Tags == nil {
+		msg.Tags = []string{}
+	}
+	if msg.Metadata == nil {
+		msg.Metadata = map[string]string{}
+	}
+	if m.TemplateName != "" {
+		name := m.TemplateName
+		msg.Template = &name
+	}
+	for _, o := range m.OpensDetail {
+		msg.Opens = append(msg.Opens, engagement{TS: o.TS})
+	}
+	for _, c := range m.ClicksDetail {
+		msg.Clicks = append(msg.Clicks, engagement{TS: c.TS, URL: c.URL})
+	}
+	return event{MessageEvent: ev, ID: m.ID, Msg: msg}
+}